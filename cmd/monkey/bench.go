@@ -0,0 +1,47 @@
+// The Monkey Language CLI benchmarking
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/freddiehaddad/monkey.compiler/pkg/repl"
+	"github.com/freddiehaddad/monkey.compiler/pkg/vm"
+)
+
+// benchFile compiles the script at path once and runs it n times in new
+// VMs, timing only the runs.
+func benchFile(path string, n int, stdout, stderr io.Writer) int {
+	bytecode, code := repl.CompileFile(path, stderr)
+	if code != repl.ExitOK {
+		return code
+	}
+
+	var min, max, total time.Duration
+	for i := 0; i < n; i++ {
+		machine := vm.New(bytecode)
+
+		start := time.Now()
+		err := machine.Run()
+		elapsed := time.Since(start)
+
+		if err != nil {
+			fmt.Fprintf(stderr, "Woops! Executing bytecode failed:\n %s\n", err)
+			return repl.ExitRuntimeError
+		}
+
+		if i == 0 || elapsed < min {
+			min = elapsed
+		}
+		if elapsed > max {
+			max = elapsed
+		}
+		total += elapsed
+	}
+
+	mean := total / time.Duration(n)
+	fmt.Fprintf(stdout, "Benchmark: N=%d min=%dµs mean=%dµs max=%dµs\n",
+		n, min.Microseconds(), mean.Microseconds(), max.Microseconds())
+	return repl.ExitOK
+}
@@ -0,0 +1,122 @@
+// The Monkey Language CLI bytecode files
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/freddiehaddad/monkey.compiler/pkg/code"
+	"github.com/freddiehaddad/monkey.compiler/pkg/compiler"
+	"github.com/freddiehaddad/monkey.compiler/pkg/repl"
+)
+
+// compileFile compiles the script at path and writes its bytecode to
+// output.
+func compileFile(path, output string, stdout, stderr io.Writer) int {
+	bytecode, code := repl.CompileFile(path, stderr)
+	if code != repl.ExitOK {
+		return code
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err)
+		return repl.ExitFileError
+	}
+
+	_, err = bytecode.WriteTo(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "writing %s: %s\n", output, err)
+		return repl.ExitFileError
+	}
+
+	fmt.Fprintf(stdout, "wrote %s: %d instructions\n", output,
+		countInstructions(bytecode.Instructions))
+	return repl.ExitOK
+}
+
+// countInstructions returns the number of instructions in ins, up to the
+// first one that can't be decoded.
+func countInstructions(ins code.Instructions) int {
+	count := 0
+	for offset := 0; offset < ins.Len(); count++ {
+		_, _, width, err := ins.At(offset)
+		if err != nil {
+			break
+		}
+		offset += width
+	}
+	return count
+}
+
+// readBytecodeFile reads the bytecode file at path, writing any error to
+// stderr.
+func readBytecodeFile(path string, stderr io.Writer) (*compiler.Bytecode, int) {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err)
+		return nil, repl.ExitFileError
+	}
+	defer file.Close()
+
+	bytecode, err := compiler.ReadFrom(bufio.NewReader(file))
+	if err != nil {
+		fmt.Fprintf(stderr, "reading %s: %s\n", path, err)
+		return nil, repl.ExitFileError
+	}
+
+	return bytecode, repl.ExitOK
+}
+
+// runBytecodeFile runs the bytecode file at path like a script, once it's
+// been validated.
+func runBytecodeFile(path string, stdout, stderr io.Writer) int {
+	bytecode, code := readBytecodeFile(path, stderr)
+	if code != repl.ExitOK {
+		return code
+	}
+
+	if err := bytecode.Validate(); err != nil {
+		fmt.Fprintf(stderr, "invalid bytecode in %s: %s\n", path, err)
+		return repl.ExitFileError
+	}
+
+	return repl.RunBytecode(bytecode, stdout, stderr)
+}
+
+// disassembleFile prints the instructions of the bytecode file at path
+// after a header, then those of each compiled function constant. Constant
+// operands are followed by their values. The bytecode is validated first.
+func disassembleFile(path string, stdout, stderr io.Writer) int {
+	bytecode, code := readBytecodeFile(path, stderr)
+	if code != repl.ExitOK {
+		return code
+	}
+
+	if err := bytecode.Validate(); err != nil {
+		fmt.Fprintf(stderr, "invalid bytecode in %s: %s\n", path, err)
+		return repl.ExitFileError
+	}
+
+	fmt.Fprintf(stdout, "%s version %d: %d instructions, %d constants\n",
+		compiler.BytecodeMagic, compiler.BytecodeVersion,
+		countInstructions(bytecode.Instructions), len(bytecode.Constants))
+	io.WriteString(stdout, bytecode.Instructions.Disassemble(bytecode.Constants))
+
+	for i, constant := range bytecode.Constants {
+		fn, ok := constant.(*compiler.CompiledFunction)
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(stdout, "\nfunction constant %d: %d parameters, %d locals\n",
+			i, fn.NumParameters, fn.NumLocals)
+		io.WriteString(stdout, fn.Instructions.Disassemble(bytecode.Constants))
+	}
+
+	return repl.ExitOK
+}
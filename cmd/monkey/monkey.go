@@ -2,23 +2,102 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/user"
+	"runtime"
 
 	"github.com/freddiehaddad/monkey.compiler/pkg/repl"
 )
 
+// Exit code for invalid arguments
+const exitUsage = 1
+
+const modulePath = "github.com/freddiehaddad/monkey.compiler"
+
+// Version is set at build time with -ldflags "-X main.Version=1.2.3"
+var Version = "dev"
+
 func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the CLI with the arguments after the program name and returns
+// the exit code.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("monkey", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: monkey [flags] [script.mk]\n")
+		flags.PrintDefaults()
+	}
+
+	output := flags.String("c", "", "compile the script to a bytecode `file` instead of running it")
+	input := flags.String("r", "", "run a bytecode `file` compiled with -c")
+	disassemble := flags.String("d", "", "disassemble a bytecode `file` compiled with -c")
+	bench := flags.Int("bench", 0, "run the script `N` times and report the run times")
+	version := flags.Bool("version", false, "print the version and exit")
+
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	switch {
+	case *version:
+		fmt.Fprintf(stdout, "%s %s %s\n", modulePath, Version, runtime.Version())
+		return repl.ExitOK
+	case *bench < 0:
+		fmt.Fprintf(stderr, "invalid value %d for -bench, want a positive count\n", *bench)
+		return exitUsage
+	case *bench > 0:
+		if flags.NArg() != 1 {
+			flags.Usage()
+			return exitUsage
+		}
+		return benchFile(flags.Arg(0), *bench, stdout, stderr)
+	case *output != "":
+		if flags.NArg() != 1 {
+			flags.Usage()
+			return exitUsage
+		}
+		return compileFile(flags.Arg(0), *output, stdout, stderr)
+	case *input != "":
+		if flags.NArg() != 0 {
+			flags.Usage()
+			return exitUsage
+		}
+		return runBytecodeFile(*input, stdout, stderr)
+	case *disassemble != "":
+		if flags.NArg() != 0 {
+			flags.Usage()
+			return exitUsage
+		}
+		return disassembleFile(*disassemble, stdout, stderr)
+	case flags.NArg() == 1:
+		// monkey script.mk runs the script instead of the REPL
+		return repl.RunFile(flags.Arg(0), stdout, stderr)
+	case flags.NArg() > 1:
+		flags.Usage()
+		return exitUsage
+	}
+
+	// Piped input runs without prompts or greetings
+	if !repl.IsInteractive(stdin) {
+		return repl.StartWithConfig(repl.Config{In: stdin, Out: stdout, ErrOut: stderr})
+	}
+
 	user, err := user.Current()
 	if err != nil {
 		log.Fatalf("Failed to get username: %s", err)
 	}
-	fmt.Printf("Hello %s! Welcome to the Monkey Language.\n", user.Username)
-	fmt.Println("Press Ctrl+D to exit")
+	fmt.Fprintf(stdout, "Hello %s! Welcome to the Monkey Language.\n", user.Username)
+	fmt.Fprintln(stdout, "Press Ctrl+D to exit")
 
-	repl.Start(os.Stdin, os.Stdout)
+	repl.Start(stdin, stdout)
 
-	fmt.Println("Goodbye", user.Username)
+	fmt.Fprintln(stdout, "Goodbye", user.Username)
+	return repl.ExitOK
 }
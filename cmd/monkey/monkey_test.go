@@ -0,0 +1,266 @@
+// The Monkey Language CLI unit tests
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/freddiehaddad/monkey.compiler/pkg/code"
+	"github.com/freddiehaddad/monkey.compiler/pkg/compiler"
+)
+
+// writeScript writes source to a file in a temporary directory and
+// returns its path.
+func writeScript(t *testing.T, source string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "script.mk")
+	if err := os.WriteFile(path, []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCompileFlag(t *testing.T) {
+	script := writeScript(t, "let a = 1; a + 2")
+	output := filepath.Join(t.TempDir(), "out.mkb")
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-c", output, script}, nil, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("wrong exit code. want=0, got=%d\n%s", code, stderr.String())
+	}
+
+	info, err := os.Stat(output)
+	if err != nil {
+		t.Fatalf("bytecode file not written: %s", err)
+	}
+	if info.Size() == 0 {
+		t.Errorf("bytecode file is empty")
+	}
+
+	// OpConstant, OpSetGlobal, OpGetGlobal, OpConstant, OpAdd, OpPop
+	expected := "wrote " + output + ": 6 instructions\n"
+	if stdout.String() != expected {
+		t.Errorf("wrong output. want=%q, got=%q", expected, stdout.String())
+	}
+
+	stdout.Reset()
+	code = run([]string{"-c", output, writeScript(t, "let b = 1;")}, nil, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("wrong exit code. want=0, got=%d\n%s", code, stderr.String())
+	}
+	if stderr.String() != "warning: unused variable b\n" {
+		t.Errorf("wrong warnings. want=%q, got=%q",
+			"warning: unused variable b\n", stderr.String())
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	code = run([]string{"-c", output, writeScript(t, "x")}, nil, &stdout, &stderr)
+	if code != 2 {
+		t.Errorf("compile error: wrong exit code. want=2, got=%d", code)
+	}
+	if !strings.Contains(stderr.String(), "undefined identifier x") {
+		t.Errorf("expected compile error, got %q", stderr.String())
+	}
+
+	stderr.Reset()
+	if code := run([]string{"-c", output}, nil, &stdout, &stderr); code != exitUsage {
+		t.Errorf("missing script: wrong exit code. want=%d, got=%d", exitUsage, code)
+	}
+	if !strings.Contains(stderr.String(), "usage: monkey") {
+		t.Errorf("expected usage, got %q", stderr.String())
+	}
+}
+
+func TestRunFlag(t *testing.T) {
+	source := `
+		let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } };
+		[fib(10), "done"]
+	`
+	script := writeScript(t, source)
+	output := filepath.Join(t.TempDir(), "out.mkb")
+
+	var direct, stderr bytes.Buffer
+	if code := run([]string{script}, nil, &direct, &stderr); code != 0 {
+		t.Fatalf("running the script failed with %d\n%s", code, stderr.String())
+	}
+
+	var stdout bytes.Buffer
+	if code := run([]string{"-c", output, script}, nil, &stdout, &stderr); code != 0 {
+		t.Fatalf("compiling the script failed with %d\n%s", code, stderr.String())
+	}
+
+	stdout.Reset()
+	if code := run([]string{"-r", output}, nil, &stdout, &stderr); code != 0 {
+		t.Fatalf("running the bytecode failed with %d\n%s", code, stderr.String())
+	}
+
+	if stdout.String() != direct.String() || direct.String() != "[55, done]\n" {
+		t.Errorf("outputs differ. script=%q, bytecode=%q", direct.String(), stdout.String())
+	}
+}
+
+func TestRunFlagErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	notBytecode := filepath.Join(dir, "script.mkb")
+	if err := os.WriteFile(notBytecode, []byte("let answer = 42;\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	version := filepath.Join(dir, "version.mkb")
+	if err := os.WriteFile(version, []byte("MONK\x63\x00\x00\x00\x00\x00\x00\x00\x00"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{filepath.Join(dir, "missing.mkb"), "no such file"},
+		{notBytecode, "not Monkey bytecode"},
+		{version, "unsupported bytecode version 99"},
+	}
+
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		if code := run([]string{"-r", tt.path}, nil, &stdout, &stderr); code != 1 {
+			t.Errorf("%s: wrong exit code. want=1, got=%d", tt.path, code)
+		}
+		if !strings.Contains(stderr.String(), tt.expected) {
+			t.Errorf("%s: expected error containing %q, got %q",
+				tt.path, tt.expected, stderr.String())
+		}
+	}
+}
+
+func TestDisassembleFlag(t *testing.T) {
+	script := writeScript(t, `let greet = fn(name) { "hi " + name }; greet("monkey")`)
+	output := filepath.Join(t.TempDir(), "out.mkb")
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-c", output, script}, nil, &stdout, &stderr); code != 0 {
+		t.Fatalf("compiling the script failed with %d\n%s", code, stderr.String())
+	}
+
+	stdout.Reset()
+	if code := run([]string{"-d", output}, nil, &stdout, &stderr); code != 0 {
+		t.Fatalf("disassembling failed with %d\n%s", code, stderr.String())
+	}
+
+	expected := `MONK version 2: 6 instructions, 3 constants
+0000 OpClosure 1 0
+0004 OpSetGlobal 0
+0007 OpGetGlobal 0
+0010 OpConstant 2 ; "monkey"
+0013 OpCall 1
+0015 OpPop
+
+function constant 1: 1 parameters, 1 locals
+0000 OpConstant 0 ; "hi "
+0003 OpGetLocal 0
+0005 OpAdd
+0006 OpReturnValue
+`
+	if stdout.String() != expected {
+		t.Errorf("wrong disassembly.\nwant=%q\ngot= %q", expected, stdout.String())
+	}
+}
+
+func TestDisassembleFlagInvalid(t *testing.T) {
+	// A lone OpConstant without its operand
+	bytecode := &compiler.Bytecode{Instructions: code.Instructions{byte(code.OpConstant)}}
+
+	path := filepath.Join(t.TempDir(), "truncated.mkb")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bytecode.WriteTo(file); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-d", path}, nil, &stdout, &stderr); code != 1 {
+		t.Errorf("wrong exit code. want=1, got=%d", code)
+	}
+
+	expected := "invalid bytecode in " + path + ": OpConstant at offset 0 is truncated\n"
+	if stderr.String() != expected {
+		t.Errorf("wrong error. want=%q, got=%q", expected, stderr.String())
+	}
+}
+
+func TestBenchFlag(t *testing.T) {
+	script := writeScript(t, "let a = 5; (a + 10 * 2 + 15 / 3) * 2 + -10")
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-bench", "10", script}, nil, &stdout, &stderr); code != 0 {
+		t.Fatalf("benchmark failed with %d\n%s", code, stderr.String())
+	}
+
+	expected := regexp.MustCompile(`^Benchmark: N=10 min=\d+µs mean=\d+µs max=\d+µs\n$`)
+	if !expected.MatchString(stdout.String()) {
+		t.Errorf("wrong output: %q", stdout.String())
+	}
+
+	stderr.Reset()
+	if code := run([]string{"-bench", "2", writeScript(t, "-true")}, nil, &stdout, &stderr); code != 3 {
+		t.Errorf("runtime error: wrong exit code. want=3, got=%d", code)
+	}
+	if code := run([]string{"-bench", "-1", script}, nil, &stdout, &stderr); code != exitUsage {
+		t.Errorf("negative count: wrong exit code. want=%d, got=%d", exitUsage, code)
+	}
+}
+
+func TestVersionFlag(t *testing.T) {
+	defer func(version string) { Version = version }(Version)
+	Version = "1.2.3"
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-version"}, nil, &stdout, &stderr); code != 0 {
+		t.Fatalf("wrong exit code. want=0, got=%d", code)
+	}
+
+	expected := regexp.MustCompile(`^github\.com/freddiehaddad/monkey\.compiler ` +
+		`\d+\.\d+\.\d+ ` + regexp.QuoteMeta(runtime.Version()) + `\n$`)
+	if !expected.MatchString(stdout.String()) {
+		t.Errorf("wrong output: %q", stdout.String())
+	}
+}
+
+func TestPipedInputErrors(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected int
+	}{
+		{"1 / a", 2},
+		{"let a = 0; 1 / a", 3},
+	}
+
+	for _, tt := range tests {
+		// A file isn't interactive, like a pipe
+		stdin, err := os.Open(writeScript(t, tt.source))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stdin.Close()
+
+		var stdout, stderr bytes.Buffer
+		if code := run(nil, stdin, &stdout, &stderr); code != tt.expected {
+			t.Errorf("%q: wrong exit code. want=%d, got=%d", tt.source, tt.expected, code)
+		}
+		if stdout.Len() != 0 || stderr.Len() == 0 {
+			t.Errorf("%q: errors not written to stderr. stdout=%q, stderr=%q",
+				tt.source, stdout.String(), stderr.String())
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// The Monkey Language built-in functions
+package builtins
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/freddiehaddad/monkey.interpreter/pkg/object"
+)
+
+// Builtins is indexed by OpGetBuiltin operands, the order must not change.
+var Builtins = []struct {
+	Name    string
+	Builtin *object.Builtin
+}{
+	{"len", &object.Builtin{Fn: builtinLen}},
+	{"puts", &object.Builtin{Fn: builtinPuts}},
+	{"first", &object.Builtin{Fn: builtinFirst}},
+	{"last", &object.Builtin{Fn: builtinLast}},
+	{"rest", &object.Builtin{Fn: builtinRest}},
+	{"push", &object.Builtin{Fn: builtinPush}},
+}
+
+func GetBuiltinByName(name string) *object.Builtin {
+	for _, def := range Builtins {
+		if def.Name == name {
+			return def.Builtin
+		}
+	}
+	return nil
+}
+
+func newError(format string, a ...interface{}) *object.Error {
+	return &object.Error{Message: fmt.Sprintf(format, a...)}
+}
+
+func builtinLen(args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1", len(args))
+	}
+
+	switch arg := args[0].(type) {
+	case *object.Array:
+		return &object.Integer{Value: int64(len(arg.Elements))}
+	case *object.String:
+		// Strings are indexed by rune
+		return &object.Integer{Value: int64(utf8.RuneCountInString(arg.Value))}
+	case *object.Hash:
+		return &object.Integer{Value: int64(len(arg.Pairs))}
+	default:
+		return newError("argument to `len` not supported, got %s", args[0].Type())
+	}
+}
+
+func builtinPuts(args ...object.Object) object.Object {
+	for _, arg := range args {
+		fmt.Println(arg.Inspect())
+	}
+	return nil
+}
+
+func builtinFirst(args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1", len(args))
+	}
+	if args[0].Type() != object.ARRAY_OBJ {
+		return newError("argument to `first` must be ARRAY, got %s", args[0].Type())
+	}
+
+	array := args[0].(*object.Array)
+	if len(array.Elements) > 0 {
+		return array.Elements[0]
+	}
+	return nil
+}
+
+func builtinLast(args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1", len(args))
+	}
+	if args[0].Type() != object.ARRAY_OBJ {
+		return newError("argument to `last` must be ARRAY, got %s", args[0].Type())
+	}
+
+	array := args[0].(*object.Array)
+	length := len(array.Elements)
+	if length > 0 {
+		return array.Elements[length-1]
+	}
+	return nil
+}
+
+func builtinRest(args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1", len(args))
+	}
+	if args[0].Type() != object.ARRAY_OBJ {
+		return newError("argument to `rest` must be ARRAY, got %s", args[0].Type())
+	}
+
+	array := args[0].(*object.Array)
+	length := len(array.Elements)
+	if length > 0 {
+		newElements := make([]object.Object, length-1)
+		copy(newElements, array.Elements[1:length])
+		return &object.Array{Elements: newElements}
+	}
+	return nil
+}
+
+func builtinPush(args ...object.Object) object.Object {
+	if len(args) != 2 {
+		return newError("wrong number of arguments. got=%d, want=2", len(args))
+	}
+	if args[0].Type() != object.ARRAY_OBJ {
+		return newError("argument to `push` must be ARRAY, got %s", args[0].Type())
+	}
+
+	array := args[0].(*object.Array)
+	length := len(array.Elements)
+
+	newElements := make([]object.Object, length+1)
+	copy(newElements, array.Elements)
+	newElements[length] = args[1]
+
+	return &object.Array{Elements: newElements}
+}
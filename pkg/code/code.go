@@ -3,8 +3,11 @@ package code
 
 import (
 	"bytes"
+	"crypto/md5"
 	"encoding/binary"
 	"fmt"
+
+	"github.com/freddiehaddad/monkey.interpreter/pkg/object"
 )
 
 type Instructions []byte
@@ -19,11 +22,17 @@ const (
 	OpNull Opcode = iota
 
 	OpConstant
+	OpConstantWide
 
 	OpPop
+	OpDup
+	OpSwap
 
 	OpJump
 	OpJumpNotTruthy
+	OpJumpWide
+	OpJumpNotTruthyWide
+	OpLoop
 
 	OpTrue
 	OpFalse
@@ -35,11 +44,21 @@ const (
 	OpSub
 	OpMul
 	OpDiv
+	OpMod
+
+	OpBitAnd
+	OpBitOr
+	OpBitXor
+	OpBitNot
+	OpLeftShift
+	OpRightShift
 
 	OpEqual
 	OpNotEqual
 	OpLessThan
 	OpGreaterThan
+	OpLessOrEqual
+	OpGreaterOrEqual
 
 	OpGetGlobal
 	OpSetGlobal
@@ -47,17 +66,50 @@ const (
 	OpIndex
 	OpArray
 	OpHash
+
+	OpGetLocal
+	OpSetLocal
+
+	OpCall
+	OpReturnValue
+	OpReturn
+
+	OpClosure
+	OpGetFree
+	OpCurrentClosure
+
+	OpGetBuiltin
+
+	// Added after the bytecode format was fixed, values of earlier opcodes
+	// must not change
+	OpIsNull
+
+	// Number of opcodes, new ones go before it
+	opCount
 )
 
 var definitions = map[Opcode]*Definition{
 	OpNull: {"OpNull", []int{}},
 
-	OpConstant: {"OpConstant", []int{2}},
+	OpConstant:     {"OpConstant", []int{2}},
+	OpConstantWide: {"OpConstantWide", []int{4}},
 
 	OpPop: {"OpPop", []int{}},
+	OpDup: {"OpDup", []int{}},
+
+	// OpSwap exchanges the top two stack elements. The compiler emits it
+	// when operands are pushed in the reverse of the order an operator
+	// expects them.
+	OpSwap: {"OpSwap", []int{}},
 
-	OpJump:          {"OpJump", []int{2}},
-	OpJumpNotTruthy: {"OpJumpNotTruthy", []int{2}},
+	OpJump:              {"OpJump", []int{2}},
+	OpJumpNotTruthy:     {"OpJumpNotTruthy", []int{2}},
+	OpJumpWide:          {"OpJumpWide", []int{4}},
+	OpJumpNotTruthyWide: {"OpJumpNotTruthyWide", []int{4}},
+
+	// The operand of OpLoop is the distance back from the OpLoop instruction
+	// to the jump target
+	OpLoop: {"OpLoop", []int{2}},
 
 	OpBang:  {"OpBang", []int{}},
 	OpMinus: {"OpMinus", []int{}},
@@ -69,18 +121,65 @@ var definitions = map[Opcode]*Definition{
 	OpSub: {"OpSub", []int{}},
 	OpMul: {"OpMul", []int{}},
 	OpDiv: {"OpDiv", []int{}},
+	OpMod: {"OpMod", []int{}},
+
+	OpBitAnd: {"OpBitAnd", []int{}},
+	OpBitOr:  {"OpBitOr", []int{}},
+	OpBitXor: {"OpBitXor", []int{}},
+	OpBitNot: {"OpBitNot", []int{}},
+
+	OpLeftShift:  {"OpLeftShift", []int{}},
+	OpRightShift: {"OpRightShift", []int{}},
 
 	OpEqual:       {"OpEqual", []int{}},
 	OpNotEqual:    {"OpNotEqual", []int{}},
 	OpLessThan:    {"OpLessThan", []int{}},
 	OpGreaterThan: {"OpGreaterThan", []int{}},
 
+	OpLessOrEqual:    {"OpLessOrEqual", []int{}},
+	OpGreaterOrEqual: {"OpGreaterOrEqual", []int{}},
+
 	OpGetGlobal: {"OpGetGlobal", []int{2}},
 	OpSetGlobal: {"OpSetGlobal", []int{2}},
 
 	OpIndex: {"OpIndex", []int{}},
 	OpArray: {"OpArray", []int{2}},
 	OpHash:  {"OpHash", []int{2}},
+
+	OpGetLocal: {"OpGetLocal", []int{1}},
+	OpSetLocal: {"OpSetLocal", []int{1}},
+
+	OpCall:        {"OpCall", []int{1}},
+	OpReturnValue: {"OpReturnValue", []int{}},
+	OpReturn:      {"OpReturn", []int{}},
+
+	OpClosure:        {"OpClosure", []int{2, 1}},
+	OpGetFree:        {"OpGetFree", []int{1}},
+	OpCurrentClosure: {"OpCurrentClosure", []int{}},
+
+	OpGetBuiltin: {"OpGetBuiltin", []int{1}},
+
+	// OpIsNull replaces the top stack element with whether it is null, the
+	// compiler emits it for comparisons with null
+	OpIsNull: {"OpIsNull", []int{}},
+}
+
+// String returns the name of the opcode's definition.
+func (op Opcode) String() string {
+	if def, ok := definitions[op]; ok {
+		return def.Name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", op)
+}
+
+// LookupName returns the opcode whose definition is called name.
+func LookupName(name string) (Opcode, error) {
+	for op, def := range definitions {
+		if def.Name == name {
+			return op, nil
+		}
+	}
+	return 0, fmt.Errorf("opcode %s undefined", name)
 }
 
 func Lookup(op byte) (*Definition, error) {
@@ -108,8 +207,12 @@ func Make(op Opcode, operands ...int) []byte {
 	for i, o := range operands {
 		width := def.OperandWidths[i]
 		switch width {
+		case 4:
+			binary.BigEndian.PutUint32(instruction[offset:], uint32(o))
 		case 2:
 			binary.BigEndian.PutUint16(instruction[offset:], uint16(o))
+		case 1:
+			instruction[offset] = byte(o)
 		}
 		offset += width
 	}
@@ -123,8 +226,12 @@ func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
 
 	for i, width := range def.OperandWidths {
 		switch width {
+		case 4:
+			operands[i] = int(ReadUint32(ins[offset:]))
 		case 2:
 			operands[i] = int(ReadUint16(ins[offset:]))
+		case 1:
+			operands[i] = int(ReadUint8(ins[offset:]))
 		}
 
 		offset += width
@@ -133,31 +240,138 @@ func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
 	return operands, offset
 }
 
+func ReadUint32(ins Instructions) uint32 {
+	return binary.BigEndian.Uint32(ins)
+}
+
 func ReadUint16(ins Instructions) uint16 {
 	return binary.BigEndian.Uint16(ins)
 }
 
+func ReadUint8(ins Instructions) uint8 {
+	return uint8(ins[0])
+}
+
+// Checksum returns the MD5 sum of the instruction bytes, for telling
+// whether cached instructions are still current.
+func (ins Instructions) Checksum() [16]byte {
+	return md5.Sum(ins)
+}
+
+// Len returns the length of the instructions in bytes.
+func (ins Instructions) Len() int {
+	return len(ins)
+}
+
+// At decodes the instruction starting at offset. It returns the opcode,
+// its operands and the number of bytes the whole instruction occupies, so
+// offset+width is the offset of the next instruction.
+func (ins Instructions) At(offset int) (Opcode, []int, int, error) {
+	if offset < 0 || offset >= len(ins) {
+		return 0, nil, 0, fmt.Errorf("offset %d out of range", offset)
+	}
+
+	def, err := Lookup(ins[offset])
+	if err != nil {
+		return 0, nil, 0, err
+	}
+
+	width := 1
+	for _, w := range def.OperandWidths {
+		width += w
+	}
+	if offset+width > len(ins) {
+		return 0, nil, 0, fmt.Errorf("%s at offset %d is truncated",
+			def.Name, offset)
+	}
+
+	operands, _ := ReadOperands(def, ins[offset+1:])
+
+	return Opcode(ins[offset]), operands, width, nil
+}
+
+// Slice returns a copy of the instructions from offset start up to end.
+// Both must be instruction boundaries, the offset of an instruction found
+// by walking with At from the beginning or the end of the instructions.
+func (ins Instructions) Slice(start, end int) (Instructions, error) {
+	if start < 0 || end > len(ins) || start > end {
+		return nil, fmt.Errorf("slice [%d:%d] out of range", start, end)
+	}
+
+	offset := 0
+	for offset < start {
+		_, _, width, err := ins.At(offset)
+		if err != nil {
+			return nil, err
+		}
+		offset += width
+	}
+	if offset != start {
+		return nil, fmt.Errorf("offset %d is not an instruction boundary", start)
+	}
+
+	for offset < end {
+		_, _, width, err := ins.At(offset)
+		if err != nil {
+			return nil, err
+		}
+		offset += width
+	}
+	if offset != end {
+		return nil, fmt.Errorf("offset %d is not an instruction boundary", end)
+	}
+
+	slice := make(Instructions, end-start)
+	copy(slice, ins[start:end])
+	return slice, nil
+}
+
 func (ins Instructions) String() string {
+	return ins.Disassemble(nil)
+}
+
+// Disassemble formats the instructions like String, annotating each
+// constant load with the value it refers to in constants.
+func (ins Instructions) Disassemble(constants []object.Object) string {
 	var out bytes.Buffer
 
 	i := 0
 	for i < len(ins) {
-		def, err := Lookup(ins[i])
+		op, operands, width, err := ins.At(i)
 		if err != nil {
 			fmt.Fprintf(&out, "ERROR: %s\n", err)
-			continue
+			if _, undefined := Lookup(ins[i]); undefined != nil {
+				i++
+				continue
+			}
+			// Truncated, the rest are the instruction's operand bytes
+			break
 		}
 
-		operands, read := ReadOperands(def, ins[i+1:])
+		def, _ := Lookup(byte(op))
+		fmt.Fprintf(&out, "%04d %s", i, ins.fmtInstruction(def, operands))
+
+		if op == OpConstant || op == OpConstantWide {
+			if index := operands[0]; index < len(constants) {
+				fmt.Fprintf(&out, " ; %s", fmtConstant(constants[index]))
+			}
+		}
 
-		fmt.Fprintf(&out, "%04d %s\n", i, ins.fmtInstruction(def, operands))
+		out.WriteString("\n")
 
-		i += 1 + read
+		i += width
 	}
 
 	return out.String()
 }
 
+func fmtConstant(obj object.Object) string {
+	if str, ok := obj.(*object.String); ok {
+		return fmt.Sprintf("%q", str.Value)
+	}
+	return obj.Inspect()
+}
+
 func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
 	operandCount := len(def.OperandWidths)
 
@@ -171,6 +385,8 @@ func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
 		return fmt.Sprintf("%s", def.Name)
 	case 1:
 		return fmt.Sprintf("%s %d", def.Name, operands[0])
+	case 2:
+		return fmt.Sprintf("%s %d %d", def.Name, operands[0], operands[1])
 	}
 
 	return fmt.Sprintf("ERROR: unhandled operandCount for %s\n", def.Name)
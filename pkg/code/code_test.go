@@ -1,7 +1,11 @@
 // The Monkey Language bytecode definition unit tests
 package code
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/freddiehaddad/monkey.interpreter/pkg/object"
+)
 
 func TestMake(t *testing.T) {
 	tests := []struct {
@@ -11,6 +15,9 @@ func TestMake(t *testing.T) {
 	}{
 		{OpConstant, []int{65534}, []byte{byte(OpConstant), 255, 254}},
 		{OpAdd, []int{}, []byte{byte(OpAdd)}},
+		{OpGetLocal, []int{255}, []byte{byte(OpGetLocal), 255}},
+		{OpClosure, []int{65534, 255}, []byte{byte(OpClosure), 255, 254, 255}},
+		{OpConstantWide, []int{65536}, []byte{byte(OpConstantWide), 0, 1, 0, 0}},
 	}
 
 	for _, tt := range tests {
@@ -36,12 +43,18 @@ func TestInstructionsString(t *testing.T) {
 		Make(OpConstant, 2),
 		Make(OpConstant, 65535),
 		Make(OpAdd),
+		Make(OpGetLocal, 1),
+		Make(OpClosure, 65535, 255),
+		Make(OpLoop, 16),
 	}
 
 	expected := `0000 OpConstant 1
 0003 OpConstant 2
 0006 OpConstant 65535
 0009 OpAdd
+0010 OpGetLocal 1
+0012 OpClosure 65535 255
+0016 OpLoop 16
 `
 
 	concatenated := Instructions{}
@@ -55,6 +68,243 @@ func TestInstructionsString(t *testing.T) {
 	}
 }
 
+func TestInstructionsDisassemble(t *testing.T) {
+	constants := []object.Object{
+		&object.Integer{Value: 5},
+		&object.String{Value: "hello"},
+		&object.Boolean{Value: true},
+	}
+
+	instructions := []Instructions{
+		Make(OpConstant, 0),
+		Make(OpConstant, 1),
+		Make(OpConstantWide, 2),
+		Make(OpAdd),
+		Make(OpConstant, 3),
+	}
+
+	// Out of range constant indexes are printed without a value
+	expected := `0000 OpConstant 0 ; 5
+0003 OpConstant 1 ; "hello"
+0006 OpConstantWide 2 ; true
+0011 OpAdd
+0012 OpConstant 3
+`
+
+	concatenated := Instructions{}
+	for _, ins := range instructions {
+		concatenated = append(concatenated, ins...)
+	}
+
+	if disassembled := concatenated.Disassemble(constants); disassembled != expected {
+		t.Errorf("instructions wrongly disassembled.\nwant=%q\ngot=%q",
+			expected, disassembled)
+	}
+
+	// Decoding stops at an instruction missing operand bytes
+	truncated := append(Instructions{255}, Make(OpAdd)...)
+	truncated = append(truncated, byte(OpConstant), 0)
+	expected = `ERROR: opcode 255 undefined
+0001 OpAdd
+ERROR: OpConstant at offset 2 is truncated
+`
+
+	if disassembled := truncated.Disassemble(constants); disassembled != expected {
+		t.Errorf("truncated instructions wrongly disassembled.\nwant=%q\ngot=%q",
+			expected, disassembled)
+	}
+}
+
+func TestOpcodeString(t *testing.T) {
+	tests := []struct {
+		op       Opcode
+		expected string
+	}{
+		{OpConstant, "OpConstant"},
+		{OpBitXor, "OpBitXor"},
+		{OpGetBuiltin, "OpGetBuiltin"},
+		{Opcode(255), "UNKNOWN(255)"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.op.String(); got != tt.expected {
+			t.Errorf("wrong opcode name. want=%q, got=%q", tt.expected, got)
+		}
+	}
+}
+
+func TestInstructionsAt(t *testing.T) {
+	tests := []struct {
+		op       Opcode
+		operands []int
+	}{
+		{OpConstant, []int{65534}},
+		{OpAdd, []int{}},
+		{OpGetLocal, []int{255}},
+		{OpClosure, []int{65535, 255}},
+		{OpJumpWide, []int{70000}},
+	}
+
+	ins := Instructions{}
+	for _, tt := range tests {
+		ins = append(ins, Make(tt.op, tt.operands...)...)
+	}
+
+	offset := 0
+	for i, tt := range tests {
+		op, operands, width, err := ins.At(offset)
+		if err != nil {
+			t.Fatalf("tests[%d] - unexpected error: %s", i, err)
+		}
+
+		if op != tt.op {
+			t.Errorf("tests[%d] - wrong opcode. want=%s, got=%s", i, tt.op, op)
+		}
+
+		if width != len(Make(tt.op, tt.operands...)) {
+			t.Errorf("tests[%d] - wrong width. want=%d, got=%d",
+				i, len(Make(tt.op, tt.operands...)), width)
+		}
+
+		if len(operands) != len(tt.operands) {
+			t.Fatalf("tests[%d] - wrong operands length. want=%d, got=%d",
+				i, len(tt.operands), len(operands))
+		}
+
+		for j, want := range tt.operands {
+			if operands[j] != want {
+				t.Errorf("tests[%d] - operand %d wrong. want=%d, got=%d",
+					i, j, want, operands[j])
+			}
+		}
+
+		offset += width
+	}
+
+	if offset != ins.Len() {
+		t.Errorf("walk ended at wrong offset. want=%d, got=%d", ins.Len(), offset)
+	}
+
+	if _, _, _, err := ins.At(ins.Len()); err == nil {
+		t.Errorf("expected error reading past the end")
+	}
+
+	truncated := Instructions(Make(OpConstant, 1)[:2])
+	if _, _, _, err := truncated.At(0); err == nil {
+		t.Errorf("expected error reading truncated instruction")
+	}
+}
+
+func TestInstructionsSlice(t *testing.T) {
+	ins := Instructions{}
+	ins = append(ins, Make(OpConstant, 1)...)
+	ins = append(ins, Make(OpConstant, 2)...)
+	ins = append(ins, Make(OpAdd)...)
+	ins = append(ins, Make(OpClosure, 3, 1)...)
+	ins = append(ins, Make(OpPop)...)
+
+	tests := []struct {
+		start, end int
+		expected   string
+	}{
+		{0, 0, ""},
+		{0, 3, "0000 OpConstant 1\n"},
+		{3, 7, "0000 OpConstant 2\n0003 OpAdd\n"},
+		{6, 12, "0000 OpAdd\n0001 OpClosure 3 1\n0005 OpPop\n"},
+		{12, 12, ""},
+	}
+
+	for i, tt := range tests {
+		slice, err := ins.Slice(tt.start, tt.end)
+		if err != nil {
+			t.Fatalf("tests[%d] - unexpected error: %s", i, err)
+		}
+
+		if slice.String() != tt.expected {
+			t.Errorf("tests[%d] - wrong instructions.\nwant=%q\ngot=%q",
+				i, tt.expected, slice.String())
+		}
+	}
+
+	slice, _ := ins.Slice(0, 3)
+	slice[0] = byte(OpPop)
+	if Opcode(ins[0]) != OpConstant {
+		t.Errorf("slice shares its bytes with the instructions")
+	}
+
+	errors := []struct {
+		start, end int
+		expected   string
+	}{
+		{-1, 3, "slice [-1:3] out of range"},
+		{0, 13, "slice [0:13] out of range"},
+		{7, 6, "slice [7:6] out of range"},
+		{1, 6, "offset 1 is not an instruction boundary"},
+		{3, 9, "offset 9 is not an instruction boundary"},
+	}
+
+	for i, tt := range errors {
+		_, err := ins.Slice(tt.start, tt.end)
+		if err == nil {
+			t.Fatalf("errors[%d] - expected error", i)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("errors[%d] - wrong error. want=%q, got=%q",
+				i, tt.expected, err)
+		}
+	}
+}
+
+func TestInstructionsChecksum(t *testing.T) {
+	a := Instructions(Make(OpConstant, 1))
+	b := Instructions(Make(OpConstant, 1))
+	c := Instructions(Make(OpConstant, 2))
+
+	if a.Checksum() != b.Checksum() {
+		t.Errorf("identical instructions have different checksums")
+	}
+	if a.Checksum() == c.Checksum() {
+		t.Errorf("a one byte change left the checksum unchanged")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	def, err := Lookup(byte(OpHash))
+	if err != nil {
+		t.Fatalf("definition not found: %q", err)
+	}
+	if def.Name != "OpHash" {
+		t.Errorf("wrong name. want=%q, got=%q", "OpHash", def.Name)
+	}
+	if len(def.OperandWidths) != 1 || def.OperandWidths[0] != 2 {
+		t.Errorf("wrong operand widths. want=[2], got=%v", def.OperandWidths)
+	}
+
+	// Every opcode in the const block needs a definition
+	for op := OpNull; op < opCount; op++ {
+		if _, err := Lookup(byte(op)); err != nil {
+			t.Errorf("opcode %d has no definition", op)
+		}
+	}
+}
+
+func TestLookupName(t *testing.T) {
+	for _, op := range []Opcode{OpConstant, OpClosure, OpGetBuiltin} {
+		got, err := LookupName(op.String())
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got != op {
+			t.Errorf("wrong opcode. want=%s, got=%s", op, got)
+		}
+	}
+
+	if _, err := LookupName("OpBogus"); err == nil {
+		t.Errorf("expected error for undefined name")
+	}
+}
+
 func TestReadOperands(t *testing.T) {
 	tests := []struct {
 		op        Opcode
@@ -62,6 +312,10 @@ func TestReadOperands(t *testing.T) {
 		bytesRead int
 	}{
 		{OpConstant, []int{65532}, 2},
+		{OpGetLocal, []int{255}, 1},
+		{OpClosure, []int{65535, 255}, 3},
+		{OpConstantWide, []int{4294967295}, 4},
+		{OpJumpWide, []int{70000}, 4},
 	}
 
 	for _, tt := range tests {
@@ -85,3 +339,31 @@ func TestReadOperands(t *testing.T) {
 		}
 	}
 }
+
+func TestOneByteOperandRoundTrip(t *testing.T) {
+	for op, def := range definitions {
+		if len(def.OperandWidths) != 1 || def.OperandWidths[0] != 1 {
+			continue
+		}
+
+		for _, want := range []int{0, 1, 127, 128, 255} {
+			instruction := Make(op, want)
+			if len(instruction) != 2 {
+				t.Fatalf("%s: instruction has wrong length. want=2, got=%d",
+					def.Name, len(instruction))
+			}
+
+			if got := int(ReadUint8(instruction[1:])); got != want {
+				t.Errorf("%s: ReadUint8 wrong. want=%d, got=%d", def.Name, want, got)
+			}
+
+			operands, n := ReadOperands(def, instruction[1:])
+			if n != 1 {
+				t.Fatalf("%s: n wrong. want=1, got=%d", def.Name, n)
+			}
+			if operands[0] != want {
+				t.Errorf("%s: operand wrong. want=%d, got=%d", def.Name, want, operands[0])
+			}
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// The Monkey Language bytecode serialization
+package compiler
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/freddiehaddad/monkey.compiler/pkg/code"
+	"github.com/freddiehaddad/monkey.interpreter/pkg/object"
+)
+
+// The serialized form starts with a header of the magic bytes, the format
+// version, the number of constants and the length of the instructions. The
+// constants and then the instructions follow it. Multi-byte values are big
+// endian like instruction operands.
+//
+// Version 2 added function names to compiled function constants and the
+// OpIsNull opcode. Readers of version 1 reject version 2 bytecode by its
+// header rather than failing on an unknown opcode.
+const (
+	BytecodeMagic   = "MONK"
+	BytecodeVersion = 2
+)
+
+// Type tags of serialized constants
+const (
+	tagInteger byte = iota + 1
+	tagString
+	tagBoolean
+	tagCompiledFunction
+)
+
+type bytecodeHeader struct {
+	Magic           [4]byte
+	Version         uint8
+	NumConstants    uint32
+	InstructionsLen uint32
+}
+
+// WriteTo writes the serialized instructions and constants of b to w.
+// Warnings are not written.
+func (b *Bytecode) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+
+	header := bytecodeHeader{
+		Version:         BytecodeVersion,
+		NumConstants:    uint32(len(b.Constants)),
+		InstructionsLen: uint32(len(b.Instructions)),
+	}
+	copy(header.Magic[:], BytecodeMagic)
+	binary.Write(&buf, binary.BigEndian, header)
+
+	for i, constant := range b.Constants {
+		if err := writeConstant(&buf, constant); err != nil {
+			return 0, fmt.Errorf("constant %d: %s", i, err)
+		}
+	}
+
+	buf.Write(b.Instructions)
+
+	return buf.WriteTo(w)
+}
+
+func writeConstant(buf *bytes.Buffer, obj object.Object) error {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		buf.WriteByte(tagInteger)
+		binary.Write(buf, binary.BigEndian, obj.Value)
+	case *object.String:
+		buf.WriteByte(tagString)
+		binary.Write(buf, binary.BigEndian, uint32(len(obj.Value)))
+		buf.WriteString(obj.Value)
+	case *object.Boolean:
+		buf.WriteByte(tagBoolean)
+		binary.Write(buf, binary.BigEndian, obj.Value)
+	case *CompiledFunction:
+		buf.WriteByte(tagCompiledFunction)
+		binary.Write(buf, binary.BigEndian, uint32(obj.NumLocals))
+		binary.Write(buf, binary.BigEndian, uint32(obj.NumParameters))
+		binary.Write(buf, binary.BigEndian, uint32(len(obj.Name)))
+		buf.WriteString(obj.Name)
+		binary.Write(buf, binary.BigEndian, uint32(len(obj.Instructions)))
+		buf.Write(obj.Instructions)
+	default:
+		return fmt.Errorf("cannot serialize %s", obj.Type())
+	}
+	return nil
+}
+
+// Checksum returns the SHA-1 sum of the serialized constants and
+// instructions of b, for telling whether cached bytecode is still current.
+// Constants that can't be serialized are hashed by type and inspection.
+func (b *Bytecode) Checksum() [20]byte {
+	var buf bytes.Buffer
+
+	binary.Write(&buf, binary.BigEndian, uint32(len(b.Constants)))
+	for _, constant := range b.Constants {
+		if err := writeConstant(&buf, constant); err != nil {
+			buf.WriteString(string(constant.Type()))
+			buf.WriteString(constant.Inspect())
+		}
+	}
+
+	buf.Write(b.Instructions)
+
+	return sha1.Sum(buf.Bytes())
+}
+
+// ReadFrom reads bytecode written by Bytecode.WriteTo from r.
+func ReadFrom(r io.Reader) (*Bytecode, error) {
+	var header bytecodeHeader
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, fmt.Errorf("reading header: %s", err)
+	}
+
+	if string(header.Magic[:]) != BytecodeMagic {
+		return nil, fmt.Errorf("not Monkey bytecode, magic %q", header.Magic)
+	}
+	if header.Version != BytecodeVersion {
+		return nil, fmt.Errorf("unsupported bytecode version %d", header.Version)
+	}
+
+	constants := []object.Object{}
+	for i := 0; i < int(header.NumConstants); i++ {
+		constant, err := readConstant(r)
+		if err != nil {
+			return nil, fmt.Errorf("constant %d: %s", i, err)
+		}
+		constants = append(constants, constant)
+	}
+
+	instructions, err := readBytes(r, header.InstructionsLen)
+	if err != nil {
+		return nil, fmt.Errorf("reading instructions: %s", err)
+	}
+
+	return &Bytecode{
+		Instructions: instructions,
+		Constants:    constants,
+	}, nil
+}
+
+func readConstant(r io.Reader) (object.Object, error) {
+	var tag byte
+	if err := binary.Read(r, binary.BigEndian, &tag); err != nil {
+		return nil, err
+	}
+
+	switch tag {
+	case tagInteger:
+		var value int64
+		if err := binary.Read(r, binary.BigEndian, &value); err != nil {
+			return nil, err
+		}
+		return &object.Integer{Value: value}, nil
+	case tagString:
+		var length uint32
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		value, err := readBytes(r, length)
+		if err != nil {
+			return nil, err
+		}
+		return &object.String{Value: string(value)}, nil
+	case tagBoolean:
+		var value bool
+		if err := binary.Read(r, binary.BigEndian, &value); err != nil {
+			return nil, err
+		}
+		return &object.Boolean{Value: value}, nil
+	case tagCompiledFunction:
+		var fields struct {
+			NumLocals     uint32
+			NumParameters uint32
+			NameLen       uint32
+		}
+		if err := binary.Read(r, binary.BigEndian, &fields); err != nil {
+			return nil, err
+		}
+		name, err := readBytes(r, fields.NameLen)
+		if err != nil {
+			return nil, err
+		}
+		var length uint32
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		instructions, err := readBytes(r, length)
+		if err != nil {
+			return nil, err
+		}
+		return &CompiledFunction{
+			Instructions:  instructions,
+			NumLocals:     int(fields.NumLocals),
+			NumParameters: int(fields.NumParameters),
+			Name:          string(name),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown constant tag %d", tag)
+}
+
+// readBytes reads exactly length bytes without trusting length for the
+// allocation, corrupted input can't make it reserve gigabytes.
+func readBytes(r io.Reader, length uint32) (code.Instructions, error) {
+	b, err := io.ReadAll(io.LimitReader(r, int64(length)))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != int(length) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, nil
+}
@@ -0,0 +1,155 @@
+// The Monkey Language bytecode serialization unit tests
+package compiler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBytecodeRoundTrip(t *testing.T) {
+	input := `
+		let greeting = "hello";
+		let adder = fn(a) { fn(b) { a + b } };
+		let values = [1, -2, 3];
+		if (true) { adder(10)(values[1]) } else { greeting }
+	`
+
+	compiler := New()
+	if err := compiler.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	expected := compiler.Bytecode()
+
+	var buf bytes.Buffer
+	n, err := expected.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo error: %s", err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("wrong byte count. want=%d, got=%d", buf.Len(), n)
+	}
+
+	actual, err := ReadFrom(&buf)
+	if err != nil {
+		t.Fatalf("ReadFrom error: %s", err)
+	}
+
+	if actual.Instructions.String() != expected.Instructions.String() {
+		t.Errorf("wrong instructions.\nwant=%q\ngot=%q",
+			expected.Instructions, actual.Instructions)
+	}
+
+	if len(actual.Constants) != len(expected.Constants) {
+		t.Fatalf("wrong number of constants. want=%d, got=%d",
+			len(expected.Constants), len(actual.Constants))
+	}
+
+	for i, want := range expected.Constants {
+		got := actual.Constants[i]
+
+		if fn, ok := want.(*CompiledFunction); ok {
+			gotFn, ok := got.(*CompiledFunction)
+			if !ok {
+				t.Errorf("constant %d is not a function. got=%T", i, got)
+				continue
+			}
+			if gotFn.Instructions.String() != fn.Instructions.String() ||
+				gotFn.NumLocals != fn.NumLocals ||
+				gotFn.NumParameters != fn.NumParameters ||
+				gotFn.Name != fn.Name {
+				t.Errorf("constant %d wrong. want=%+v, got=%+v", i, fn, gotFn)
+			}
+			continue
+		}
+
+		if got.Type() != want.Type() || got.Inspect() != want.Inspect() {
+			t.Errorf("constant %d wrong. want=%s, got=%s",
+				i, want.Inspect(), got.Inspect())
+		}
+	}
+}
+
+func TestReadFromErrors(t *testing.T) {
+	var valid bytes.Buffer
+	parseAndCompile(t, `"abc"`).WriteTo(&valid)
+
+	badVersion := append([]byte{}, valid.Bytes()...)
+	badVersion[4] = BytecodeVersion + 1
+
+	oldVersion := append([]byte{}, valid.Bytes()...)
+	oldVersion[4] = 1
+
+	// The tag of the first constant follows the 13 byte header
+	badTag := append([]byte{}, valid.Bytes()...)
+	badTag[13] = 99
+
+	tests := []struct {
+		input    []byte
+		expected string
+	}{
+		{[]byte("MON"), "reading header"},
+		{[]byte("JUNKJUNKJUNKJ"), "not Monkey bytecode"},
+		{badVersion, "unsupported bytecode version"},
+		{oldVersion, "unsupported bytecode version 1"},
+		{badTag, "unknown constant tag 99"},
+		{valid.Bytes()[:valid.Len()-1], "reading instructions"},
+	}
+
+	for i, tt := range tests {
+		_, err := ReadFrom(bytes.NewReader(tt.input))
+		if err == nil {
+			t.Errorf("test[%d] - expected error but resulted in none", i)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("test[%d] - wrong error. want=%q, got=%q",
+				i, tt.expected, err)
+		}
+	}
+}
+
+func TestBytecodeChecksum(t *testing.T) {
+	input := `let f = fn(x) { x * 2 }; f("a")`
+	a := parseAndCompile(t, input)
+	b := parseAndCompile(t, input)
+
+	if a.Checksum() != b.Checksum() {
+		t.Errorf("identical programs have different checksums")
+	}
+	if a.Instructions.Checksum() != b.Instructions.Checksum() {
+		t.Errorf("identical instructions have different checksums")
+	}
+
+	// Changes to the constants alone change the bytecode checksum
+	for _, changed := range []string{
+		`let f = fn(x) { x * 3 }; f("a")`,
+		`let f = fn(x) { x * 2 }; f("b")`,
+	} {
+		c := parseAndCompile(t, changed)
+		if a.Instructions.Checksum() != c.Instructions.Checksum() {
+			t.Fatalf("%s: expected the same instructions", changed)
+		}
+		if a.Checksum() == c.Checksum() {
+			t.Errorf("%s: checksum unchanged", changed)
+		}
+	}
+
+	c := parseAndCompile(t, `let g = fn(x) { x * 2 }; g("a"); g`)
+	if a.Instructions.Checksum() == c.Instructions.Checksum() {
+		t.Errorf("different instructions have the same checksum")
+	}
+	if a.Checksum() == c.Checksum() {
+		t.Errorf("different programs have the same checksum")
+	}
+}
+
+func parseAndCompile(t *testing.T, input string) *Bytecode {
+	t.Helper()
+
+	compiler := New()
+	if err := compiler.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	return compiler.Bytecode()
+}
@@ -3,7 +3,11 @@ package compiler
 
 import (
 	"fmt"
+	"math"
+	"sort"
+	"strings"
 
+	"github.com/freddiehaddad/monkey.compiler/pkg/builtins"
 	"github.com/freddiehaddad/monkey.compiler/pkg/code"
 	"github.com/freddiehaddad/monkey.interpreter/pkg/ast"
 	"github.com/freddiehaddad/monkey.interpreter/pkg/object"
@@ -12,16 +16,69 @@ import (
 type Bytecode struct {
 	Instructions code.Instructions
 	Constants    []object.Object
+	Warnings     []Warning
+}
+
+// Warning reports a likely mistake that does not stop compilation. The
+// parser records no source positions, so only the name is known.
+type Warning struct {
+	Name  string
+	Scope SymbolScope
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("unused variable %s", w.Name)
 }
 
 type Compiler struct {
+	constants []object.Object
+
+	// Index of each integer, string and boolean constant in constants
+	constantIndex map[object.HashKey]int
+
+	symbolTable *SymbolTable
+
+	// Whether the symbol table and constants were handed in by the caller of
+	// NewWithState, Reset then replaces them rather than reusing them
+	sharedState bool
+
+	scopes     []CompilationScope
+	scopeIndex int
+
+	// Recoverable errors of the program being compiled
+	errors []error
+
+	warnings []Warning
+
+	// Optimizations applied, see SetOptimizationLevel
+	optimizationLevel int
+}
+
+// DefaultOptimizationLevel is the optimization level of new compilers.
+const DefaultOptimizationLevel = 2
+
+// CompileErrors holds every error found in a program, in source order.
+type CompileErrors []error
+
+func (e CompileErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+type CompilationScope struct {
 	instructions code.Instructions
-	constants    []object.Object
 
 	lastInstruction     EmittedInstruction
 	previousInstruction EmittedInstruction
 
-	symbolTable *SymbolTable
+	// The furthest position a forward jump was set to land on
+	jumpTarget int
+
+	// Symbols bound by let statements in this scope
+	definitions []Symbol
 }
 
 type EmittedInstruction struct {
@@ -29,48 +86,172 @@ type EmittedInstruction struct {
 	Position int
 }
 
+// NewWithState returns a compiler for a program that follows the ones
+// compiled with symbolTable and constants before. It may use and redefine
+// their globals.
 func NewWithState(symbolTable *SymbolTable, constants []object.Object) *Compiler {
-	return &Compiler{
-		instructions: code.Instructions{},
-		constants:    constants,
+	c := New()
+	c.symbolTable = symbolTable
+	c.symbolTable.AllowRedefinition()
+	c.constants = constants
+	c.sharedState = true
+	for i, constant := range constants {
+		if key, ok := constant.(object.Hashable); ok {
+			if _, ok := c.constantIndex[key.HashKey()]; !ok {
+				c.constantIndex[key.HashKey()] = i
+			}
+		}
+	}
+	return c
+}
 
-		lastInstruction:     EmittedInstruction{},
-		previousInstruction: EmittedInstruction{},
+func New() *Compiler {
+	symbolTable := NewSymbolTable()
+	for i, v := range builtins.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
+
+	return &Compiler{
+		constants:     []object.Object{},
+		constantIndex: map[object.HashKey]int{},
 
 		symbolTable: symbolTable,
+
+		scopes:     []CompilationScope{newMainScope()},
+		scopeIndex: 0,
+
+		optimizationLevel: DefaultOptimizationLevel,
 	}
 }
 
-func New() *Compiler {
-	return &Compiler{
+// SetOptimizationLevel selects the optimizations applied to the programs
+// compiled after it. Level 0 compiles every expression as written. Level 1
+// folds constant integer expressions. Level 2 also drops the statements
+// after a return in a block, stores equal integer, string and boolean
+// constants once and rewrites instruction sequences as they are emitted,
+// see peepholeOptimize. Dropped statements are still checked for errors.
+func (c *Compiler) SetOptimizationLevel(level int) {
+	c.optimizationLevel = level
+}
+
+func newMainScope() CompilationScope {
+	return CompilationScope{
 		instructions: code.Instructions{},
-		constants:    []object.Object{},
 
 		lastInstruction:     EmittedInstruction{},
 		previousInstruction: EmittedInstruction{},
+	}
+}
+
+// Reset returns the compiler to the state New creates it in, so it can be
+// reused for an unrelated program. The memory of the constants, the
+// instructions and the symbol table is reused, Bytecode returned before
+// Reset must not be used after it. The symbol table and constants given to
+// NewWithState are left unchanged, the compiler gets its own instead.
+func (c *Compiler) Reset() {
+	for key := range c.constantIndex {
+		delete(c.constantIndex, key)
+	}
 
-		symbolTable: NewSymbolTable(),
+	if c.sharedState {
+		c.constants = []object.Object{}
+		c.symbolTable = NewSymbolTable()
+		c.sharedState = false
+	} else {
+		c.constants = c.constants[:0]
+		for c.symbolTable.outer != nil {
+			c.symbolTable = c.symbolTable.outer
+		}
+		c.symbolTable.clear()
+	}
+	for i, v := range builtins.Builtins {
+		c.symbolTable.DefineBuiltin(i, v.Name)
+	}
+
+	main := c.scopes[0]
+	c.scopes = c.scopes[:1]
+	c.scopes[0] = CompilationScope{
+		instructions: main.instructions[:0],
+		definitions:  main.definitions[:0],
+	}
+	c.scopeIndex = 0
+
+	c.errors = nil
+	c.warnings = nil
+	c.optimizationLevel = DefaultOptimizationLevel
+}
+
+// ResetInstructions discards the compiled instructions but keeps the
+// global symbol table and the constants, so the next program can refer to
+// the globals of the previous ones. Also recovers from a compilation that
+// failed inside a function.
+func (c *Compiler) ResetInstructions() {
+	for c.symbolTable.outer != nil {
+		c.symbolTable, _ = c.symbolTable.LeaveScope()
 	}
+	c.symbolTable.AllowRedefinition()
+
+	c.scopes = []CompilationScope{newMainScope()}
+	c.scopeIndex = 0
+	c.errors = nil
+	c.warnings = nil
 }
 
+// Compile compiles node into the current scope. The errors found are
+// returned together as CompileErrors.
 func (c *Compiler) Compile(node ast.Node) error {
+	if err := c.compile(node); err != nil {
+		c.errors = append(c.errors, err)
+	}
+
+	if len(c.errors) > 0 {
+		errs := CompileErrors(c.errors)
+		c.errors = nil
+		return errs
+	}
+	return nil
+}
+
+func (c *Compiler) compile(node ast.Node) error {
 	switch node := node.(type) {
 	case *ast.Program:
 		for _, s := range node.Statements {
-			if err := c.Compile(s); err != nil {
-				return err
+			if err := c.compile(s); err != nil {
+				c.errors = append(c.errors, err)
+				break
 			}
 		}
+
+		// Globals of earlier programs compiled with the same symbol table
+		// may still be used by later ones, only this program's are checked
+		c.checkUnused()
+		c.scopes[c.scopeIndex].definitions = nil
 	case *ast.ExpressionStatement:
-		if err := c.Compile(node.Expression); err != nil {
+		if err := c.compile(node.Expression); err != nil {
 			return err
 		}
 		c.emit(code.OpPop)
 	case *ast.InfixExpression:
-		if err := c.Compile(node.Left); err != nil {
+		switch node.Operator {
+		case "&&", "||", "??":
+			return c.compileLogical(node)
+		}
+
+		if c.optimizationLevel >= 1 {
+			if folded, ok := tryConstantFold(node); ok {
+				if err, ok := folded.(*object.Error); ok {
+					c.addError("%s", err.Message)
+					return nil
+				}
+				c.emitConstant(folded)
+				return nil
+			}
+		}
+
+		if err := c.compile(node.Left); err != nil {
 			return err
 		}
-		if err := c.Compile(node.Right); err != nil {
+		if err := c.compile(node.Right); err != nil {
 			return err
 		}
 		switch node.Operator {
@@ -82,6 +263,18 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpMul)
 		case "/":
 			c.emit(code.OpDiv)
+		case "%":
+			c.emit(code.OpMod)
+		case "&":
+			c.emit(code.OpBitAnd)
+		case "|":
+			c.emit(code.OpBitOr)
+		case "^":
+			c.emit(code.OpBitXor)
+		case "<<":
+			c.emit(code.OpLeftShift)
+		case ">>":
+			c.emit(code.OpRightShift)
 		case "==":
 			c.emit(code.OpEqual)
 		case "!=":
@@ -90,11 +283,19 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpLessThan)
 		case ">":
 			c.emit(code.OpGreaterThan)
+		case "<=":
+			c.emit(code.OpLessOrEqual)
+		case ">=":
+			c.emit(code.OpGreaterOrEqual)
 		default:
-			return fmt.Errorf("unknown operator %s", node.Operator)
+			c.addError("unknown operator %s", node.Operator)
 		}
 	case *ast.PrefixExpression:
-		if err := c.Compile(node.Right); err != nil {
+		if node.Operator == "++" || node.Operator == "--" {
+			return c.compileIncrement(node)
+		}
+
+		if err := c.compile(node.Right); err != nil {
 			return err
 		}
 		switch node.Operator {
@@ -102,92 +303,160 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpBang)
 		case "-":
 			c.emit(code.OpMinus)
+		case "~":
+			c.emit(code.OpBitNot)
 		default:
-			return fmt.Errorf("unknown prefix operator %s", node.Operator)
+			c.addError("unknown prefix operator %s", node.Operator)
 		}
 	case *ast.IfExpression:
-		if err := c.Compile(node.Condition); err != nil {
+		if err := c.compile(node.Condition); err != nil {
 			return err
 		}
 
-		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+		jumpNotTruthyPos := c.emitJump(code.OpJumpNotTruthy)
 
-		if err := c.Compile(node.Consequence); err != nil {
+		if err := c.compile(node.Consequence); err != nil {
 			return err
 		}
 
-		if c.lastInstructionIsPop() {
+		if c.lastInstructionIs(code.OpPop) {
 			c.removeLastPop()
 		}
 
-		jumpPos := c.emit(code.OpJump, 9999)
+		jumpPos := c.emitJump(code.OpJump)
 
-		afterConsequencePos := len(c.instructions)
-		c.changeOperand(jumpNotTruthyPos, afterConsequencePos)
+		afterConsequencePos := len(c.currentInstructions())
+		if err := c.changeOperand(jumpNotTruthyPos, afterConsequencePos); err != nil {
+			return err
+		}
 
 		if node.Alternative == nil {
 			c.emit(code.OpNull)
 		} else {
-			if err := c.Compile(node.Alternative); err != nil {
+			if err := c.compile(node.Alternative); err != nil {
 				return err
 			}
 
-			if c.lastInstructionIsPop() {
+			if c.lastInstructionIs(code.OpPop) {
 				c.removeLastPop()
 			}
 		}
 
-		afterAlternativePos := len(c.instructions)
-		c.changeOperand(jumpPos, afterAlternativePos)
+		afterAlternativePos := len(c.currentInstructions())
+		if err := c.changeOperand(jumpPos, afterAlternativePos); err != nil {
+			return err
+		}
 	case *ast.BlockStatement:
-		for _, s := range node.Statements {
-			if err := c.Compile(s); err != nil {
+		for i, s := range node.Statements {
+			if err := c.compile(s); err != nil {
 				return err
 			}
+
+			if _, ok := s.(*ast.ReturnStatement); ok && c.optimizationLevel >= 2 {
+				return c.compileUnreachable(node.Statements[i+1:])
+			}
 		}
 	case *ast.LetStatement:
-		if err := c.Compile(node.Value); err != nil {
+		// A function bound by let can refer to itself by that name
+		if fn, ok := node.Value.(*ast.FunctionLiteral); ok {
+			if err := c.compileFunction(fn, node.Name.Value); err != nil {
+				return err
+			}
+		} else if err := c.compile(node.Value); err != nil {
 			return err
 		}
-		symbol := c.symbolTable.Define(node.Name.Value)
-		c.emit(code.OpSetGlobal, symbol.Index)
+		// The parser has no type annotations, every let is untyped
+		symbol, err := c.symbolTable.Define(node.Name.Value, "")
+		if err != nil {
+			c.errors = append(c.errors, err)
+			return nil
+		}
+		c.scopes[c.scopeIndex].definitions = append(
+			c.scopes[c.scopeIndex].definitions, symbol)
+		if symbol.Scope == GlobalScope {
+			c.emit(code.OpSetGlobal, symbol.Index)
+		} else {
+			c.emit(code.OpSetLocal, symbol.Index)
+		}
 	case *ast.Identifier:
 		symbol, ok := c.symbolTable.Resolve(node.Value)
 		if !ok {
-			return fmt.Errorf("undefined identifier %s", node.Value)
+			c.addError("undefined identifier %s", node.Value)
+			return nil
+		}
+		c.loadSymbol(symbol)
+	case *ast.FunctionLiteral:
+		if err := c.compileFunction(node, ""); err != nil {
+			return err
+		}
+	case *ast.ReturnStatement:
+		// The main program has no frame to return from
+		if c.scopeIndex == 0 {
+			c.addError("return outside function")
+			return nil
+		}
+
+		if node.ReturnValue == nil {
+			c.emit(code.OpReturn)
+			return nil
+		}
+		if err := c.compile(node.ReturnValue); err != nil {
+			return err
+		}
+		c.emit(code.OpReturnValue)
+	case *ast.CallExpression:
+		if err := c.compile(node.Function); err != nil {
+			return err
+		}
+		for _, a := range node.Arguments {
+			if err := c.compile(a); err != nil {
+				return err
+			}
 		}
-		c.emit(code.OpGetGlobal, symbol.Index)
+		c.emit(code.OpCall, len(node.Arguments))
 	case *ast.IndexExpression:
-		if err := c.Compile(node.Left); err != nil {
+		if err := c.compile(node.Left); err != nil {
 			return err
 		}
-		if err := c.Compile(node.Index); err != nil {
+		if err := c.compile(node.Index); err != nil {
 			return err
 		}
 		c.emit(code.OpIndex)
 	case *ast.ArrayLiteral:
 		for _, e := range node.Elements {
-			if err := c.Compile(e); err != nil {
+			if err := c.compile(e); err != nil {
 				return err
 			}
 		}
 		c.emit(code.OpArray, len(node.Elements))
 	case *ast.HashLiteral:
-		for k, v := range node.Pairs {
-			if err := c.Compile(k); err != nil {
+		// Map iteration order is random, sort the keys for stable output
+		keys := []ast.Expression{}
+		for k := range node.Pairs {
+			if k == nil {
+				return fmt.Errorf("unsupported node encountered %T (%+v)", k, k)
+			}
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+
+		for _, k := range keys {
+			if err := c.compile(k); err != nil {
 				return err
 			}
-			if err := c.Compile(v); err != nil {
+			if err := c.compile(node.Pairs[k]); err != nil {
 				return err
 			}
 		}
 		c.emit(code.OpHash, len(node.Pairs))
 	case *ast.StringLiteral:
 		string := &object.String{Value: node.Value}
-		c.emit(code.OpConstant, c.addConstant(string))
+		c.emitConstant(string)
 	case *ast.IntegerLiteral:
 		integer := &object.Integer{Value: node.Value}
-		c.emit(code.OpConstant, c.addConstant(integer))
+		c.emitConstant(integer)
 	case *ast.Boolean:
 		if node.Value {
 			c.emit(code.OpTrue)
@@ -201,20 +470,239 @@ func (c *Compiler) Compile(node ast.Node) error {
 	return nil
 }
 
+// compileUnreachable compiles statements that follow a return, so their
+// errors are still reported, and then drops their instructions.
+func (c *Compiler) compileUnreachable(statements []ast.Statement) error {
+	scope := c.scopes[c.scopeIndex]
+	end := len(scope.instructions)
+
+	for _, s := range statements {
+		if err := c.compile(s); err != nil {
+			return err
+		}
+	}
+
+	c.scopes[c.scopeIndex].instructions = c.scopes[c.scopeIndex].instructions[:end]
+	c.scopes[c.scopeIndex].lastInstruction = scope.lastInstruction
+	c.scopes[c.scopeIndex].previousInstruction = scope.previousInstruction
+
+	return nil
+}
+
+// compileLogical compiles &&, || and ?? so the right operand only runs
+// when the left one doesn't decide the result. The operand that decides it
+// is the value of the expression. ?? only runs its right operand when the
+// left one is null.
+func (c *Compiler) compileLogical(node *ast.InfixExpression) error {
+	if err := c.compile(node.Left); err != nil {
+		return err
+	}
+
+	// The copy is consumed by the test, the left value stays as the result
+	// unless the right operand is needed
+	c.emit(code.OpDup)
+	if node.Operator == "??" {
+		c.emit(code.OpNull)
+		c.emit(code.OpEqual)
+	}
+	jumpNotTruthyPos := c.emitJump(code.OpJumpNotTruthy)
+
+	jumpPos := -1
+	if node.Operator == "||" {
+		jumpPos = c.emitJump(code.OpJump)
+		if err := c.changeOperand(jumpNotTruthyPos, len(c.currentInstructions())); err != nil {
+			return err
+		}
+	}
+
+	c.emit(code.OpPop)
+	if err := c.compile(node.Right); err != nil {
+		return err
+	}
+
+	endPos := len(c.currentInstructions())
+	if jumpPos == -1 {
+		return c.changeOperand(jumpNotTruthyPos, endPos)
+	}
+	return c.changeOperand(jumpPos, endPos)
+}
+
+// compileIncrement compiles ++x and --x, which store x plus or minus one
+// back into x. The new value is the value of the expression. Only globals
+// and locals can be changed.
+func (c *Compiler) compileIncrement(node *ast.PrefixExpression) error {
+	ident, ok := node.Right.(*ast.Identifier)
+	if !ok {
+		c.addError("operand of %s must be an identifier", node.Operator)
+		return nil
+	}
+
+	symbol, ok := c.symbolTable.Resolve(ident.Value)
+	if !ok {
+		c.addError("undefined identifier %s", ident.Value)
+		return nil
+	}
+	if symbol.Scope != GlobalScope && symbol.Scope != LocalScope {
+		c.addError("cannot assign to %s", ident.Value)
+		return nil
+	}
+
+	c.loadSymbol(symbol)
+	c.emitConstant(&object.Integer{Value: 1})
+	if node.Operator == "++" {
+		c.emit(code.OpAdd)
+	} else {
+		c.emit(code.OpSub)
+	}
+
+	// The set consumes a copy, the new value stays on the stack
+	c.emit(code.OpDup)
+	if symbol.Scope == GlobalScope {
+		c.emit(code.OpSetGlobal, symbol.Index)
+	} else {
+		c.emit(code.OpSetLocal, symbol.Index)
+	}
+
+	return nil
+}
+
+func (c *Compiler) compileFunction(node *ast.FunctionLiteral, name string) error {
+	c.enterScope()
+
+	if name != "" {
+		c.symbolTable.DefineFunctionName(name)
+	}
+
+	for _, p := range node.Parameters {
+		if _, err := c.symbolTable.Define(p.Value, ""); err != nil {
+			c.errors = append(c.errors, err)
+		}
+	}
+
+	if err := c.compile(node.Body); err != nil {
+		return err
+	}
+
+	// The value of the last expression is implicitly returned
+	if c.lastInstructionIs(code.OpPop) {
+		c.replaceLastPopWithReturn()
+	}
+	if !c.lastInstructionIs(code.OpReturnValue) && !c.lastInstructionIs(code.OpReturn) {
+		c.emit(code.OpReturn)
+	}
+
+	numLocals := c.symbolTable.numDefinitions
+	instructions, freeSymbols := c.leaveScope()
+
+	// Load the captured values so OpClosure can collect them
+	for _, s := range freeSymbols {
+		c.loadSymbol(s)
+	}
+
+	compiledFn := &CompiledFunction{
+		Instructions:  instructions,
+		NumLocals:     numLocals,
+		NumParameters: len(node.Parameters),
+		Name:          name,
+	}
+	fnIndex := c.addConstant(compiledFn)
+	if fnIndex > math.MaxUint16 {
+		return fmt.Errorf("too many constants for function %d", fnIndex)
+	}
+	c.emit(code.OpClosure, fnIndex, len(freeSymbols))
+
+	return nil
+}
+
 func (c *Compiler) Bytecode() *Bytecode {
 	return &Bytecode{
-		Instructions: c.instructions,
+		Instructions: c.currentInstructions(),
 		Constants:    c.constants,
+		Warnings:     c.warnings,
 	}
 }
 
+// addError records an error the compiler can continue after and emits
+// OpNull in place of the value the failed node would have pushed. Errors
+// that leave the instructions unusable are returned from Compile instead.
+func (c *Compiler) addError(format string, a ...interface{}) {
+	c.errors = append(c.errors, fmt.Errorf(format, a...))
+	c.emit(code.OpNull)
+}
+
+// addConstant returns the index of obj in the constant pool, appending it
+// unless an equal integer, string or boolean is already there. Other
+// constants, such as compiled functions, are always appended.
 func (c *Compiler) addConstant(obj object.Object) int {
+	key, hashable := obj.(object.Hashable)
+	if hashable && c.optimizationLevel >= 2 {
+		i, ok := c.constantIndex[key.HashKey()]
+		if ok && sameConstant(c.constants[i], obj) {
+			return i
+		}
+	}
+
 	posNewConstant := len(c.constants)
 	c.constants = append(c.constants, obj)
+
+	if hashable {
+		if _, ok := c.constantIndex[key.HashKey()]; !ok {
+			c.constantIndex[key.HashKey()] = posNewConstant
+		}
+	}
+
 	return posNewConstant
 }
 
+// sameConstant reports whether a and b have the same type and value. Hash
+// keys of strings can collide.
+func sameConstant(a, b object.Object) bool {
+	switch a := a.(type) {
+	case *object.Integer:
+		b, ok := b.(*object.Integer)
+		return ok && a.Value == b.Value
+	case *object.String:
+		b, ok := b.(*object.String)
+		return ok && a.Value == b.Value
+	case *object.Boolean:
+		b, ok := b.(*object.Boolean)
+		return ok && a.Value == b.Value
+	}
+	return false
+}
+
+// emitConstant adds obj to the constant pool and emits the instruction
+// loading it, using the wide variant once the pool outgrows 2 bytes.
+func (c *Compiler) emitConstant(obj object.Object) int {
+	index := c.addConstant(obj)
+	if index > math.MaxUint16 {
+		return c.emit(code.OpConstantWide, index)
+	}
+	return c.emit(code.OpConstant, index)
+}
+
+// emitJump emits a jump with a placeholder address to be set through
+// changeOperand. The target of a forward jump is not yet known, so the wide
+// variant is used once the jump itself is beyond a 2 byte address.
+func (c *Compiler) emitJump(op code.Opcode) int {
+	if len(c.currentInstructions()) > math.MaxUint16 {
+		switch op {
+		case code.OpJump:
+			op = code.OpJumpWide
+		case code.OpJumpNotTruthy:
+			op = code.OpJumpNotTruthyWide
+		}
+	}
+	return c.emit(op, 9999)
+}
+
 func (c *Compiler) emit(op code.Opcode, operands ...int) int {
+	if c.optimizationLevel >= 2 {
+		if pos, ok := c.peepholeOptimize(op); ok {
+			return pos
+		}
+	}
+
 	ins := code.Make(op, operands...)
 	pos := c.addInstruction(ins)
 
@@ -223,38 +711,173 @@ func (c *Compiler) emit(op code.Opcode, operands ...int) int {
 	return pos
 }
 
+// peepholeOptimize rewrites the last instructions together with op, the
+// one about to be emitted, when they have a shorter equivalent. A
+// comparison of two booleans becomes its result and a comparison with null
+// becomes OpIsNull. It returns the position of the rewritten instruction
+// and whether op was part of a rewrite. Instructions a jump lands inside
+// of are left alone, the jump would skip part of the sequence.
+func (c *Compiler) peepholeOptimize(op code.Opcode) (int, bool) {
+	if op != code.OpEqual && op != code.OpNotEqual {
+		return 0, false
+	}
+
+	scope := &c.scopes[c.scopeIndex]
+	last, previous := scope.lastInstruction, scope.previousInstruction
+	if len(scope.instructions) == 0 {
+		return 0, false
+	}
+
+	isBoolean := func(i EmittedInstruction) bool {
+		return i.OpCode == code.OpTrue || i.OpCode == code.OpFalse
+	}
+
+	// After removeLastPop the previous instruction is the last one, only
+	// adjacent instructions are a sequence
+	if isBoolean(last) && isBoolean(previous) &&
+		previous.Position+1 == last.Position &&
+		scope.jumpTarget <= previous.Position {
+		result := code.OpFalse
+		if (last.OpCode == previous.OpCode) == (op == code.OpEqual) {
+			result = code.OpTrue
+		}
+
+		scope.instructions = scope.instructions[:last.Position]
+		c.replaceInstruction(previous.Position, code.Make(result))
+		scope.lastInstruction = EmittedInstruction{result, previous.Position}
+		scope.previousInstruction = scope.lastInstruction
+		return previous.Position, true
+	}
+
+	if last.OpCode == code.OpNull && op == code.OpEqual &&
+		scope.jumpTarget <= last.Position {
+		c.replaceInstruction(last.Position, code.Make(code.OpIsNull))
+		scope.lastInstruction.OpCode = code.OpIsNull
+		return last.Position, true
+	}
+
+	return 0, false
+}
+
+func (c *Compiler) loadSymbol(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpGetGlobal, s.Index)
+	case LocalScope:
+		c.emit(code.OpGetLocal, s.Index)
+	case FreeScope:
+		c.emit(code.OpGetFree, s.Index)
+	case FunctionScope:
+		c.emit(code.OpCurrentClosure)
+	case BuiltinScope:
+		c.emit(code.OpGetBuiltin, s.Index)
+	}
+}
+
+func (c *Compiler) currentInstructions() code.Instructions {
+	return c.scopes[c.scopeIndex].instructions
+}
+
+func (c *Compiler) enterScope() {
+	scope := CompilationScope{
+		instructions: code.Instructions{},
+
+		lastInstruction:     EmittedInstruction{},
+		previousInstruction: EmittedInstruction{},
+	}
+	c.scopes = append(c.scopes, scope)
+	c.scopeIndex++
+
+	c.symbolTable = c.symbolTable.EnterScope()
+}
+
+// leaveScope returns the instructions of the scope left and the symbols
+// its function captured.
+func (c *Compiler) leaveScope() (code.Instructions, []Symbol) {
+	instructions := c.currentInstructions()
+
+	c.checkUnused()
+
+	c.scopes = c.scopes[:len(c.scopes)-1]
+	c.scopeIndex--
+
+	var freeSymbols []Symbol
+	c.symbolTable, freeSymbols = c.symbolTable.LeaveScope()
+
+	return instructions, freeSymbols
+}
+
+// checkUnused adds a warning for every symbol bound by let in the current
+// scope that was never resolved.
+func (c *Compiler) checkUnused() {
+	for _, symbol := range c.scopes[c.scopeIndex].definitions {
+		if c.symbolTable.Usages(symbol) == 0 {
+			c.warnings = append(c.warnings, Warning{symbol.Name, symbol.Scope})
+		}
+	}
+}
+
 func (c *Compiler) addInstruction(ins []byte) int {
-	posNewInstruction := len(c.instructions)
-	c.instructions = append(c.instructions, ins...)
+	posNewInstruction := len(c.currentInstructions())
+	c.scopes[c.scopeIndex].instructions = append(c.currentInstructions(), ins...)
 	return posNewInstruction
 }
 
 func (c *Compiler) setLastInstruction(op code.Opcode, pos int) {
-	previous := c.lastInstruction
+	previous := c.scopes[c.scopeIndex].lastInstruction
 	last := EmittedInstruction{OpCode: op, Position: pos}
 
-	c.previousInstruction = previous
-	c.lastInstruction = last
+	c.scopes[c.scopeIndex].previousInstruction = previous
+	c.scopes[c.scopeIndex].lastInstruction = last
 }
 
-func (c *Compiler) lastInstructionIsPop() bool {
-	return c.lastInstruction.OpCode == code.OpPop
+func (c *Compiler) lastInstructionIs(op code.Opcode) bool {
+	if len(c.currentInstructions()) == 0 {
+		return false
+	}
+	return c.scopes[c.scopeIndex].lastInstruction.OpCode == op
 }
 
 func (c *Compiler) removeLastPop() {
-	c.instructions = c.instructions[:c.lastInstruction.Position]
-	c.lastInstruction = c.previousInstruction
+	last := c.scopes[c.scopeIndex].lastInstruction
+	previous := c.scopes[c.scopeIndex].previousInstruction
+
+	c.scopes[c.scopeIndex].instructions = c.currentInstructions()[:last.Position]
+	c.scopes[c.scopeIndex].lastInstruction = previous
+}
+
+func (c *Compiler) replaceLastPopWithReturn() {
+	lastPos := c.scopes[c.scopeIndex].lastInstruction.Position
+	c.replaceInstruction(lastPos, code.Make(code.OpReturnValue))
+
+	c.scopes[c.scopeIndex].lastInstruction.OpCode = code.OpReturnValue
 }
 
 func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
+	ins := c.currentInstructions()
+
 	for i := 0; i < len(newInstruction); i++ {
-		c.instructions[pos+i] = newInstruction[i]
+		ins[pos+i] = newInstruction[i]
 	}
 }
 
-func (c *Compiler) changeOperand(opPos int, operand int) {
-	op := code.Opcode(c.instructions[opPos])
-	newInstruction := code.Make(op, operand)
+func (c *Compiler) changeOperand(opPos int, operand int) error {
+	op := code.Opcode(c.currentInstructions()[opPos])
+
+	def, err := code.Lookup(byte(op))
+	if err != nil {
+		return err
+	}
+	if def.OperandWidths[0] == 2 && operand > math.MaxUint16 {
+		return fmt.Errorf("operand %d out of range for %s", operand, def.Name)
+	}
 
+	newInstruction := code.Make(op, operand)
 	c.replaceInstruction(opPos, newInstruction)
+
+	if operand > c.scopes[c.scopeIndex].jumpTarget {
+		c.scopes[c.scopeIndex].jumpTarget = operand
+	}
+
+	return nil
 }
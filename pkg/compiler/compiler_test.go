@@ -3,6 +3,8 @@ package compiler
 
 import (
 	"fmt"
+	"math"
+	"strings"
 	"testing"
 
 	"github.com/freddiehaddad/monkey.compiler/pkg/code"
@@ -14,37 +16,528 @@ import (
 
 type compilerTestCase struct {
 	input                string
+	program              *ast.Program // Used instead of input when set
 	expectedConstants    []interface{}
 	expectedInstructions []code.Instructions
 }
 
+func TestCompilerScopes(t *testing.T) {
+	compiler := New()
+	if compiler.scopeIndex != 0 {
+		t.Errorf("scopeIndex wrong. got=%d, want=%d", compiler.scopeIndex, 0)
+	}
+	globalSymbolTable := compiler.symbolTable
+
+	compiler.emit(code.OpMul)
+
+	compiler.enterScope()
+	if compiler.scopeIndex != 1 {
+		t.Errorf("scopeIndex wrong. got=%d, want=%d", compiler.scopeIndex, 1)
+	}
+
+	compiler.emit(code.OpSub)
+
+	if len(compiler.scopes[compiler.scopeIndex].instructions) != 1 {
+		t.Errorf("instructions length wrong. got=%d",
+			len(compiler.scopes[compiler.scopeIndex].instructions))
+	}
+
+	last := compiler.scopes[compiler.scopeIndex].lastInstruction
+	if last.OpCode != code.OpSub {
+		t.Errorf("lastInstruction.OpCode wrong. got=%d, want=%d",
+			last.OpCode, code.OpSub)
+	}
+
+	if compiler.symbolTable.outer != globalSymbolTable {
+		t.Errorf("compiler did not enclose symbolTable")
+	}
+
+	compiler.leaveScope()
+	if compiler.scopeIndex != 0 {
+		t.Errorf("scopeIndex wrong. got=%d, want=%d", compiler.scopeIndex, 0)
+	}
+
+	if compiler.symbolTable != globalSymbolTable {
+		t.Errorf("compiler did not restore global symbol table")
+	}
+	if compiler.symbolTable.outer != nil {
+		t.Errorf("compiler modified global symbol table incorrectly")
+	}
+
+	compiler.emit(code.OpAdd)
+
+	if len(compiler.scopes[compiler.scopeIndex].instructions) != 2 {
+		t.Errorf("instructions length wrong. got=%d",
+			len(compiler.scopes[compiler.scopeIndex].instructions))
+	}
+
+	last = compiler.scopes[compiler.scopeIndex].lastInstruction
+	if last.OpCode != code.OpAdd {
+		t.Errorf("lastInstruction.OpCode wrong. got=%d, want=%d",
+			last.OpCode, code.OpAdd)
+	}
+
+	previous := compiler.scopes[compiler.scopeIndex].previousInstruction
+	if previous.OpCode != code.OpMul {
+		t.Errorf("previousInstruction.OpCode wrong. got=%d, want=%d",
+			previous.OpCode, code.OpMul)
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "fn() { return 5 + 10 }",
+			expectedConstants: []interface{}{
+				15,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { 5 + 10 }",
+			expectedConstants: []interface{}{
+				15,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpReturn),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestFunctionCalls(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "fn() { 24 }();",
+			expectedConstants: []interface{}{
+				24,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpCall, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+				let oneArg = fn(a) { a };
+				oneArg(24);
+			`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+				24,
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+				let manyArg = fn(a, b, c) { a; b; c };
+				manyArg(24, 25, 26);
+			`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpPop),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpPop),
+					code.Make(code.OpGetLocal, 2),
+					code.Make(code.OpReturnValue),
+				},
+				24,
+				25,
+				26,
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpCall, 3),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestLetStatementScopes(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+				let num = 55;
+				fn() { num }
+			`,
+			expectedConstants: []interface{}{
+				55,
+				[]code.Instructions{
+					code.Make(code.OpGetGlobal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+				fn() {
+					let num = 55;
+					num
+				}
+			`,
+			expectedConstants: []interface{}{
+				55,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+				let a = 1;
+				fn() {
+					let a = 55;
+					let b = 77;
+					a + b
+				}
+			`,
+			expectedConstants: []interface{}{
+				1,
+				55,
+				77,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpConstant, 2),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestClosures(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+				fn(a) {
+					fn(b) {
+						a + b
+					}
+				}
+			`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 0, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+				fn(a) {
+					fn(b) {
+						fn(c) {
+							a + b + c
+						}
+					}
+				};
+			`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpGetFree, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 0, 2),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 1, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+				let global = 55;
+
+				fn() {
+					let a = 66;
+
+					fn() {
+						let b = 77;
+
+						fn() {
+							let c = 88;
+
+							global + a + b + c;
+						}
+					}
+				}
+			`,
+			expectedConstants: []interface{}{
+				55,
+				66,
+				77,
+				88,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 3),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetGlobal, 0),
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpGetFree, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpConstant, 2),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 4, 2),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 5, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpClosure, 6, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestRecursiveFunctions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+				let countDown = fn(x) { countDown(x - 1); };
+				countDown(1);
+			`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpCurrentClosure),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSub),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+				let wrapper = fn() {
+					let countDown = fn(x) { countDown(x - 1); };
+					countDown(1);
+				};
+				wrapper();
+			`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpCurrentClosure),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSub),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpClosure, 1, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpCall, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestBuiltins(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+				len([]);
+				push([], 1);
+			`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpGetBuiltin, 0),
+				code.Make(code.OpArray, 0),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpGetBuiltin, 5),
+				code.Make(code.OpArray, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpCall, 2),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { len([]) }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetBuiltin, 0),
+					code.Make(code.OpArray, 0),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
 func TestIndexExpressions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
 			input:             "[1, 2, 3][1 + 1]",
-			expectedConstants: []interface{}{1, 2, 3, 1, 1},
+			expectedConstants: []interface{}{1, 2, 3},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
 				code.Make(code.OpConstant, 2),
 				code.Make(code.OpArray, 3),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpAdd),
+				code.Make(code.OpConstant, 1),
 				code.Make(code.OpIndex),
 				code.Make(code.OpPop),
 			},
 		},
 		{
 			input:             "{1: 2}[2 - 1]",
-			expectedConstants: []interface{}{1, 2, 2, 1},
+			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
 				code.Make(code.OpHash, 1),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpSub),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpIndex),
 				code.Make(code.OpPop),
 			},
@@ -76,114 +569,681 @@ func TestHashLiterals(t *testing.T) {
 		},
 		{ // 2
 			input:             "{1 + 2: 3}",
-			expectedConstants: []interface{}{1, 2, 3},
+			expectedConstants: []interface{}{3},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpAdd),
-				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpHash, 1),
 				code.Make(code.OpPop),
 			},
 		},
 		{ // 3
 			input:             "{1: 2 + 3}",
-			expectedConstants: []interface{}{1, 2, 3},
+			expectedConstants: []interface{}{1, 5},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpAdd),
 				code.Make(code.OpHash, 1),
 				code.Make(code.OpPop),
 			},
 		},
 		{ // 4
 			input:             "{0 + 1: 2 + 3}",
-			expectedConstants: []interface{}{0, 1, 2, 3},
+			expectedConstants: []interface{}{1, 5},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpAdd),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpAdd),
 				code.Make(code.OpHash, 1),
 				code.Make(code.OpPop),
 			},
 		},
 		{ // 5
 			input:             "{0: 1 + 2, 3: 4 + 5}",
-			expectedConstants: []interface{}{0, 1, 2, 3, 4, 5},
+			expectedConstants: []interface{}{0, 3, 9},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 1),
 				code.Make(code.OpConstant, 2),
-				code.Make(code.OpAdd),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpConstant, 5),
-				code.Make(code.OpAdd),
 				code.Make(code.OpHash, 2),
 				code.Make(code.OpPop),
 			},
 		},
 		{ // 6
 			input:             "{0 + 1: 2, 3 + 4: 5}",
-			expectedConstants: []interface{}{0, 1, 2, 3, 4, 5},
+			expectedConstants: []interface{}{1, 2, 7, 5},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpAdd),
 				code.Make(code.OpConstant, 2),
 				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
+				code.Make(code.OpHash, 2),
+				code.Make(code.OpPop),
+			},
+		},
+		{ // 7
+			input:             `{"a": "b" + "c"}`,
+			expectedConstants: []interface{}{"a", "b", "c"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
 				code.Make(code.OpAdd),
-				code.Make(code.OpConstant, 5),
+				code.Make(code.OpHash, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{ // 8
+			input:             `{"b": 1, "a": 2}`,
+			expectedConstants: []interface{}{"a", 2, "b", 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 3),
 				code.Make(code.OpHash, 2),
 				code.Make(code.OpPop),
 			},
 		},
+		{ // 9
+			input:             "{true: 1, false: 2}",
+			expectedConstants: []interface{}{2, 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpFalse),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpTrue),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpHash, 2),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestArrayLiterals(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "[]",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpArray, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "[1, 2, 3]",
+			expectedConstants: []interface{}{1, 2, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpArray, 3),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "[1 + 2, 3 - 4, 5 * 6]",
+			expectedConstants: []interface{}{3, -1, 30},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpArray, 3),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `["a" + "b", "c"]`,
+			expectedConstants: []interface{}{"a", "b", "c"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpArray, 2),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+func TestStringExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `"monkey"`,
+			expectedConstants: []interface{}{"monkey"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"mon" + "key"`,
+			expectedConstants: []interface{}{"mon", "key"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestGlobalLetStatements(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+				let one = 1;
+				let two = 2;
+			`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 1),
+			},
+		},
+		{
+			input: `
+				let one = 1;
+				one;
+			`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+				let one = 1;
+				let two = one;
+				two;
+			`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestWideConstants(t *testing.T) {
+	const count = math.MaxUint16 + 2
+
+	literals := []ast.Expression{}
+	for i := 0; i < count; i++ {
+		literals = append(literals, integerLiteral(int64(i)))
+	}
+
+	compiler := New()
+	if err := compiler.Compile(expressionProgram(literals...)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+	if len(bytecode.Constants) != count {
+		t.Fatalf("wrong number of constants. got=%d, want=%d",
+			len(bytecode.Constants), count)
+	}
+
+	// Every narrow load is followed by OpPop, 4 bytes per statement
+	narrowLen := (math.MaxUint16 + 1) * 4
+	expected := concatenateInstructions([]code.Instructions{
+		code.Make(code.OpConstant, math.MaxUint16),
+		code.Make(code.OpPop),
+		code.Make(code.OpConstantWide, math.MaxUint16+1),
+		code.Make(code.OpPop),
+	})
+
+	actual := bytecode.Instructions[narrowLen-4:]
+	if err := testInstructions([]code.Instructions{expected}, actual); err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+}
+
+func TestWideJumps(t *testing.T) {
+	// Enough statements to push the conditional past a 2 byte address
+	statements := []ast.Statement{}
+	for i := 0; i < (math.MaxUint16+1)/2; i++ {
+		statements = append(statements, &ast.ExpressionStatement{
+			Expression: booleanLiteral(true),
+		})
+	}
+	program := &ast.Program{Statements: statements}
+	program.Statements = append(program.Statements, parse("if (false) { 10 }").Statements...)
+
+	compiler := New()
+	if err := compiler.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	start := math.MaxUint16 + 1
+	expected := []code.Instructions{
+		code.Make(code.OpFalse),
+		code.Make(code.OpJumpNotTruthyWide, start+14),
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpJumpWide, start+15),
+		code.Make(code.OpNull),
+		code.Make(code.OpPop),
+	}
+
+	actual := compiler.Bytecode().Instructions[start:]
+	if err := testInstructions(expected, actual); err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+}
+
+func TestNarrowJumpOutOfRange(t *testing.T) {
+	consequence := &ast.BlockStatement{}
+	for i := 0; i < (math.MaxUint16+1)/2; i++ {
+		consequence.Statements = append(consequence.Statements,
+			&ast.ExpressionStatement{Expression: booleanLiteral(true)})
+	}
+
+	program := expressionProgram(&ast.IfExpression{
+		Condition:   booleanLiteral(true),
+		Consequence: consequence,
+	})
+
+	compiler := New()
+	err := compiler.Compile(program)
+	if err == nil {
+		t.Fatalf("expected compiler error but resulted in none.")
+	}
+
+	expected := "operand 65544 out of range for OpJumpNotTruthy"
+	if err.Error() != expected {
+		t.Fatalf("wrong compiler error: want=%q, got=%q", expected, err)
+	}
+}
+
+func TestConditionals(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "if (true) { 10 }; 3333;",
+			expectedConstants: []interface{}{10, 3333},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 10),
+				// 0004
+				code.Make(code.OpConstant, 0),
+				// 0007
+				code.Make(code.OpJump, 11),
+				// 0010
+				code.Make(code.OpNull),
+				// 0011
+				code.Make(code.OpPop),
+				// 0012
+				code.Make(code.OpConstant, 1),
+				// 0015
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "if (true) { 10 } else { 20 }; 3333;",
+			expectedConstants: []interface{}{10, 20, 3333},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 10),
+				// 0004
+				code.Make(code.OpConstant, 0), // 10
+				// 0007
+				code.Make(code.OpJump, 13),
+				// 0010
+				code.Make(code.OpConstant, 1), // 20
+				// 0013
+				code.Make(code.OpPop),
+				// 0014
+				code.Make(code.OpConstant, 2), // 3333
+				// 0017
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestBitwiseOperators(t *testing.T) {
+	tests := []compilerTestCase{}
+
+	for operator, op := range map[string]code.Opcode{
+		"&":  code.OpBitAnd,
+		"|":  code.OpBitOr,
+		"^":  code.OpBitXor,
+		"<<": code.OpLeftShift,
+		">>": code.OpRightShift,
+	} {
+		// Integer literal operands would be folded
+		program := parse("let a = 12;")
+		program.Statements = append(program.Statements, expressionProgram(
+			infixExpression(&ast.Identifier{Value: "a"}, operator, integerLiteral(10)),
+		).Statements...)
+
+		tests = append(tests, compilerTestCase{
+			program:           program,
+			expectedConstants: []interface{}{12, 10},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(op),
+				code.Make(code.OpPop),
+			},
+		})
+	}
+
+	tests = append(tests, compilerTestCase{
+		program:           expressionProgram(prefixExpression("~", integerLiteral(5))),
+		expectedConstants: []interface{}{5},
+		expectedInstructions: []code.Instructions{
+			code.Make(code.OpConstant, 0),
+			code.Make(code.OpBitNot),
+			code.Make(code.OpPop),
+		},
+	})
+
+	runCompilerTests(t, tests)
+}
+
+func TestLogicalOperators(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			program: expressionProgram(
+				infixExpression(booleanLiteral(true), "&&", integerLiteral(1)),
+				integerLiteral(2),
+			),
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpDup),
+				// 0002
+				code.Make(code.OpJumpNotTruthy, 9),
+				// 0005
+				code.Make(code.OpPop),
+				// 0006
+				code.Make(code.OpConstant, 0),
+				// 0009
+				code.Make(code.OpPop),
+				// 0010
+				code.Make(code.OpConstant, 1),
+				// 0013
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			program: expressionProgram(
+				infixExpression(booleanLiteral(false), "||", integerLiteral(1)),
+				integerLiteral(2),
+			),
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpFalse),
+				// 0001
+				code.Make(code.OpDup),
+				// 0002
+				code.Make(code.OpJumpNotTruthy, 8),
+				// 0005
+				code.Make(code.OpJump, 12),
+				// 0008
+				code.Make(code.OpPop),
+				// 0009
+				code.Make(code.OpConstant, 0),
+				// 0012
+				code.Make(code.OpPop),
+				// 0013
+				code.Make(code.OpConstant, 1),
+				// 0016
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			program: expressionProgram(
+				infixExpression(integerLiteral(5), "??", integerLiteral(42)),
+			),
+			expectedConstants: []interface{}{5, 42},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpDup),
+				// 0004
+				code.Make(code.OpIsNull),
+				// 0005
+				code.Make(code.OpJumpNotTruthy, 12),
+				// 0008
+				code.Make(code.OpPop),
+				// 0009
+				code.Make(code.OpConstant, 1),
+				// 0012
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestIncrementOperators(t *testing.T) {
+	global := parse("let x = 5;")
+	global.Statements = append(global.Statements, expressionProgram(
+		prefixExpression("++", &ast.Identifier{Value: "x"}),
+	).Statements...)
+
+	local := parse("fn() { let x = 5; }")
+	body := local.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.FunctionLiteral).Body
+	body.Statements = append(body.Statements, expressionProgram(
+		prefixExpression("--", &ast.Identifier{Value: "x"}),
+	).Statements...)
+
+	tests := []compilerTestCase{
+		{
+			program:           global,
+			expectedConstants: []interface{}{5, 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpDup),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			program: local,
+			expectedConstants: []interface{}{
+				5,
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSub),
+					code.Make(code.OpDup),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+
+	errorTests := []struct {
+		program  *ast.Program
+		expected string
+	}{
+		{
+			expressionProgram(prefixExpression("++", integerLiteral(1))),
+			"operand of ++ must be an identifier",
+		},
+		{
+			expressionProgram(prefixExpression("--", &ast.Identifier{Value: "y"})),
+			"undefined identifier y",
+		},
+		{
+			expressionProgram(prefixExpression("++", &ast.Identifier{Value: "len"})),
+			"cannot assign to len",
+		},
+	}
+
+	for i, tt := range errorTests {
+		compiler := New()
+		err := compiler.Compile(tt.program)
+		if err == nil {
+			t.Fatalf("test[%d] - expected compiler error but resulted in none", i)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("test[%d] - wrong compiler error. want=%q, got=%q",
+				i, tt.expected, err)
+		}
+	}
+}
+
+func TestComparisonOperators(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "10 == 10",
+			expectedConstants: []interface{}{10},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpEqual),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "10 != 10",
+			expectedConstants: []interface{}{10},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpNotEqual),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "true == true",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "true != false",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 < 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpLessThan),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 > 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpGreaterThan),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			program: expressionProgram(
+				infixExpression(integerLiteral(1), "<=", integerLiteral(2)),
+			),
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpLessOrEqual),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			program: expressionProgram(
+				infixExpression(integerLiteral(1), ">=", integerLiteral(2)),
+			),
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpGreaterOrEqual),
+				code.Make(code.OpPop),
+			},
+		},
 	}
 
 	runCompilerTests(t, tests)
 }
 
-func TestArrayLiterals(t *testing.T) {
+func TestBooleanExpressions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
-			input:             "[]",
+			input:             "true",
 			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpArray, 0),
+				code.Make(code.OpTrue),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input:             "[1, 2, 3]",
-			expectedConstants: []interface{}{1, 2, 3},
+			input:             "false",
+			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpArray, 3),
+				code.Make(code.OpFalse),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input:             "[1 + 2, 3 - 4, 5 * 6]",
-			expectedConstants: []interface{}{1, 2, 3, 4, 5, 6},
+			input:             "!true",
+			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpAdd),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpSub),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpConstant, 5),
-				code.Make(code.OpMul),
-				code.Make(code.OpArray, 3),
+				code.Make(code.OpTrue),
+				code.Make(code.OpBang),
 				code.Make(code.OpPop),
 			},
 		},
@@ -191,123 +1251,83 @@ func TestArrayLiterals(t *testing.T) {
 
 	runCompilerTests(t, tests)
 }
-func TestStringExpressions(t *testing.T) {
+
+func TestIntegerArithmetic(t *testing.T) {
 	tests := []compilerTestCase{
 		{
-			input:             `"monkey"`,
-			expectedConstants: []interface{}{"monkey"},
+			input:             "1 + 2",
+			expectedConstants: []interface{}{3},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input:             `"mon" + "key"`,
-			expectedConstants: []interface{}{"mon", "key"},
+			input:             "let a = 1; a + 2",
+			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpConstant, 1),
 				code.Make(code.OpAdd),
 				code.Make(code.OpPop),
 			},
 		},
-	}
-
-	runCompilerTests(t, tests)
-}
-
-func TestGlobalLetStatements(t *testing.T) {
-	tests := []compilerTestCase{
 		{
-			input: `
-				let one = 1;
-				let two = 2;
-			`,
-			expectedConstants: []interface{}{1, 2},
+			input:             "let a = 3; a - 2",
+			expectedConstants: []interface{}{3, 2},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpSub),
+				code.Make(code.OpPop),
 			},
 		},
 		{
-			input: `
-				let one = 1;
-				one;
-			`,
-			expectedConstants: []interface{}{1},
+			input:             "let a = 2; a * 2",
+			expectedConstants: []interface{}{2},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpSetGlobal, 0),
 				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpMul),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input: `
-				let one = 1;
-				let two = one;
-				two;
-			`,
-			expectedConstants: []interface{}{1},
+			input:             "let a = 10; a / 2",
+			expectedConstants: []interface{}{10, 2},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpSetGlobal, 0),
 				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpSetGlobal, 1),
-				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpDiv),
 				code.Make(code.OpPop),
 			},
 		},
-	}
-
-	runCompilerTests(t, tests)
-}
-
-func TestConditionals(t *testing.T) {
-	tests := []compilerTestCase{
 		{
-			input:             "if (true) { 10 }; 3333;",
-			expectedConstants: []interface{}{10, 3333},
+			input:             "-1",
+			expectedConstants: []interface{}{1},
 			expectedInstructions: []code.Instructions{
-				// 0000
-				code.Make(code.OpTrue),
-				// 0001
-				code.Make(code.OpJumpNotTruthy, 10),
-				// 0004
 				code.Make(code.OpConstant, 0),
-				// 0007
-				code.Make(code.OpJump, 11),
-				// 0010
-				code.Make(code.OpNull),
-				// 0011
-				code.Make(code.OpPop),
-				// 0012
-				code.Make(code.OpConstant, 1),
-				// 0015
+				code.Make(code.OpMinus),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input:             "if (true) { 10 } else { 20 }; 3333;",
-			expectedConstants: []interface{}{10, 20, 3333},
+			program: expressionProgram(
+				infixExpression(stringLiteral("10"), "%", integerLiteral(3)),
+			),
+			expectedConstants: []interface{}{"10", 3},
 			expectedInstructions: []code.Instructions{
-				// 0000
-				code.Make(code.OpTrue),
-				// 0001
-				code.Make(code.OpJumpNotTruthy, 10),
-				// 0004
-				code.Make(code.OpConstant, 0), // 10
-				// 0007
-				code.Make(code.OpJump, 13),
-				// 0010
-				code.Make(code.OpConstant, 1), // 20
-				// 0013
-				code.Make(code.OpPop),
-				// 0014
-				code.Make(code.OpConstant, 2), // 3333
-				// 0017
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMod),
 				code.Make(code.OpPop),
 			},
 		},
@@ -316,45 +1336,56 @@ func TestConditionals(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
-func TestComparisonOperators(t *testing.T) {
+func TestConstantFolding(t *testing.T) {
 	tests := []compilerTestCase{
 		{
-			input:             "10 == 10",
-			expectedConstants: []interface{}{10, 10},
+			input:             "2 + 3",
+			expectedConstants: []interface{}{5},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpEqual),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input:             "10 != 10",
-			expectedConstants: []interface{}{10, 10},
+			input:             "60 * 60 * 24",
+			expectedConstants: []interface{}{86400},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpNotEqual),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input:             "true == true",
-			expectedConstants: []interface{}{},
+			input:             "(10 - 4) / 3 + 1",
+			expectedConstants: []interface{}{3},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpTrue),
-				code.Make(code.OpTrue),
-				code.Make(code.OpEqual),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input:             "true != false",
-			expectedConstants: []interface{}{},
+			program: expressionProgram(
+				infixExpression(
+					infixExpression(integerLiteral(1), "<<", integerLiteral(4)),
+					"%",
+					integerLiteral(7),
+				),
+			),
+			expectedConstants: []interface{}{2},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpTrue),
-				code.Make(code.OpFalse),
-				code.Make(code.OpNotEqual),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// Only the foldable operand is folded
+			input:             "let a = 1; a + 2 * 3",
+			expectedConstants: []interface{}{1, 6},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
 				code.Make(code.OpPop),
 			},
 		},
@@ -368,114 +1399,496 @@ func TestComparisonOperators(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestConstantDeduplication(t *testing.T) {
+	tests := []compilerTestCase{
 		{
-			input:             "1 > 2",
-			expectedConstants: []interface{}{1, 2},
+			input:             `1; "a"; 1; "a"; 2`,
+			expectedConstants: []interface{}{1, "a", 2},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// Strings and integers with equal hash key values differ
+			input:             `1; "1"`,
+			expectedConstants: []interface{}{1, "1"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpGreaterThan),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// Functions are never shared
+			input: "fn() { 1 }; fn() { 1 }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpClosure, 2, 0),
 				code.Make(code.OpPop),
 			},
 		},
 	}
 
 	runCompilerTests(t, tests)
+
+	literals := []ast.Expression{}
+	for i := 0; i < 100; i++ {
+		literals = append(literals, integerLiteral(7))
+	}
+
+	compiler := New()
+	if err := compiler.Compile(expressionProgram(literals...)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	if n := len(compiler.Bytecode().Constants); n != 1 {
+		t.Errorf("wrong number of constants. want=1, got=%d", n)
+	}
 }
 
-func TestBooleanExpressions(t *testing.T) {
-	tests := []compilerTestCase{
+func BenchmarkCompileDuplicateConstants(b *testing.B) {
+	literals := []ast.Expression{}
+	for i := 0; i < 100; i++ {
+		literals = append(literals, integerLiteral(7))
+	}
+	program := expressionProgram(literals...)
+
+	for i := 0; i < b.N; i++ {
+		compiler := New()
+		if err := compiler.Compile(program); err != nil {
+			b.Fatalf("compiler error: %s", err)
+		}
+	}
+}
+
+func benchmarkCompile(b *testing.B, input string) {
+	program := parse(input)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := New().Compile(program); err != nil {
+			b.Fatalf("compiler error: %s", err)
+		}
+	}
+}
+
+func BenchmarkCompileArithmetic(b *testing.B) {
+	benchmarkCompile(b, "let a = 5; let b = a * 2 + 3; (a - b) * (a + b) / 2")
+}
+
+func BenchmarkCompileConditionals(b *testing.B) {
+	benchmarkCompile(b, `
+		let sign = fn(x) { if (x < 0) { -1 } else { if (x == 0) { 0 } else { 1 } } };
+		sign(-5) + sign(0) + sign(5)
+	`)
+}
+
+// Monkey has no loop statements, loops are written as recursion
+func BenchmarkCompileLoops(b *testing.B) {
+	benchmarkCompile(b, `
+		let map = fn(arr, f) {
+			let iter = fn(arr, acc) {
+				if (len(arr) == 0) { acc } else { iter(rest(arr), push(acc, f(first(arr)))) }
+			};
+			iter(arr, [])
+		};
+		map([1, 2, 3, 4], fn(x) { x * 2 })
+	`)
+}
+
+func BenchmarkCompileHashLiteral(b *testing.B) {
+	benchmarkCompile(b, `{"one": 1, "two": 2, "three": 3, true: [1, 2], 4: {"five": 5}}`)
+}
+
+func BenchmarkCompileNew(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		New()
+	}
+}
+
+func BenchmarkCompileWithReset(b *testing.B) {
+	program := parse("let a = 5; let b = a * 2 + 3; (a - b) * (a + b) / 2")
+	compiler := New()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		compiler.Reset()
+		if err := compiler.Compile(program); err != nil {
+			b.Fatalf("compiler error: %s", err)
+		}
+	}
+}
+
+func TestConstantFoldingErrors(t *testing.T) {
+	tests := []struct {
+		program  *ast.Program
+		expected string
+	}{
+		{parse("1 / 0"), "integer division by zero"},
+		{parse("fn() { 10 / (5 - 5) }"), "integer division by zero"},
 		{
-			input:             "true",
-			expectedConstants: []interface{}{},
+			expressionProgram(
+				infixExpression(integerLiteral(1), "%", integerLiteral(0)),
+			),
+			"integer modulo by zero",
+		},
+		{
+			expressionProgram(
+				infixExpression(integerLiteral(1), "<<", integerLiteral(-1)),
+			),
+			"negative shift amount: -1",
+		},
+	}
+
+	for i, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(tt.program)
+		if err == nil {
+			t.Fatalf("test[%d] - expected compiler error but resulted in none", i)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("test[%d] - wrong compiler error. want=%q, got=%q",
+				i, tt.expected, err)
+		}
+	}
+}
+
+func TestOptimizationLevels(t *testing.T) {
+	tests := []struct {
+		level                int
+		input                string
+		expectedConstants    []interface{}
+		expectedInstructions []code.Instructions
+	}{
+		{
+			level:             0,
+			input:             "2 + 3; 2",
+			expectedConstants: []interface{}{2, 3, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			level:             1,
+			input:             "2 + 3; 5",
+			expectedConstants: []interface{}{5, 5},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			level: 1,
+			input: "fn() { if (true) { return 1; 2 } }",
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpTrue),
+					// 0001
+					code.Make(code.OpJumpNotTruthy, 14),
+					// 0004
+					code.Make(code.OpConstant, 0),
+					// 0007
+					code.Make(code.OpReturnValue),
+					// 0008
+					code.Make(code.OpConstant, 1),
+					// 0011
+					code.Make(code.OpJump, 15),
+					// 0014
+					code.Make(code.OpNull),
+					// 0015
+					code.Make(code.OpReturnValue),
+				},
+			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpTrue),
+				code.Make(code.OpClosure, 2, 0),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input:             "false",
-			expectedConstants: []interface{}{},
+			level:             2,
+			input:             "2 + 3; 5",
+			expectedConstants: []interface{}{5},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpFalse),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input:             "!true",
-			expectedConstants: []interface{}{},
+			level: 2,
+			input: "fn() { if (true) { return 1; 2 } }",
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpTrue),
+					// 0001
+					code.Make(code.OpJumpNotTruthy, 11),
+					// 0004
+					code.Make(code.OpConstant, 0),
+					// 0007
+					code.Make(code.OpReturnValue),
+					// 0008
+					code.Make(code.OpJump, 12),
+					// 0011
+					code.Make(code.OpNull),
+					// 0012
+					code.Make(code.OpReturnValue),
+				},
+			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpTrue),
-				code.Make(code.OpBang),
+				code.Make(code.OpClosure, 2, 0),
 				code.Make(code.OpPop),
 			},
 		},
 	}
 
-	runCompilerTests(t, tests)
+	for i, tt := range tests {
+		compiler := New()
+		compiler.SetOptimizationLevel(tt.level)
+		if err := compiler.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("test[%d] - compiler error: %s", i, err)
+		}
+
+		bytecode := compiler.Bytecode()
+
+		if err := testInstructions(tt.expectedInstructions,
+			bytecode.Instructions); err != nil {
+			t.Fatalf("test[%d] - testInstructions failed: %s", i, err)
+		}
+
+		if err := testConstants(t, tt.expectedConstants, bytecode.Constants); err != nil {
+			t.Fatalf("test[%d] - testConstants failed: %s", i, err)
+		}
+	}
 }
 
-func TestIntegerArithmetic(t *testing.T) {
+func TestPeepholeOptimization(t *testing.T) {
 	tests := []compilerTestCase{
 		{
-			input:             "1 + 2",
-			expectedConstants: []interface{}{1, 2},
+			input:             "false == false; true == false; false != true",
+			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpAdd),
+				code.Make(code.OpTrue),
 				code.Make(code.OpPop),
-			},
-		},
-		{
-			input:             "3 - 2",
-			expectedConstants: []interface{}{3, 2},
-			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpSub),
+				code.Make(code.OpFalse),
+				code.Make(code.OpPop),
+				code.Make(code.OpTrue),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input:             "2 * 2",
-			expectedConstants: []interface{}{2, 2},
+			input:             "(true == true) == false",
+			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpMul),
+				code.Make(code.OpFalse),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input:             "10 / 2",
-			expectedConstants: []interface{}{10, 2},
+			// The jump over the consequence lands on the OpNull
+			input:             "1 == if (false) { 2 }",
+			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
+				// 0000
 				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpFalse),
+				// 0004
+				code.Make(code.OpJumpNotTruthy, 13),
+				// 0007
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpDiv),
+				// 0010
+				code.Make(code.OpJump, 14),
+				// 0013
+				code.Make(code.OpNull),
+				// 0014
+				code.Make(code.OpEqual),
+				// 0015
 				code.Make(code.OpPop),
 			},
 		},
+	}
+
+	runCompilerTests(t, tests)
+
+	// Instruction counts with and without the rewrites
+	inputs := []struct {
+		program *ast.Program
+		removed int
+	}{
+		{parse("true == true"), 2},
+		{parse("true != false == true"), 4},
 		{
-			input:             "-1",
-			expectedConstants: []interface{}{1},
-			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpMinus),
-				code.Make(code.OpPop),
-			},
+			expressionProgram(
+				infixExpression(integerLiteral(1), "??", integerLiteral(2)),
+			),
+			1,
 		},
 	}
 
-	runCompilerTests(t, tests)
+	for _, tt := range inputs {
+		count := func(level int) int {
+			compiler := New()
+			compiler.SetOptimizationLevel(level)
+			if err := compiler.Compile(tt.program); err != nil {
+				t.Fatalf("%q - compiler error: %s", tt.program, err)
+			}
+
+			n := 0
+			ins := compiler.Bytecode().Instructions
+			for offset := 0; offset < ins.Len(); {
+				_, _, width, err := ins.At(offset)
+				if err != nil {
+					t.Fatalf("%q - %s", tt.program, err)
+				}
+				offset += width
+				n++
+			}
+			return n
+		}
+
+		before, after := count(1), count(2)
+		if before-after != tt.removed {
+			t.Errorf("%q - wrong number of instructions removed. want=%d, got=%d",
+				tt.program, tt.removed, before-after)
+		}
+	}
+}
+
+func TestOptimizationLevelsCompared(t *testing.T) {
+	input := `
+	let double = fn(x) { return x * 2; x * 3 };
+	let a = 60 * 60 * 24;
+	let b = 60 * 60 * 24;
+	double(a + b);
+	`
+
+	compile := func(level int) *Bytecode {
+		compiler := New()
+		compiler.SetOptimizationLevel(level)
+		if err := compiler.Compile(parse(input)); err != nil {
+			t.Fatalf("level %d - compiler error: %s", level, err)
+		}
+		return compiler.Bytecode()
+	}
+
+	// Instructions of the main program and of every function
+	instructions := func(b *Bytecode) int {
+		n := len(b.Instructions)
+		for _, constant := range b.Constants {
+			if fn, ok := constant.(*CompiledFunction); ok {
+				n += len(fn.Instructions)
+			}
+		}
+		return n
+	}
+
+	none, full := compile(0), compile(2)
+
+	if len(full.Constants) >= len(none.Constants) {
+		t.Errorf("level 2 has %d constants, level 0 has %d",
+			len(full.Constants), len(none.Constants))
+	}
+
+	if instructions(full) >= instructions(none) {
+		t.Errorf("level 2 has %d bytes of instructions, level 0 has %d",
+			instructions(full), instructions(none))
+	}
+}
+
+func TestOptimizationLevelUnreachableErrors(t *testing.T) {
+	compiler := New()
+	err := compiler.Compile(parse("fn() { return 1; undefinedVariable }"))
+	if err == nil {
+		t.Fatalf("expected compiler error but resulted in none")
+	}
+
+	expected := "undefined identifier undefinedVariable"
+	if err.Error() != expected {
+		t.Errorf("wrong compiler error. want=%q, got=%q", expected, err)
+	}
+}
+
+func FuzzCompiler(f *testing.F) {
+	for _, seed := range []string{
+		"1 + 2 * 3",
+		`let s = "a" + "b"; len(s)`,
+		"let f = fn(x) { if (x > 1) { return x; } f(x - 1) }; f(3)",
+		"[1, 2, 3][1]",
+		`{"a": 1, true: [fn() { 2 }]}["a"]`,
+		"let a = 1; let adder = fn(b) { fn(c) { a + b + c } };",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("compiler panicked on %q: %v", input, r)
+			}
+		}()
+
+		compiler := New()
+		if err := compiler.Compile(parse(input)); err != nil && err.Error() == "" {
+			t.Fatalf("empty compiler error for %q", input)
+		}
+	})
 }
 
 func runCompilerTests(t *testing.T, tests []compilerTestCase) {
 	t.Helper()
 
 	for i, tt := range tests {
-		program := parse(tt.input)
+		program := tt.program
+		if program == nil {
+			program = parse(tt.input)
+		}
+
 		compiler := New()
 		if err := compiler.Compile(program); err != nil {
 			t.Fatalf("test[%d] - compiler error: %s", i, err)
@@ -500,6 +1913,38 @@ func parse(input string) *ast.Program {
 	return p.ParseProgram()
 }
 
+// The parser does not know every operator the compiler supports, these
+// helpers build such programs directly.
+
+func expressionProgram(expressions ...ast.Expression) *ast.Program {
+	program := &ast.Program{}
+	for _, e := range expressions {
+		statement := &ast.ExpressionStatement{Expression: e}
+		program.Statements = append(program.Statements, statement)
+	}
+	return program
+}
+
+func infixExpression(left ast.Expression, operator string, right ast.Expression) *ast.InfixExpression {
+	return &ast.InfixExpression{Left: left, Operator: operator, Right: right}
+}
+
+func prefixExpression(operator string, right ast.Expression) *ast.PrefixExpression {
+	return &ast.PrefixExpression{Operator: operator, Right: right}
+}
+
+func integerLiteral(value int64) *ast.IntegerLiteral {
+	return &ast.IntegerLiteral{Value: value}
+}
+
+func booleanLiteral(value bool) *ast.Boolean {
+	return &ast.Boolean{Value: value}
+}
+
+func stringLiteral(value string) *ast.StringLiteral {
+	return &ast.StringLiteral{Value: value}
+}
+
 func testInstructions(expected []code.Instructions, actual code.Instructions) error {
 	concatenated := concatenateInstructions(expected)
 
@@ -541,6 +1986,15 @@ func testConstants(t *testing.T, expected []interface{}, actual []object.Object)
 			if err := testStringObject(constant, actual[i]); err != nil {
 				return fmt.Errorf("constant %d - testStringObject failed: %s", i, err)
 			}
+		case []code.Instructions:
+			fn, ok := actual[i].(*CompiledFunction)
+			if !ok {
+				return fmt.Errorf("constant %d - not a function: %T", i, actual[i])
+			}
+
+			if err := testInstructions(constant, fn.Instructions); err != nil {
+				return fmt.Errorf("constant %d - testInstructions failed: %s", i, err)
+			}
 		default:
 			return fmt.Errorf("testConstants failed: unhandled type (%T)", constant)
 		}
@@ -573,3 +2027,319 @@ func testStringObject(expected string, actual object.Object) error {
 
 	return nil
 }
+
+func TestReturnOutsideFunction(t *testing.T) {
+	tests := []string{
+		"return 5;",
+		"if (true) { return 1; }",
+		"let f = fn() { 1 }; return f();",
+	}
+
+	for _, input := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(input))
+		if err == nil {
+			t.Fatalf("%q - expected compiler error but resulted in none", input)
+		}
+
+		if err.Error() != "return outside function" {
+			t.Errorf("%q - wrong compiler error. want=%q, got=%q",
+				input, "return outside function", err)
+		}
+	}
+}
+
+func TestBareReturn(t *testing.T) {
+	// The parser requires a value after return
+	function := &ast.FunctionLiteral{
+		Body: &ast.BlockStatement{
+			Statements: []ast.Statement{
+				&ast.ReturnStatement{},
+				&ast.ExpressionStatement{Expression: integerLiteral(5)},
+			},
+		},
+	}
+
+	tests := []compilerTestCase{
+		{
+			program: expressionProgram(function),
+			expectedConstants: []interface{}{
+				5,
+				[]code.Instructions{
+					code.Make(code.OpReturn),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestCompileErrors(t *testing.T) {
+	program := parse(`
+		let a = b;
+		fn(x) { x + c };
+		10 / 0;
+		a;
+	`)
+
+	compiler := New()
+	err := compiler.Compile(program)
+	if err == nil {
+		t.Fatalf("expected compiler error but resulted in none")
+	}
+
+	errs, ok := err.(CompileErrors)
+	if !ok {
+		t.Fatalf("error is not CompileErrors. got=%T (%+v)", err, err)
+	}
+
+	expected := []string{
+		"undefined identifier b",
+		"undefined identifier c",
+		"integer division by zero",
+	}
+
+	if len(errs) != len(expected) {
+		t.Fatalf("wrong number of errors. want=%d, got=%d (%s)",
+			len(expected), len(errs), errs)
+	}
+
+	for i, want := range expected {
+		if errs[i].Error() != want {
+			t.Errorf("errs[%d] wrong. want=%q, got=%q", i, want, errs[i])
+		}
+	}
+
+	if err.Error() != strings.Join(expected, "\n") {
+		t.Errorf("wrong message. want=%q, got=%q",
+			strings.Join(expected, "\n"), err)
+	}
+
+	if err := compiler.Compile(parse("a")); err != nil {
+		t.Errorf("errors of the previous program reported again: %s", err)
+	}
+}
+
+func TestCompileErrorsOfNode(t *testing.T) {
+	node := &ast.ExpressionStatement{Expression: &ast.Identifier{Value: "x"}}
+
+	compiler := New()
+	err := compiler.Compile(node)
+	if err == nil {
+		t.Fatalf("expected compiler error but resulted in none")
+	}
+
+	if _, ok := err.(CompileErrors); !ok {
+		t.Fatalf("error is not CompileErrors. got=%T (%+v)", err, err)
+	}
+
+	expected := "undefined identifier x"
+	if err.Error() != expected {
+		t.Errorf("wrong error. want=%q, got=%q", expected, err)
+	}
+
+	if err := compiler.Compile(&ast.IntegerLiteral{Value: 1}); err != nil {
+		t.Errorf("errors of the previous node reported again: %s", err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	compiler := New()
+	if err := compiler.Compile(parse(`let a = fn(x) { x * 2 }; a("b")`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	compiler.Reset()
+
+	program := parse("let c = 3; c + 4")
+	if err := compiler.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	fresh := New()
+	if err := fresh.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	got, want := compiler.Bytecode(), fresh.Bytecode()
+	if got.Instructions.String() != want.Instructions.String() {
+		t.Errorf("wrong instructions after Reset.\nwant=%q\ngot=%q",
+			want.Instructions, got.Instructions)
+	}
+	if len(got.Constants) != len(want.Constants) {
+		t.Errorf("wrong number of constants after Reset. want=%d, got=%d",
+			len(want.Constants), len(got.Constants))
+	}
+}
+
+func TestResetAllocations(t *testing.T) {
+	compiler := New()
+	program := parse(`let a = fn(x) { x * 2 }; a("b")`)
+	if err := compiler.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	allocs := testing.AllocsPerRun(10, func() {
+		compiler.Reset()
+	})
+	if allocs != 0 {
+		t.Errorf("Reset allocated. want=0, got=%v", allocs)
+	}
+}
+
+func TestResetWithState(t *testing.T) {
+	symbolTable := NewSymbolTable()
+	symbolTable.Define("a", "")
+	constants := make([]object.Object, 1, 4)
+	constants[0] = &object.Integer{Value: 1}
+
+	compiler := NewWithState(symbolTable, constants)
+	compiler.Reset()
+
+	if err := compiler.Compile(parse(`let b = "x"; b`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	// The caller's table and constants survive the compiler's reuse
+	if symbol, ok := symbolTable.Resolve("a"); !ok || symbol.Index != 0 {
+		t.Errorf("a resolved wrong. got=%+v (%t)", symbol, ok)
+	}
+	if _, ok := symbolTable.Resolve("b"); ok {
+		t.Errorf("b defined in the caller's symbol table")
+	}
+	if err := testIntegerObject(1, constants[0]); err != nil {
+		t.Errorf("caller's constant changed: %s", err)
+	}
+	if extended := constants[:2][1]; extended != nil {
+		t.Errorf("caller's constants overwritten. got=%s", extended.Inspect())
+	}
+}
+
+func TestResetInstructions(t *testing.T) {
+	compiler := New()
+	if err := compiler.Compile(parse("let a = 1;")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	// A statement without an expression stops compilation inside the
+	// function, leaving the compiler in the function's scope
+	broken := expressionProgram(&ast.FunctionLiteral{
+		Body: &ast.BlockStatement{
+			Statements: []ast.Statement{&ast.ExpressionStatement{}},
+		},
+	})
+	if err := compiler.Compile(broken); err == nil {
+		t.Fatalf("expected compiler error but resulted in none")
+	}
+	if compiler.scopeIndex != 1 {
+		t.Fatalf("scopeIndex wrong. got=%d, want=%d", compiler.scopeIndex, 1)
+	}
+
+	compiler.ResetInstructions()
+
+	if err := compiler.Compile(parse("a + 2")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := []code.Instructions{
+		code.Make(code.OpGetGlobal, 0),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpAdd),
+		code.Make(code.OpPop),
+	}
+
+	bytecode := compiler.Bytecode()
+	if err := testInstructions(expected, bytecode.Instructions); err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+	if err := testConstants(t, []interface{}{1, 2}, bytecode.Constants); err != nil {
+		t.Fatalf("testConstants failed: %s", err)
+	}
+}
+
+func TestUnusedVariableWarnings(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []Warning
+	}{
+		{"let x = 5;", []Warning{{"x", GlobalScope}}},
+		{"let x = 5; x;", []Warning{}},
+		{"let x = 5; fn() { x };", []Warning{}},
+		{"fn(a) { let y = 1; a };", []Warning{{"y", LocalScope}}},
+		{"fn(a) { 1 };", []Warning{}},
+		{"fn() { let a = 1; fn() { a } };", []Warning{}},
+		{
+			"let f = fn() { let a = 1; let b = 2; a };",
+			[]Warning{{"b", LocalScope}, {"f", GlobalScope}},
+		},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		if err := compiler.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		warnings := compiler.Bytecode().Warnings
+		if len(warnings) != len(tt.expected) {
+			t.Fatalf("wrong number of warnings for %q. want=%+v, got=%+v",
+				tt.input, tt.expected, warnings)
+		}
+
+		for i, want := range tt.expected {
+			if warnings[i] != want {
+				t.Errorf("warnings[%d] wrong for %q. want=%+v, got=%+v",
+					i, tt.input, want, warnings[i])
+			}
+		}
+	}
+}
+
+func TestRedefinitionErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let x = 1; let x = 2;", "identifier x already defined"},
+		{"fn() { let y = 1; let y = 2; y }", "identifier y already defined"},
+		{"fn(a, a) { a }", "identifier a already defined"},
+		{"fn(a) { let a = 1; a }", "identifier a already defined"},
+	}
+
+	for i, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err == nil {
+			t.Fatalf("test[%d] - expected compiler error but resulted in none", i)
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("test[%d] - wrong compiler error. want=%q, got=%q",
+				i, tt.expected, err)
+		}
+	}
+
+	// Shadowing names of other scopes is allowed
+	for _, input := range []string{
+		"let x = 1; fn() { let x = 2; x }",
+		"let len = 1; len",
+		"let f = fn() { let f = 1; f }; f",
+	} {
+		if err := New().Compile(parse(input)); err != nil {
+			t.Errorf("%q - unexpected compiler error: %s", input, err)
+		}
+	}
+
+	// Every program compiled after ResetInstructions may redefine globals
+	compiler := New()
+	for _, input := range []string{"let x = 1; x", "let x = 2; x"} {
+		compiler.ResetInstructions()
+		if err := compiler.Compile(parse(input)); err != nil {
+			t.Errorf("%q - unexpected compiler error: %s", input, err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// The Monkey Language bytecode dead code analysis
+package compiler
+
+import (
+	"github.com/freddiehaddad/monkey.compiler/pkg/code"
+)
+
+// ByteRange is the instructions from offset Start up to, not including,
+// offset End.
+type ByteRange struct {
+	Start, End int
+}
+
+// DeadInstructions returns the ranges of the main program's instructions
+// that no path from the first instruction reaches, in order. Both branches
+// of every jump are followed and nothing runs after a return. Analysis
+// stops at instructions that can't be decoded.
+func (b *Bytecode) DeadInstructions() []ByteRange {
+	ins := b.Instructions
+	reachable := map[int]bool{}
+
+	for offsets := []int{0}; len(offsets) > 0; {
+		offset := offsets[len(offsets)-1]
+		offsets = offsets[:len(offsets)-1]
+
+		for offset < ins.Len() && !reachable[offset] {
+			op, operands, width, err := ins.At(offset)
+			if err != nil {
+				break
+			}
+			reachable[offset] = true
+
+			next := offset + width
+			switch op {
+			case code.OpJump, code.OpJumpWide:
+				next = operands[0]
+			case code.OpLoop:
+				next = offset - operands[0]
+			case code.OpJumpNotTruthy, code.OpJumpNotTruthyWide:
+				offsets = append(offsets, operands[0])
+			case code.OpReturnValue, code.OpReturn:
+				next = ins.Len()
+			}
+
+			offset = next
+		}
+	}
+
+	dead := []ByteRange{}
+	for offset := 0; offset < ins.Len(); {
+		_, _, width, err := ins.At(offset)
+		if err != nil {
+			break
+		}
+
+		if !reachable[offset] {
+			// Extend the previous range when it ends here
+			if n := len(dead); n > 0 && dead[n-1].End == offset {
+				dead[n-1].End = offset + width
+			} else {
+				dead = append(dead, ByteRange{offset, offset + width})
+			}
+		}
+
+		offset += width
+	}
+
+	return dead
+}
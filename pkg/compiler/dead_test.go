@@ -0,0 +1,88 @@
+// The Monkey Language bytecode dead code analysis unit tests
+package compiler
+
+import (
+	"testing"
+
+	"github.com/freddiehaddad/monkey.compiler/pkg/code"
+)
+
+func TestDeadInstructions(t *testing.T) {
+	concat := func(instructions ...[]byte) code.Instructions {
+		out := code.Instructions{}
+		for _, ins := range instructions {
+			out = append(out, ins...)
+		}
+		return out
+	}
+
+	tests := []struct {
+		instructions code.Instructions
+		expected     []ByteRange
+	}{
+		{code.Instructions{}, []ByteRange{}},
+		{
+			concat(
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpReturnValue),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+			),
+			[]ByteRange{{4, 8}},
+		},
+		{
+			// Skipped by a jump, reached again after it
+			concat(
+				code.Make(code.OpJump, 5),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+				code.Make(code.OpNull),
+				code.Make(code.OpReturn),
+				code.Make(code.OpPop),
+			),
+			[]ByteRange{{3, 5}, {7, 8}},
+		},
+		{
+			// Both branches of a conditional jump are live
+			concat(
+				code.Make(code.OpTrue),
+				code.Make(code.OpJumpNotTruthy, 6),
+				code.Make(code.OpNull),
+				code.Make(code.OpReturnValue),
+				code.Make(code.OpFalse),
+				code.Make(code.OpPop),
+			),
+			[]ByteRange{},
+		},
+		{
+			// A loop that never exits
+			concat(
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+				code.Make(code.OpLoop, 2),
+				code.Make(code.OpNull),
+			),
+			[]ByteRange{{5, 6}},
+		},
+	}
+
+	for i, tt := range tests {
+		bytecode := &Bytecode{Instructions: tt.instructions}
+		got := bytecode.DeadInstructions()
+
+		if len(got) != len(tt.expected) {
+			t.Fatalf("test[%d] - wrong ranges. want=%v, got=%v", i, tt.expected, got)
+		}
+		for j, want := range tt.expected {
+			if got[j] != want {
+				t.Errorf("test[%d] - range %d wrong. want=%v, got=%v", i, j, want, got[j])
+			}
+		}
+	}
+
+	// Compiled conditionals have no dead code
+	bytecode := parseAndCompile(t, "if (true) { 1 } else { 2 }; 3")
+	if dead := bytecode.DeadInstructions(); len(dead) != 0 {
+		t.Errorf("unexpected dead code %v", dead)
+	}
+}
@@ -0,0 +1,88 @@
+// The Monkey Language bytecode stack depth analysis
+package compiler
+
+import (
+	"github.com/freddiehaddad/monkey.compiler/pkg/code"
+)
+
+// MaxStackDepth returns the largest number of values the main program's
+// instructions keep on the stack at once. Both branches of every jump are
+// followed. Frames of called functions are not included, their depth
+// depends on the calls made at run time. Instructions that can't be decoded
+// end the analysis of their path.
+func (b *Bytecode) MaxStackDepth() int {
+	return maxStackDepth(b.Instructions)
+}
+
+func maxStackDepth(ins code.Instructions) int {
+	max := 0
+	visited := map[int]bool{}
+
+	// Offsets still to analyse and the stack depth on reaching them
+	type path struct{ offset, depth int }
+	paths := []path{{0, 0}}
+
+	for len(paths) > 0 {
+		p := paths[len(paths)-1]
+		paths = paths[:len(paths)-1]
+
+		for offset, depth := p.offset, p.depth; !visited[offset]; {
+			op, operands, width, err := ins.At(offset)
+			if err != nil {
+				break
+			}
+			visited[offset] = true
+
+			depth += stackEffect(op, operands)
+			if depth > max {
+				max = depth
+			}
+
+			next := offset + width
+			switch op {
+			case code.OpJump, code.OpJumpWide:
+				next = operands[0]
+			case code.OpLoop:
+				next = offset - operands[0]
+			case code.OpJumpNotTruthy, code.OpJumpNotTruthyWide:
+				paths = append(paths, path{operands[0], depth})
+			case code.OpReturnValue, code.OpReturn:
+				next = ins.Len()
+			}
+
+			offset = next
+		}
+	}
+
+	return max
+}
+
+// stackEffect returns how many values op leaves on the stack minus how
+// many it takes from it.
+func stackEffect(op code.Opcode, operands []int) int {
+	switch op {
+	case code.OpNull, code.OpConstant, code.OpConstantWide, code.OpDup,
+		code.OpTrue, code.OpFalse, code.OpGetGlobal, code.OpGetLocal,
+		code.OpGetFree, code.OpCurrentClosure, code.OpGetBuiltin:
+		return 1
+	case code.OpPop, code.OpJumpNotTruthy, code.OpJumpNotTruthyWide,
+		code.OpSetGlobal, code.OpSetLocal, code.OpIndex, code.OpReturnValue,
+		code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod,
+		code.OpBitAnd, code.OpBitOr, code.OpBitXor,
+		code.OpLeftShift, code.OpRightShift,
+		code.OpEqual, code.OpNotEqual, code.OpLessThan, code.OpGreaterThan,
+		code.OpLessOrEqual, code.OpGreaterOrEqual:
+		return -1
+	case code.OpArray:
+		return 1 - operands[0]
+	case code.OpHash:
+		// The operand counts key and value pairs
+		return 1 - 2*operands[0]
+	case code.OpCall:
+		// The callee and arguments are replaced by the result
+		return -operands[0]
+	case code.OpClosure:
+		return 1 - operands[1]
+	}
+	return 0
+}
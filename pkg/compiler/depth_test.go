@@ -0,0 +1,52 @@
+// The Monkey Language bytecode stack depth analysis unit tests
+package compiler
+
+import (
+	"testing"
+
+	"github.com/freddiehaddad/monkey.compiler/pkg/code"
+)
+
+func TestMaxStackDepth(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{"", 0},
+		{"1; 2; 3", 1},
+		{"let a = 1; a + a", 2},
+		{"[1, 2, 3]", 3},
+		{"let a = 1; [a, [a, a]]", 3},
+		{`{1: 2, 3: 4}`, 4},
+		{"let f = fn(a, b, c) { a }; f(1, 2, 3)", 4},
+		{"if (true) { [1, 2] } else { 3 }", 2},
+		{"if (true) { 1 } else { [2, 3, 4] }", 3},
+		{"let a = 1; fn() { [a, a, a, a, a] }", 1},
+		{"let a = 1; fn() { a }; fn() { a }", 1},
+	}
+
+	for _, tt := range tests {
+		bytecode := parseAndCompile(t, tt.input)
+		if got := bytecode.MaxStackDepth(); got != tt.expected {
+			t.Errorf("wrong depth for %q. want=%d, got=%d", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestMaxStackDepthLoop(t *testing.T) {
+	// Each path through a loop is analysed once
+	bytecode := &Bytecode{Instructions: concatenateInstructions([]code.Instructions{
+		code.Make(code.OpTrue),
+		code.Make(code.OpJumpNotTruthy, 11),
+		code.Make(code.OpNull),
+		code.Make(code.OpNull),
+		code.Make(code.OpPop),
+		code.Make(code.OpPop),
+		code.Make(code.OpLoop, 8),
+		code.Make(code.OpNull),
+	})}
+
+	if got := bytecode.MaxStackDepth(); got != 2 {
+		t.Errorf("wrong depth. want=2, got=%d", got)
+	}
+}
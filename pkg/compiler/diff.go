@@ -0,0 +1,103 @@
+// The Monkey Language bytecode comparison
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// DiffBytecode compares the disassembled constants and instructions of a
+// and b. Lines only in a start with "-", lines only in b with "+" and
+// lines in both with a space. Offsets and constant indexes are ignored
+// when matching lines, so an inserted instruction doesn't make every line
+// after it differ. Lines in both are shown as they are in b.
+func DiffBytecode(a, b *Bytecode) string {
+	var out bytes.Buffer
+	out.WriteString("--- a\n+++ b\n")
+
+	aLines, bLines := bytecodeLines(a), bytecodeLines(b)
+	aKeys, bKeys := diffKeys(aLines), diffKeys(bLines)
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// aKeys[i:] and bKeys[j:]
+	lcs := make([][]int, len(aKeys)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bKeys)+1)
+	}
+	for i := len(aKeys) - 1; i >= 0; i-- {
+		for j := len(bKeys) - 1; j >= 0; j-- {
+			if aKeys[i] == bKeys[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(aKeys) || j < len(bKeys) {
+		switch {
+		case i < len(aKeys) && j < len(bKeys) && aKeys[i] == bKeys[j]:
+			fmt.Fprintf(&out, " %s\n", bLines[j])
+			i++
+			j++
+		case j == len(bKeys) || (i < len(aKeys) && lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&out, "-%s\n", aLines[i])
+			i++
+		default:
+			fmt.Fprintf(&out, "+%s\n", bLines[j])
+			j++
+		}
+	}
+
+	return out.String()
+}
+
+func bytecodeLines(b *Bytecode) []string {
+	lines := []string{"constants:"}
+	for i, constant := range b.Constants {
+		fn, ok := constant.(*CompiledFunction)
+		if !ok {
+			lines = append(lines, fmt.Sprintf("%d: %s %s", i, constant.Type(), constant.Inspect()))
+			continue
+		}
+
+		lines = append(lines, fmt.Sprintf("%d: function, %d parameters, %d locals",
+			i, fn.NumParameters, fn.NumLocals))
+		for _, line := range disassemblyLines(fn, b) {
+			lines = append(lines, "  "+line)
+		}
+	}
+
+	lines = append(lines, "instructions:")
+	return append(lines, disassemblyLines(&CompiledFunction{Instructions: b.Instructions}, b)...)
+}
+
+func disassemblyLines(fn *CompiledFunction, b *Bytecode) []string {
+	text := strings.TrimSuffix(fn.Instructions.Disassemble(b.Constants), "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+// diffKeys returns lines without the offset or constant index they start
+// with.
+func diffKeys(lines []string) []string {
+	keys := make([]string, len(lines))
+	for i, line := range lines {
+		key := strings.TrimLeft(line, " ")
+		indent := line[:len(line)-len(key)]
+
+		number := strings.TrimLeftFunc(key, unicode.IsDigit)
+		if number != key {
+			key = strings.TrimPrefix(number, ":")
+		}
+		keys[i] = indent + key
+	}
+	return keys
+}
@@ -0,0 +1,79 @@
+// The Monkey Language bytecode comparison unit tests
+package compiler
+
+import (
+	"testing"
+
+	"github.com/freddiehaddad/monkey.compiler/pkg/code"
+	"github.com/freddiehaddad/monkey.interpreter/pkg/object"
+)
+
+func TestDiffBytecode(t *testing.T) {
+	folded := parseAndCompile(t, "1 + 2; 4")
+
+	// The same program without constant folding
+	instructions := code.Instructions{}
+	for _, ins := range [][]byte{
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpAdd),
+		code.Make(code.OpPop),
+		code.Make(code.OpConstant, 2),
+		code.Make(code.OpPop),
+	} {
+		instructions = append(instructions, ins...)
+	}
+	unfolded := &Bytecode{
+		Instructions: instructions,
+		Constants: []object.Object{
+			&object.Integer{Value: 1},
+			&object.Integer{Value: 2},
+			&object.Integer{Value: 4},
+		},
+	}
+
+	expected := `--- a
++++ b
+ constants:
+-0: INTEGER 3
++0: INTEGER 1
++1: INTEGER 2
+ 2: INTEGER 4
+ instructions:
+-0000 OpConstant 0 ; 3
++0000 OpConstant 0 ; 1
++0003 OpConstant 1 ; 2
++0006 OpAdd
+ 0007 OpPop
+-0004 OpConstant 1 ; 4
++0008 OpConstant 2 ; 4
+ 0011 OpPop
+`
+
+	if got := DiffBytecode(folded, unfolded); got != expected {
+		t.Errorf("wrong diff.\nwant=%q\ngot= %q", expected, got)
+	}
+
+	// Function constants are compared instruction by instruction
+	a := parseAndCompile(t, "fn(x) { x + 1 }")
+	b := parseAndCompile(t, "fn(x) { x - 1 }")
+
+	expected = `--- a
++++ b
+ constants:
+ 0: INTEGER 1
+ 1: function, 1 parameters, 1 locals
+   0000 OpGetLocal 0
+   0002 OpConstant 0 ; 1
+-  0005 OpAdd
++  0005 OpSub
+   0006 OpReturnValue
+ instructions:
+ 0000 OpClosure 1 0
+ 0004 OpPop
+`
+
+	if got := DiffBytecode(a, b); got != expected {
+		t.Errorf("wrong diff.\nwant=%q\ngot= %q", expected, got)
+	}
+}
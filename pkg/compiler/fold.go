@@ -0,0 +1,89 @@
+// The Monkey Language compiler constant folding
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/freddiehaddad/monkey.interpreter/pkg/ast"
+	"github.com/freddiehaddad/monkey.interpreter/pkg/object"
+)
+
+// tryConstantFold evaluates an infix expression whose operands are integer
+// literals, or foldable infix expressions themselves, at compile time. The
+// result is an *object.Integer, or an *object.Error when evaluating it would
+// fail at run time, e.g. on division by zero. ok is false when node can't be
+// folded.
+func tryConstantFold(node *ast.InfixExpression) (object.Object, bool) {
+	left, ok := foldOperand(node.Left)
+	if !ok {
+		return nil, false
+	}
+	right, ok := foldOperand(node.Right)
+	if !ok {
+		return nil, false
+	}
+
+	if err, ok := left.(*object.Error); ok {
+		return err, true
+	}
+	if err, ok := right.(*object.Error); ok {
+		return err, true
+	}
+
+	lValue := left.(*object.Integer).Value
+	rValue := right.(*object.Integer).Value
+
+	var result int64
+
+	switch node.Operator {
+	case "+":
+		result = lValue + rValue
+	case "-":
+		result = lValue - rValue
+	case "*":
+		result = lValue * rValue
+	case "/":
+		if rValue == 0 {
+			return newFoldError("integer division by zero"), true
+		}
+		result = lValue / rValue
+	case "%":
+		if rValue == 0 {
+			return newFoldError("integer modulo by zero"), true
+		}
+		result = lValue % rValue
+	case "&":
+		result = lValue & rValue
+	case "|":
+		result = lValue | rValue
+	case "^":
+		result = lValue ^ rValue
+	case "<<", ">>":
+		if rValue < 0 {
+			return newFoldError("negative shift amount: %d", rValue), true
+		}
+		if node.Operator == "<<" {
+			result = lValue << rValue
+		} else {
+			result = lValue >> rValue
+		}
+	default:
+		return nil, false
+	}
+
+	return &object.Integer{Value: result}, true
+}
+
+func foldOperand(node ast.Expression) (object.Object, bool) {
+	switch node := node.(type) {
+	case *ast.IntegerLiteral:
+		return &object.Integer{Value: node.Value}, true
+	case *ast.InfixExpression:
+		return tryConstantFold(node)
+	}
+	return nil, false
+}
+
+func newFoldError(format string, a ...interface{}) *object.Error {
+	return &object.Error{Message: fmt.Sprintf(format, a...)}
+}
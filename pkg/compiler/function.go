@@ -0,0 +1,28 @@
+// The Monkey Language compiled function object
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/freddiehaddad/monkey.compiler/pkg/code"
+	"github.com/freddiehaddad/monkey.interpreter/pkg/object"
+)
+
+const COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION"
+
+type CompiledFunction struct {
+	Instructions  code.Instructions
+	NumLocals     int
+	NumParameters int
+
+	// The name the function was bound to by let, empty when anonymous
+	Name string
+}
+
+func (cf *CompiledFunction) Type() object.ObjectType {
+	return COMPILED_FUNCTION_OBJ
+}
+
+func (cf *CompiledFunction) Inspect() string {
+	return fmt.Sprintf("CompiledFunction[%p]", cf)
+}
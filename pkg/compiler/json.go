@@ -0,0 +1,186 @@
+// The Monkey Language bytecode JSON encoding
+package compiler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/freddiehaddad/monkey.compiler/pkg/code"
+	"github.com/freddiehaddad/monkey.interpreter/pkg/object"
+)
+
+// In JSON, constants are numbers, strings, booleans or function objects and
+// instructions are decoded into objects naming their opcode. Constants only
+// refer to each other by index in OpClosure operands, so the encoding can't
+// contain cycles.
+
+type jsonBytecode struct {
+	Instructions []jsonInstruction `json:"instructions"`
+	Constants    []json.RawMessage `json:"constants"`
+}
+
+type jsonInstruction struct {
+	Offset   int    `json:"offset"`
+	Op       string `json:"op"`
+	Operands []int  `json:"operands"`
+}
+
+type jsonFunction struct {
+	Instructions  []jsonInstruction `json:"instructions"`
+	NumLocals     int               `json:"numLocals"`
+	NumParameters int               `json:"numParameters"`
+	Name          string            `json:"name"`
+}
+
+func (b Bytecode) MarshalJSON() ([]byte, error) {
+	instructions, err := encodeInstructions(b.Instructions)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := jsonBytecode{
+		Instructions: instructions,
+		Constants:    []json.RawMessage{},
+	}
+
+	for i, constant := range b.Constants {
+		c, err := encodeConstant(constant)
+		if err != nil {
+			return nil, fmt.Errorf("constant %d: %s", i, err)
+		}
+		encoded.Constants = append(encoded.Constants, c)
+	}
+
+	return json.Marshal(encoded)
+}
+
+func encodeInstructions(ins code.Instructions) ([]jsonInstruction, error) {
+	encoded := []jsonInstruction{}
+
+	for offset := 0; offset < ins.Len(); {
+		op, operands, width, err := ins.At(offset)
+		if err != nil {
+			return nil, err
+		}
+
+		encoded = append(encoded, jsonInstruction{offset, op.String(), operands})
+		offset += width
+	}
+
+	return encoded, nil
+}
+
+func encodeConstant(obj object.Object) (json.RawMessage, error) {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return json.Marshal(obj.Value)
+	case *object.String:
+		return json.Marshal(obj.Value)
+	case *object.Boolean:
+		return json.Marshal(obj.Value)
+	case *CompiledFunction:
+		instructions, err := encodeInstructions(obj.Instructions)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(jsonFunction{
+			Instructions:  instructions,
+			NumLocals:     obj.NumLocals,
+			NumParameters: obj.NumParameters,
+			Name:          obj.Name,
+		})
+	}
+	return nil, fmt.Errorf("cannot encode %s", obj.Type())
+}
+
+func (b *Bytecode) UnmarshalJSON(data []byte) error {
+	var decoded jsonBytecode
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	instructions, err := decodeInstructions(decoded.Instructions)
+	if err != nil {
+		return err
+	}
+
+	constants := []object.Object{}
+	for i, c := range decoded.Constants {
+		constant, err := decodeConstant(c)
+		if err != nil {
+			return fmt.Errorf("constant %d: %s", i, err)
+		}
+		constants = append(constants, constant)
+	}
+
+	*b = Bytecode{Instructions: instructions, Constants: constants}
+	return nil
+}
+
+func decodeInstructions(decoded []jsonInstruction) (code.Instructions, error) {
+	ins := code.Instructions{}
+
+	for _, d := range decoded {
+		if d.Offset != ins.Len() {
+			return nil, fmt.Errorf("%s at offset %d, want offset %d",
+				d.Op, d.Offset, ins.Len())
+		}
+
+		op, err := code.LookupName(d.Op)
+		if err != nil {
+			return nil, err
+		}
+
+		def, _ := code.Lookup(byte(op))
+		if len(d.Operands) != len(def.OperandWidths) {
+			return nil, fmt.Errorf("%s at offset %d has %d operands, want %d",
+				d.Op, d.Offset, len(d.Operands), len(def.OperandWidths))
+		}
+
+		ins = append(ins, code.Make(op, d.Operands...)...)
+	}
+
+	return ins, nil
+}
+
+func decodeConstant(data json.RawMessage) (object.Object, error) {
+	// Numbers are decoded as json.Number, float64 can't hold every int64
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	switch value := value.(type) {
+	case json.Number:
+		i, err := value.Int64()
+		if err != nil {
+			return nil, err
+		}
+		return &object.Integer{Value: i}, nil
+	case string:
+		return &object.String{Value: value}, nil
+	case bool:
+		return &object.Boolean{Value: value}, nil
+	case map[string]interface{}:
+		var fn jsonFunction
+		if err := json.Unmarshal(data, &fn); err != nil {
+			return nil, err
+		}
+		instructions, err := decodeInstructions(fn.Instructions)
+		if err != nil {
+			return nil, err
+		}
+		return &CompiledFunction{
+			Instructions:  instructions,
+			NumLocals:     fn.NumLocals,
+			NumParameters: fn.NumParameters,
+			Name:          fn.Name,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("cannot decode %s", data)
+}
@@ -0,0 +1,104 @@
+// The Monkey Language bytecode JSON encoding unit tests
+package compiler
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestMarshalJSON(t *testing.T) {
+	bytecode := parseAndCompile(t, `let f = fn(a) { a }; f("x")`)
+
+	data, err := json.Marshal(bytecode)
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+
+	expected := `{"instructions":[` +
+		`{"offset":0,"op":"OpClosure","operands":[0,0]},` +
+		`{"offset":4,"op":"OpSetGlobal","operands":[0]},` +
+		`{"offset":7,"op":"OpGetGlobal","operands":[0]},` +
+		`{"offset":10,"op":"OpConstant","operands":[1]},` +
+		`{"offset":13,"op":"OpCall","operands":[1]},` +
+		`{"offset":15,"op":"OpPop","operands":[]}],` +
+		`"constants":[` +
+		`{"instructions":[` +
+		`{"offset":0,"op":"OpGetLocal","operands":[0]},` +
+		`{"offset":2,"op":"OpReturnValue","operands":[]}],` +
+		`"numLocals":1,"numParameters":1,"name":"f"},` +
+		`"x"]}`
+
+	if string(data) != expected {
+		t.Errorf("wrong JSON.\nwant=%s\ngot=%s", expected, data)
+	}
+}
+
+func TestUnmarshalJSON(t *testing.T) {
+	expected := parseAndCompile(t, `
+		let big = 9223372036854775807;
+		let f = fn(a, b) { let c = a; if (c) { b } else { [true, "s"] } };
+		f(big, {"k": -1})
+	`)
+
+	data, err := json.Marshal(expected)
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+
+	var actual Bytecode
+	if err := json.Unmarshal(data, &actual); err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+
+	if actual.Instructions.String() != expected.Instructions.String() {
+		t.Errorf("wrong instructions.\nwant=%q\ngot=%q",
+			expected.Instructions, actual.Instructions)
+	}
+
+	again, err := json.Marshal(actual)
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+	if string(again) != string(data) {
+		t.Errorf("round trip changed JSON.\nwant=%s\ngot=%s", data, again)
+	}
+
+	if fn := actual.Constants[2].(*CompiledFunction); fn.Name != "f" {
+		t.Errorf("wrong function name. want=%q, got=%q", "f", fn.Name)
+	}
+}
+
+func TestUnmarshalJSONErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			`{"instructions":[{"offset":0,"op":"OpBogus","operands":[]}]}`,
+			"opcode OpBogus undefined",
+		},
+		{
+			`{"instructions":[{"offset":1,"op":"OpPop","operands":[]}]}`,
+			"OpPop at offset 1, want offset 0",
+		},
+		{
+			`{"instructions":[{"offset":0,"op":"OpConstant","operands":[]}]}`,
+			"OpConstant at offset 0 has 0 operands, want 1",
+		},
+		{`{"constants":[1.5]}`, "constant 0"},
+		{`{"constants":[null]}`, "cannot decode null"},
+	}
+
+	for i, tt := range tests {
+		var bytecode Bytecode
+		err := json.Unmarshal([]byte(tt.input), &bytecode)
+		if err == nil {
+			t.Errorf("test[%d] - expected error but resulted in none", i)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("test[%d] - wrong error. want=%q, got=%q", i, tt.expected, err)
+		}
+	}
+}
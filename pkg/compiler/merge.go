@@ -0,0 +1,129 @@
+// The Monkey Language bytecode linking
+package compiler
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/freddiehaddad/monkey.compiler/pkg/code"
+	"github.com/freddiehaddad/monkey.interpreter/pkg/object"
+)
+
+// Merge links two separately compiled programs into one that runs base and
+// then extension. The constants of extension follow those of base and its
+// globals follow the globals base refers to, the operands of extension's
+// instructions and functions are moved along with them. Jumps of the main
+// program are moved past base's instructions. An error is returned when a
+// moved operand no longer fits its instruction, such as a constant index
+// beyond 65535 for OpConstant.
+func Merge(base, extension *Bytecode) (*Bytecode, error) {
+	offsets := relocation{
+		constants: len(base.Constants),
+		globals:   base.numGlobals(),
+	}
+
+	constants := make([]object.Object, 0, len(base.Constants)+len(extension.Constants))
+	constants = append(constants, base.Constants...)
+	for i, constant := range extension.Constants {
+		if fn, ok := constant.(*CompiledFunction); ok {
+			instructions, err := offsets.apply(fn.Instructions)
+			if err != nil {
+				return nil, fmt.Errorf("function constant %d: %s", i, err)
+			}
+
+			moved := *fn
+			moved.Instructions = instructions
+			constant = &moved
+		}
+		constants = append(constants, constant)
+	}
+
+	// Jumps in functions are relative to the function's instructions
+	offsets.jumps = len(base.Instructions)
+	instructions, err := offsets.apply(extension.Instructions)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := &Bytecode{
+		Instructions: make(code.Instructions, 0, len(base.Instructions)+len(instructions)),
+		Constants:    constants,
+	}
+	merged.Instructions = append(merged.Instructions, base.Instructions...)
+	merged.Instructions = append(merged.Instructions, instructions...)
+	merged.Warnings = append(merged.Warnings, base.Warnings...)
+	merged.Warnings = append(merged.Warnings, extension.Warnings...)
+
+	return merged, nil
+}
+
+// numGlobals returns the number of globals b's instructions and functions
+// refer to, one more than the largest global index.
+func (b *Bytecode) numGlobals() int {
+	count := func(ins code.Instructions) int {
+		n := 0
+		for offset := 0; offset < ins.Len(); {
+			op, operands, width, err := ins.At(offset)
+			if err != nil {
+				break
+			}
+			if op == code.OpGetGlobal || op == code.OpSetGlobal {
+				if operands[0] >= n {
+					n = operands[0] + 1
+				}
+			}
+			offset += width
+		}
+		return n
+	}
+
+	n := count(b.Instructions)
+	for _, constant := range b.Constants {
+		if fn, ok := constant.(*CompiledFunction); ok {
+			if m := count(fn.Instructions); m > n {
+				n = m
+			}
+		}
+	}
+	return n
+}
+
+// relocation is how far constant indexes, global indexes and jump targets
+// move when instructions are linked after others.
+type relocation struct {
+	constants, globals, jumps int
+}
+
+// apply returns a copy of ins with the operands moved by r.
+func (r relocation) apply(ins code.Instructions) (code.Instructions, error) {
+	moved := make(code.Instructions, 0, ins.Len())
+
+	for offset := 0; offset < ins.Len(); {
+		op, operands, width, err := ins.At(offset)
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case code.OpConstant, code.OpConstantWide, code.OpClosure:
+			operands[0] += r.constants
+		case code.OpGetGlobal, code.OpSetGlobal:
+			operands[0] += r.globals
+		case code.OpJump, code.OpJumpNotTruthy,
+			code.OpJumpWide, code.OpJumpNotTruthyWide:
+			operands[0] += r.jumps
+		}
+
+		def, _ := code.Lookup(byte(op))
+		if len(operands) > 0 && def.OperandWidths[0] == 2 &&
+			operands[0] > math.MaxUint16 {
+			return nil, fmt.Errorf("%s at offset %d: operand %d out of range",
+				op, offset, operands[0])
+		}
+
+		moved = append(moved, code.Make(op, operands...)...)
+		offset += width
+	}
+
+	return moved, nil
+}
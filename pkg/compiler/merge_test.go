@@ -0,0 +1,105 @@
+// The Monkey Language bytecode linking unit tests
+package compiler
+
+import (
+	"math"
+	"testing"
+
+	"github.com/freddiehaddad/monkey.compiler/pkg/code"
+	"github.com/freddiehaddad/monkey.interpreter/pkg/object"
+)
+
+func TestMerge(t *testing.T) {
+	compile := func(input string) *Bytecode {
+		compiler := New()
+		if err := compiler.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		return compiler.Bytecode()
+	}
+
+	base := compile("let a = 1; a")
+	extension := compile("let b = 2; let f = fn() { b }; if (f()) { b }")
+
+	merged, err := Merge(base, extension)
+	if err != nil {
+		t.Fatalf("merge error: %s", err)
+	}
+
+	expectedInstructions := []code.Instructions{
+		// 0000
+		code.Make(code.OpConstant, 0),
+		// 0003
+		code.Make(code.OpSetGlobal, 0),
+		// 0006
+		code.Make(code.OpGetGlobal, 0),
+		// 0009
+		code.Make(code.OpPop),
+		// 0010
+		code.Make(code.OpConstant, 1),
+		// 0013
+		code.Make(code.OpSetGlobal, 1),
+		// 0016
+		code.Make(code.OpClosure, 2, 0),
+		// 0020
+		code.Make(code.OpSetGlobal, 2),
+		// 0023
+		code.Make(code.OpGetGlobal, 2),
+		// 0026
+		code.Make(code.OpCall, 0),
+		// 0028
+		code.Make(code.OpJumpNotTruthy, 37),
+		// 0031
+		code.Make(code.OpGetGlobal, 1),
+		// 0034
+		code.Make(code.OpJump, 38),
+		// 0037
+		code.Make(code.OpNull),
+		// 0038
+		code.Make(code.OpPop),
+	}
+
+	if err := testInstructions(expectedInstructions, merged.Instructions); err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+
+	expectedConstants := []interface{}{
+		1,
+		2,
+		[]code.Instructions{
+			code.Make(code.OpGetGlobal, 1),
+			code.Make(code.OpReturnValue),
+		},
+	}
+
+	if err := testConstants(t, expectedConstants, merged.Constants); err != nil {
+		t.Fatalf("testConstants failed: %s", err)
+	}
+
+	// The extension's function is moved, not changed in place
+	fn := extension.Constants[1].(*CompiledFunction)
+	if op, operands, _, _ := fn.Instructions.At(0); op != code.OpGetGlobal || operands[0] != 0 {
+		t.Errorf("extension function changed: %s", fn.Instructions)
+	}
+}
+
+func TestMergeOutOfRange(t *testing.T) {
+	base := &Bytecode{
+		Instructions: code.Instructions{},
+		Constants:    make([]object.Object, math.MaxUint16+1),
+	}
+	extension := &Bytecode{
+		Instructions: code.Make(code.OpConstant, 0),
+		Constants:    []object.Object{&object.Integer{Value: 1}},
+	}
+
+	_, err := Merge(base, extension)
+	if err == nil {
+		t.Fatalf("expected merge error")
+	}
+
+	expected := "OpConstant at offset 0: operand 65536 out of range"
+	if err.Error() != expected {
+		t.Errorf("wrong merge error. want=%q, got=%q", expected, err)
+	}
+}
@@ -1,36 +1,243 @@
 // The Monkey Language compiler symbol table
 package compiler
 
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrAlreadyDefined is returned by Define for a name bound twice in one
+// scope.
+var ErrAlreadyDefined = errors.New("already defined")
+
 type SymbolScope string
 
 const (
-	GlobalScope SymbolScope = "GLOBAL"
+	GlobalScope  SymbolScope = "GLOBAL"
+	LocalScope   SymbolScope = "LOCAL"
+	FreeScope    SymbolScope = "FREE"
+	BuiltinScope SymbolScope = "BUILTIN"
+
+	// The name of the function being compiled, bound to the closure itself
+	FunctionScope SymbolScope = "FUNCTION"
 )
 
 type Symbol struct {
 	Name  string
 	Scope SymbolScope
 	Index int
+
+	// The type the symbol was annotated with, empty when untyped
+	Type string
 }
 
 type SymbolTable struct {
+	outer *SymbolTable
+
 	store          map[string]Symbol
 	numDefinitions int
+
+	// Symbols with a lower index may be defined again, see AllowRedefinition
+	redefinable int
+
+	// Number of times each symbol of store was resolved
+	usages map[Symbol]int
+
+	// Symbols of enclosing scopes captured by this one, ordered by index
+	FreeSymbols []Symbol
 }
 
 func NewSymbolTable() *SymbolTable {
 	s := make(map[string]Symbol)
-	return &SymbolTable{store: s}
+	u := make(map[Symbol]int)
+	free := []Symbol{}
+	return &SymbolTable{store: s, usages: u, FreeSymbols: free}
+}
+
+func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
+	s := NewSymbolTable()
+	s.outer = outer
+	return s
+}
+
+// EnterScope returns a new symbol table enclosed by s. Symbols defined in
+// the returned table are local to it.
+func (s *SymbolTable) EnterScope() *SymbolTable {
+	return NewEnclosedSymbolTable(s)
 }
 
-func (s *SymbolTable) Define(name string) Symbol {
-	symbol := Symbol{Name: name, Index: s.numDefinitions, Scope: GlobalScope}
+// LeaveScope returns the symbol table enclosing s and the symbols of the
+// enclosing scopes s captured. A closure over s loads them, in order.
+func (s *SymbolTable) LeaveScope() (*SymbolTable, []Symbol) {
+	return s.outer, s.FreeSymbols
+}
+
+// clear removes every binding from s, keeping the memory of its maps.
+func (s *SymbolTable) clear() {
+	for name := range s.store {
+		delete(s.store, name)
+	}
+	for symbol := range s.usages {
+		delete(s.usages, symbol)
+	}
+	s.numDefinitions = 0
+	s.redefinable = 0
+	s.FreeSymbols = s.FreeSymbols[:0]
+}
+
+// Define binds name in s with the type annotation typeName, empty for an
+// untyped symbol. It fails with ErrAlreadyDefined if name is already bound
+// by Define in s. Built-ins, the function name and captured symbols may be
+// shadowed.
+func (s *SymbolTable) Define(name, typeName string) (Symbol, error) {
+	symbol := Symbol{Name: name, Index: s.numDefinitions, Type: typeName}
+	if s.outer == nil {
+		symbol.Scope = GlobalScope
+	} else {
+		symbol.Scope = LocalScope
+	}
+
+	existing, ok := s.store[name]
+	if ok && existing.Scope == symbol.Scope && existing.Index >= s.redefinable {
+		return existing, fmt.Errorf("identifier %s %w", name, ErrAlreadyDefined)
+	}
+
 	s.store[name] = symbol
 	s.numDefinitions++
+	return symbol, nil
+}
+
+// AllowRedefinition lets Define bind the names defined in s so far again,
+// as if the next definitions were made in a new scope. The REPL compiles
+// every line as a new program that may redefine earlier globals.
+func (s *SymbolTable) AllowRedefinition() {
+	s.redefinable = s.numDefinitions
+}
+
+// DefineBuiltin binds name to the built-in function at index. Built-ins
+// are never captured as free symbols.
+func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
+	symbol := Symbol{Name: name, Index: index, Scope: BuiltinScope}
+	s.store[name] = symbol
+	return symbol
+}
+
+// DefineFunctionName binds name to the function whose body s is the scope
+// of. Locals and parameters with the same name shadow it.
+func (s *SymbolTable) DefineFunctionName(name string) Symbol {
+	symbol := Symbol{Name: name, Index: 0, Scope: FunctionScope}
+	s.store[name] = symbol
 	return symbol
 }
 
+func (s *SymbolTable) defineFree(original Symbol) Symbol {
+	s.FreeSymbols = append(s.FreeSymbols, original)
+
+	symbol := Symbol{
+		Name:  original.Name,
+		Index: len(s.FreeSymbols) - 1,
+		Scope: FreeScope,
+		Type:  original.Type,
+	}
+
+	s.store[original.Name] = symbol
+	return symbol
+}
+
+// Resolve looks up name in s and its enclosing scopes. A name defined in
+// an enclosing local scope is recorded as a free symbol of s.
 func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 	obj, ok := s.store[name]
-	return obj, ok
+	if ok {
+		s.usages[obj]++
+	}
+	if ok || s.outer == nil {
+		return obj, ok
+	}
+
+	obj, ok = s.outer.Resolve(name)
+	if !ok || obj.Scope == GlobalScope || obj.Scope == BuiltinScope {
+		return obj, ok
+	}
+
+	return s.defineFree(obj), true
+}
+
+// TypeOf returns the type annotation of the symbol name resolves to from
+// s, empty when untyped, and whether name is bound. Unlike Resolve it
+// neither counts a usage nor captures the symbol.
+func (s *SymbolTable) TypeOf(name string) (string, bool) {
+	for table := s; table != nil; table = table.outer {
+		if symbol, ok := table.store[name]; ok {
+			return symbol.Type, true
+		}
+	}
+	return "", false
+}
+
+// Usages returns how many times symbol, defined in s, was resolved.
+func (s *SymbolTable) Usages(symbol Symbol) int {
+	return s.usages[symbol]
+}
+
+// ListAll returns the symbols visible from s, sorted by name. A name bound
+// in several scopes is listed once, with its innermost binding.
+func (s *SymbolTable) ListAll() []Symbol {
+	visible := map[string]Symbol{}
+	for table := s; table != nil; table = table.outer {
+		for name, symbol := range table.store {
+			if _, shadowed := visible[name]; !shadowed {
+				visible[name] = symbol
+			}
+		}
+	}
+
+	symbols := []Symbol{}
+	for _, symbol := range visible {
+		symbols = append(symbols, symbol)
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		return symbols[i].Name < symbols[j].Name
+	})
+
+	return symbols
+}
+
+// SymbolTableSnapshot is a copy of the bindings of a symbol table that
+// later changes to the table don't affect.
+type SymbolTableSnapshot struct {
+	Symbols        []Symbol // Sorted by name
+	NumDefinitions int
+	Redefinable    int
+}
+
+// Snapshot copies the bindings made in s. Enclosing tables are not
+// included, it is meant for the global table.
+func (s *SymbolTable) Snapshot() SymbolTableSnapshot {
+	symbols := []Symbol{}
+	for _, symbol := range s.store {
+		symbols = append(symbols, symbol)
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		return symbols[i].Name < symbols[j].Name
+	})
+
+	return SymbolTableSnapshot{
+		Symbols:        symbols,
+		NumDefinitions: s.numDefinitions,
+		Redefinable:    s.redefinable,
+	}
+}
+
+// RestoreSnapshot returns a new global symbol table with the bindings of
+// snap.
+func RestoreSnapshot(snap SymbolTableSnapshot) *SymbolTable {
+	s := NewSymbolTable()
+	for _, symbol := range snap.Symbols {
+		s.store[symbol.Name] = symbol
+	}
+	s.numDefinitions = snap.NumDefinitions
+	s.redefinable = snap.Redefinable
+	return s
 }
@@ -0,0 +1,136 @@
+// The Monkey Language compiler symbol table JSON encoding
+package compiler
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// In JSON, a symbol table is an array of the symbols bound in it and its
+// enclosing tables. The depth of a symbol counts the tables enclosing the
+// one it is bound in, the global table has depth 0. A free symbol also
+// holds the symbol of the enclosing table it captures.
+
+type jsonSymbol struct {
+	Name     string      `json:"name"`
+	Scope    string      `json:"scope"`
+	Index    int         `json:"index"`
+	Depth    int         `json:"depth"`
+	Type     string      `json:"type,omitempty"`
+	Captured *jsonSymbol `json:"captured,omitempty"`
+}
+
+func encodeSymbol(symbol Symbol, depth int) jsonSymbol {
+	return jsonSymbol{
+		Name:  symbol.Name,
+		Scope: strings.ToLower(string(symbol.Scope)),
+		Index: symbol.Index,
+		Depth: depth,
+		Type:  symbol.Type,
+	}
+}
+
+// MarshalJSON encodes the bindings of s and its enclosing tables, sorted by
+// depth and then name. How often symbols were resolved is not included.
+func (s *SymbolTable) MarshalJSON() ([]byte, error) {
+	tables := []*SymbolTable{}
+	for table := s; table != nil; table = table.outer {
+		tables = append([]*SymbolTable{table}, tables...)
+	}
+
+	encoded := []jsonSymbol{}
+	for depth, table := range tables {
+		symbols := []jsonSymbol{}
+		for _, symbol := range table.store {
+			e := encodeSymbol(symbol, depth)
+			if symbol.Scope == FreeScope {
+				captured := encodeSymbol(table.FreeSymbols[symbol.Index], depth-1)
+				e.Captured = &captured
+			}
+			symbols = append(symbols, e)
+		}
+		sort.Slice(symbols, func(i, j int) bool {
+			return symbols[i].Name < symbols[j].Name
+		})
+		encoded = append(encoded, symbols...)
+	}
+
+	return json.Marshal(encoded)
+}
+
+// UnmarshalSymbolTable decodes a symbol table encoded by
+// SymbolTable.MarshalJSON. It returns the innermost table, enclosed by
+// tables for the lower depths. New definitions are given the indexes after
+// the decoded ones.
+func UnmarshalSymbolTable(data []byte) (*SymbolTable, error) {
+	var encoded []jsonSymbol
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, err
+	}
+
+	tables := []*SymbolTable{NewSymbolTable()}
+	for _, e := range encoded {
+		if e.Depth < 0 {
+			return nil, fmt.Errorf("symbol %s: negative depth %d", e.Name, e.Depth)
+		}
+		for len(tables) <= e.Depth {
+			tables = append(tables, tables[len(tables)-1].EnterScope())
+		}
+	}
+
+	for _, e := range encoded {
+		symbol, err := decodeSymbol(e)
+		if err != nil {
+			return nil, err
+		}
+
+		table := tables[e.Depth]
+		table.store[symbol.Name] = symbol
+
+		switch symbol.Scope {
+		case GlobalScope, LocalScope:
+			if symbol.Index >= table.numDefinitions {
+				table.numDefinitions = symbol.Index + 1
+			}
+		case FreeScope:
+			if e.Captured == nil {
+				return nil, fmt.Errorf("free symbol %s: no captured symbol", e.Name)
+			}
+			captured, err := decodeSymbol(*e.Captured)
+			if err != nil {
+				return nil, fmt.Errorf("free symbol %s: %s", e.Name, err)
+			}
+			for len(table.FreeSymbols) <= symbol.Index {
+				table.FreeSymbols = append(table.FreeSymbols, Symbol{})
+			}
+			table.FreeSymbols[symbol.Index] = captured
+		}
+	}
+
+	for depth, table := range tables {
+		for i, symbol := range table.FreeSymbols {
+			if symbol.Name == "" {
+				return nil, fmt.Errorf("free symbol %d at depth %d missing", i, depth)
+			}
+		}
+	}
+
+	return tables[len(tables)-1], nil
+}
+
+func decodeSymbol(e jsonSymbol) (Symbol, error) {
+	scope := SymbolScope(strings.ToUpper(e.Scope))
+	switch scope {
+	case GlobalScope, LocalScope, FreeScope, BuiltinScope, FunctionScope:
+	default:
+		return Symbol{}, fmt.Errorf("symbol %s: unknown scope %q", e.Name, e.Scope)
+	}
+
+	if e.Index < 0 {
+		return Symbol{}, fmt.Errorf("symbol %s: negative index %d", e.Name, e.Index)
+	}
+
+	return Symbol{Name: e.Name, Scope: scope, Index: e.Index, Type: e.Type}, nil
+}
@@ -0,0 +1,117 @@
+// The Monkey Language compiler symbol table JSON encoding unit tests
+package compiler
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSymbolTableJSONRoundTrip(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineBuiltin(0, "len")
+	global.Define("a", "")
+	global.Define("b", "INTEGER")
+
+	outer := global.EnterScope()
+	outer.DefineFunctionName("f")
+	outer.Define("c", "")
+	outer.Define("d", "")
+
+	inner := outer.EnterScope()
+	inner.Define("e", "")
+	inner.Resolve("d")
+	inner.Resolve("c")
+
+	data, err := json.Marshal(inner)
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+
+	decoded, err := UnmarshalSymbolTable(data)
+	if err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+
+	// f is captured by the first resolve, on both tables alike
+	for _, name := range []string{"len", "a", "b", "c", "d", "e", "f", "x"} {
+		want, wantOk := inner.Resolve(name)
+		got, gotOk := decoded.Resolve(name)
+		if want != got || wantOk != gotOk {
+			t.Errorf("%s resolved wrong. want=%+v (%t), got=%+v (%t)",
+				name, want, wantOk, got, gotOk)
+		}
+	}
+
+	if len(decoded.FreeSymbols) != len(inner.FreeSymbols) {
+		t.Fatalf("wrong number of free symbols. want=%d, got=%d",
+			len(inner.FreeSymbols), len(decoded.FreeSymbols))
+	}
+	for i, want := range inner.FreeSymbols {
+		if got := decoded.FreeSymbols[i]; got != want {
+			t.Errorf("free symbol %d wrong. want=%+v, got=%+v", i, want, got)
+		}
+	}
+
+	// New definitions follow the decoded ones
+	want, _ := inner.Define("g", "")
+	if got, _ := decoded.Define("g", ""); got != want {
+		t.Errorf("g defined wrong. want=%+v, got=%+v", want, got)
+	}
+}
+
+func TestSymbolTableMarshalJSON(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineBuiltin(1, "puts")
+	global.Define("a", "")
+
+	local := global.EnterScope()
+	local.Define("b", "")
+
+	inner := local.EnterScope()
+	inner.Resolve("b")
+
+	data, err := json.Marshal(inner)
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+
+	expected := `[` +
+		`{"name":"a","scope":"global","index":0,"depth":0},` +
+		`{"name":"puts","scope":"builtin","index":1,"depth":0},` +
+		`{"name":"b","scope":"local","index":0,"depth":1},` +
+		`{"name":"b","scope":"free","index":0,"depth":2,` +
+		`"captured":{"name":"b","scope":"local","index":0,"depth":1}}` +
+		`]`
+	if string(data) != expected {
+		t.Errorf("wrong JSON.\nwant=%s\ngot= %s", expected, data)
+	}
+}
+
+func TestUnmarshalSymbolTableErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`{}`, "json: cannot unmarshal object into Go value of type []compiler.jsonSymbol"},
+		{`[{"name":"a","scope":"outer","index":0,"depth":0}]`, `symbol a: unknown scope "outer"`},
+		{`[{"name":"a","scope":"global","index":-1,"depth":0}]`, "symbol a: negative index -1"},
+		{`[{"name":"a","scope":"global","index":0,"depth":-1}]`, "symbol a: negative depth -1"},
+		{`[{"name":"a","scope":"free","index":0,"depth":1}]`, "free symbol a: no captured symbol"},
+		{
+			`[{"name":"a","scope":"free","index":1,"depth":1,` +
+				`"captured":{"name":"a","scope":"local","index":0,"depth":0}}]`,
+			"free symbol 0 at depth 1 missing",
+		},
+	}
+
+	for i, tt := range tests {
+		_, err := UnmarshalSymbolTable([]byte(tt.input))
+		if err == nil {
+			t.Fatalf("test[%d] - expected error", i)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("test[%d] - wrong error. want=%q, got=%q", i, tt.expected, err)
+		}
+	}
+}
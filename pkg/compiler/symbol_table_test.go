@@ -1,7 +1,10 @@
 // The Monkey Language compiler symbol table tests
 package compiler
 
-import "testing"
+import (
+	"errors"
+	"testing"
+)
 
 func TestDefine(t *testing.T) {
 	expected := map[string]Symbol{
@@ -11,19 +14,19 @@ func TestDefine(t *testing.T) {
 
 	global := NewSymbolTable()
 
-	if a := global.Define("a"); a != expected["a"] {
+	if a, _ := global.Define("a", ""); a != expected["a"] {
 		t.Errorf("expected a=%+v, got=%+v", expected["a"], a)
 	}
 
-	if b := global.Define("b"); b != expected["b"] {
+	if b, _ := global.Define("b", ""); b != expected["b"] {
 		t.Errorf("expected b=%+v, got=%+v", expected["b"], b)
 	}
 }
 
 func TestResolveGlobal(t *testing.T) {
 	global := NewSymbolTable()
-	global.Define("a")
-	global.Define("b")
+	global.Define("a", "")
+	global.Define("b", "")
 
 	expected := []Symbol{
 		{Name: "a", Scope: GlobalScope, Index: 0},
@@ -41,3 +44,507 @@ func TestResolveGlobal(t *testing.T) {
 		}
 	}
 }
+
+func TestResolveLocal(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a", "")
+	global.Define("b", "")
+
+	local := global.EnterScope()
+	local.Define("c", "")
+	local.Define("d", "")
+
+	expected := []Symbol{
+		{Name: "a", Scope: GlobalScope, Index: 0},
+		{Name: "b", Scope: GlobalScope, Index: 1},
+		{Name: "c", Scope: LocalScope, Index: 0},
+		{Name: "d", Scope: LocalScope, Index: 1},
+	}
+
+	for _, sym := range expected {
+		result, ok := local.Resolve(sym.Name)
+		if !ok {
+			t.Errorf("name %s not resolvable", sym.Name)
+			continue
+		}
+		if result != sym {
+			t.Errorf("expected %s to resolve to %+v, got=%+v", sym.Name, sym, result)
+		}
+	}
+}
+
+func TestResolveNestedLocal(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a", "")
+	global.Define("b", "")
+
+	firstLocal := global.EnterScope()
+	firstLocal.Define("c", "")
+	firstLocal.Define("d", "")
+
+	secondLocal := firstLocal.EnterScope()
+	secondLocal.Define("e", "")
+	secondLocal.Define("f", "")
+
+	tests := []struct {
+		table           *SymbolTable
+		expectedSymbols []Symbol
+	}{
+		{
+			firstLocal,
+			[]Symbol{
+				{Name: "a", Scope: GlobalScope, Index: 0},
+				{Name: "b", Scope: GlobalScope, Index: 1},
+				{Name: "c", Scope: LocalScope, Index: 0},
+				{Name: "d", Scope: LocalScope, Index: 1},
+			},
+		},
+		{
+			secondLocal,
+			[]Symbol{
+				{Name: "a", Scope: GlobalScope, Index: 0},
+				{Name: "b", Scope: GlobalScope, Index: 1},
+				{Name: "e", Scope: LocalScope, Index: 0},
+				{Name: "f", Scope: LocalScope, Index: 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, sym := range tt.expectedSymbols {
+			result, ok := tt.table.Resolve(sym.Name)
+			if !ok {
+				t.Errorf("name %s not resolvable", sym.Name)
+				continue
+			}
+			if result != sym {
+				t.Errorf("expected %s to resolve to %+v, got=%+v", sym.Name, sym, result)
+			}
+		}
+	}
+}
+
+func TestShadowGlobal(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a", "")
+
+	local := global.EnterScope()
+	local.Define("a", "")
+
+	expected := Symbol{Name: "a", Scope: LocalScope, Index: 0}
+	if result, _ := local.Resolve("a"); result != expected {
+		t.Errorf("expected a to resolve to %+v, got=%+v", expected, result)
+	}
+
+	if outer, _ := local.LeaveScope(); outer != global {
+		t.Errorf("LeaveScope returned wrong table. want=%p, got=%p", global, outer)
+	}
+}
+
+func TestResolveFree(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a", "")
+	global.Define("b", "")
+
+	firstLocal := global.EnterScope()
+	firstLocal.Define("c", "")
+	firstLocal.Define("d", "")
+
+	secondLocal := firstLocal.EnterScope()
+	secondLocal.Define("e", "")
+	secondLocal.Define("f", "")
+
+	tests := []struct {
+		table               *SymbolTable
+		expectedSymbols     []Symbol
+		expectedFreeSymbols []Symbol
+	}{
+		{
+			firstLocal,
+			[]Symbol{
+				{Name: "a", Scope: GlobalScope, Index: 0},
+				{Name: "b", Scope: GlobalScope, Index: 1},
+				{Name: "c", Scope: LocalScope, Index: 0},
+				{Name: "d", Scope: LocalScope, Index: 1},
+			},
+			[]Symbol{},
+		},
+		{
+			secondLocal,
+			[]Symbol{
+				{Name: "a", Scope: GlobalScope, Index: 0},
+				{Name: "b", Scope: GlobalScope, Index: 1},
+				{Name: "c", Scope: FreeScope, Index: 0},
+				{Name: "d", Scope: FreeScope, Index: 1},
+				{Name: "e", Scope: LocalScope, Index: 0},
+				{Name: "f", Scope: LocalScope, Index: 1},
+			},
+			[]Symbol{
+				{Name: "c", Scope: LocalScope, Index: 0},
+				{Name: "d", Scope: LocalScope, Index: 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, sym := range tt.expectedSymbols {
+			result, ok := tt.table.Resolve(sym.Name)
+			if !ok {
+				t.Errorf("name %s not resolvable", sym.Name)
+				continue
+			}
+			if result != sym {
+				t.Errorf("expected %s to resolve to %+v, got=%+v", sym.Name, sym, result)
+			}
+		}
+
+		if len(tt.table.FreeSymbols) != len(tt.expectedFreeSymbols) {
+			t.Errorf("wrong number of free symbols. got=%d, want=%d",
+				len(tt.table.FreeSymbols), len(tt.expectedFreeSymbols))
+			continue
+		}
+
+		for i, sym := range tt.expectedFreeSymbols {
+			if result := tt.table.FreeSymbols[i]; result != sym {
+				t.Errorf("wrong free symbol. got=%+v, want=%+v", result, sym)
+			}
+		}
+	}
+}
+
+func TestResolveUnresolvableFree(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a", "")
+
+	firstLocal := global.EnterScope()
+	firstLocal.Define("c", "")
+
+	secondLocal := firstLocal.EnterScope()
+	secondLocal.Define("e", "")
+	secondLocal.Define("f", "")
+
+	expected := []Symbol{
+		{Name: "a", Scope: GlobalScope, Index: 0},
+		{Name: "c", Scope: FreeScope, Index: 0},
+		{Name: "e", Scope: LocalScope, Index: 0},
+		{Name: "f", Scope: LocalScope, Index: 1},
+	}
+
+	for _, sym := range expected {
+		result, ok := secondLocal.Resolve(sym.Name)
+		if !ok {
+			t.Errorf("name %s not resolvable", sym.Name)
+			continue
+		}
+		if result != sym {
+			t.Errorf("expected %s to resolve to %+v, got=%+v", sym.Name, sym, result)
+		}
+	}
+
+	for _, name := range []string{"b", "d"} {
+		if _, ok := secondLocal.Resolve(name); ok {
+			t.Errorf("name %s resolved, but was expected not to", name)
+		}
+	}
+}
+
+func TestDefineAndResolveFunctionName(t *testing.T) {
+	global := NewSymbolTable()
+	local := global.EnterScope()
+	local.DefineFunctionName("a")
+
+	expected := Symbol{Name: "a", Scope: FunctionScope, Index: 0}
+
+	result, ok := local.Resolve(expected.Name)
+	if !ok {
+		t.Fatalf("function name %s not resolvable", expected.Name)
+	}
+
+	if result != expected {
+		t.Errorf("expected %s to resolve to %+v, got=%+v",
+			expected.Name, expected, result)
+	}
+}
+
+func TestShadowingFunctionName(t *testing.T) {
+	global := NewSymbolTable()
+	local := global.EnterScope()
+	local.DefineFunctionName("a")
+	local.Define("a", "")
+
+	expected := Symbol{Name: "a", Scope: LocalScope, Index: 0}
+
+	result, ok := local.Resolve(expected.Name)
+	if !ok {
+		t.Fatalf("function name %s not resolvable", expected.Name)
+	}
+
+	if result != expected {
+		t.Errorf("expected %s to resolve to %+v, got=%+v",
+			expected.Name, expected, result)
+	}
+}
+
+func TestDefineResolveBuiltins(t *testing.T) {
+	global := NewSymbolTable()
+	firstLocal := global.EnterScope()
+	secondLocal := firstLocal.EnterScope()
+
+	expected := []Symbol{
+		{Name: "a", Scope: BuiltinScope, Index: 0},
+		{Name: "c", Scope: BuiltinScope, Index: 1},
+		{Name: "e", Scope: BuiltinScope, Index: 2},
+		{Name: "f", Scope: BuiltinScope, Index: 3},
+	}
+
+	for i, v := range expected {
+		global.DefineBuiltin(i, v.Name)
+	}
+
+	for _, table := range []*SymbolTable{global, firstLocal, secondLocal} {
+		for _, sym := range expected {
+			result, ok := table.Resolve(sym.Name)
+			if !ok {
+				t.Errorf("name %s not resolvable", sym.Name)
+				continue
+			}
+			if result != sym {
+				t.Errorf("expected %s to resolve to %+v, got=%+v", sym.Name, sym, result)
+			}
+		}
+
+		if len(table.FreeSymbols) != 0 {
+			t.Errorf("built-ins captured as free symbols: %+v", table.FreeSymbols)
+		}
+	}
+}
+
+func TestUsages(t *testing.T) {
+	global := NewSymbolTable()
+	a, _ := global.Define("a", "")
+	b, _ := global.Define("b", "")
+
+	local := NewEnclosedSymbolTable(global)
+	c, _ := local.Define("c", "")
+
+	local.Resolve("a")
+	local.Resolve("a")
+	local.Resolve("c")
+	local.Resolve("undefined")
+
+	expected := []struct {
+		table *SymbolTable
+		sym   Symbol
+		count int
+	}{
+		{global, a, 2},
+		{global, b, 0},
+		{local, c, 1},
+	}
+
+	for _, tt := range expected {
+		if got := tt.table.Usages(tt.sym); got != tt.count {
+			t.Errorf("wrong usages for %s. want=%d, got=%d",
+				tt.sym.Name, tt.count, got)
+		}
+	}
+}
+
+func TestLeaveScopeFreeSymbols(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("g", "")
+
+	outer := global.EnterScope()
+	outer.Define("a", "")
+	outer.Define("b", "")
+
+	inner := outer.EnterScope()
+	inner.Define("c", "")
+	inner.Resolve("b")
+	inner.Resolve("g")
+	inner.Resolve("c")
+	inner.Resolve("a")
+
+	table, free := inner.LeaveScope()
+	if table != outer {
+		t.Errorf("LeaveScope returned wrong table. want=%p, got=%p", outer, table)
+	}
+
+	expected := []Symbol{
+		{Name: "b", Scope: LocalScope, Index: 1},
+		{Name: "a", Scope: LocalScope, Index: 0},
+	}
+
+	if len(free) != len(expected) {
+		t.Fatalf("wrong number of free symbols. want=%d, got=%d (%+v)",
+			len(expected), len(free), free)
+	}
+
+	for i, sym := range expected {
+		if free[i] != sym {
+			t.Errorf("free symbol %d wrong. want=%+v, got=%+v", i, sym, free[i])
+		}
+	}
+
+	if _, free := outer.LeaveScope(); len(free) != 0 {
+		t.Errorf("outer scope captured symbols: %+v", free)
+	}
+}
+
+func TestDefineDuplicate(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineBuiltin(0, "len")
+	global.Define("a", "")
+
+	if _, err := global.Define("a", ""); !errors.Is(err, ErrAlreadyDefined) {
+		t.Errorf("expected ErrAlreadyDefined, got=%v", err)
+	}
+
+	if _, err := global.Define("len", ""); err != nil {
+		t.Errorf("shadowing a built-in failed: %s", err)
+	}
+
+	local := global.EnterScope()
+	local.DefineFunctionName("f")
+	local.Resolve("a")
+
+	for _, name := range []string{"a", "f"} {
+		if _, err := local.Define(name, ""); err != nil {
+			t.Errorf("shadowing %s failed: %s", name, err)
+		}
+	}
+
+	if _, err := local.Define("a", ""); !errors.Is(err, ErrAlreadyDefined) {
+		t.Errorf("expected ErrAlreadyDefined, got=%v", err)
+	}
+
+	global.AllowRedefinition()
+
+	expected := Symbol{Name: "a", Scope: GlobalScope, Index: 2}
+	if symbol, err := global.Define("a", ""); err != nil || symbol != expected {
+		t.Errorf("redefinition wrong. want=%+v, got=%+v (%v)", expected, symbol, err)
+	}
+
+	if _, err := global.Define("a", ""); !errors.Is(err, ErrAlreadyDefined) {
+		t.Errorf("expected ErrAlreadyDefined, got=%v", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineBuiltin(0, "len")
+	global.Define("b", "")
+	global.Define("a", "")
+
+	snap := global.Snapshot()
+
+	global.Define("c", "")
+
+	expected := []Symbol{
+		{Name: "a", Scope: GlobalScope, Index: 1},
+		{Name: "b", Scope: GlobalScope, Index: 0},
+		{Name: "len", Scope: BuiltinScope, Index: 0},
+	}
+
+	if len(snap.Symbols) != len(expected) {
+		t.Fatalf("wrong number of symbols. want=%d, got=%d (%+v)",
+			len(expected), len(snap.Symbols), snap.Symbols)
+	}
+	for i, sym := range expected {
+		if snap.Symbols[i] != sym {
+			t.Errorf("symbol %d wrong. want=%+v, got=%+v", i, sym, snap.Symbols[i])
+		}
+	}
+
+	restored := RestoreSnapshot(snap)
+
+	for _, sym := range expected {
+		if result, ok := restored.Resolve(sym.Name); !ok || result != sym {
+			t.Errorf("expected %s to resolve to %+v, got=%+v", sym.Name, sym, result)
+		}
+	}
+
+	if _, ok := restored.Resolve("c"); ok {
+		t.Errorf("symbol defined after the snapshot was restored")
+	}
+
+	expectedNext := Symbol{Name: "d", Scope: GlobalScope, Index: 2}
+	if next, _ := restored.Define("d", ""); next != expectedNext {
+		t.Errorf("wrong symbol after restore. want=%+v, got=%+v", expectedNext, next)
+	}
+}
+
+func TestListAll(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineBuiltin(0, "len")
+	global.Define("b", "")
+	global.Define("a", "")
+
+	local := global.EnterScope()
+	local.Define("c", "")
+	local.Define("a", "")
+
+	expected := []Symbol{
+		{Name: "a", Scope: LocalScope, Index: 1},
+		{Name: "b", Scope: GlobalScope, Index: 0},
+		{Name: "c", Scope: LocalScope, Index: 0},
+		{Name: "len", Scope: BuiltinScope, Index: 0},
+	}
+
+	symbols := local.ListAll()
+	if len(symbols) != len(expected) {
+		t.Fatalf("wrong number of symbols. want=%d, got=%d (%+v)",
+			len(expected), len(symbols), symbols)
+	}
+
+	for i, sym := range expected {
+		if symbols[i] != sym {
+			t.Errorf("symbol %d wrong. want=%+v, got=%+v", i, sym, symbols[i])
+		}
+	}
+
+	if n := len(global.ListAll()); n != 3 {
+		t.Errorf("wrong number of global symbols. want=3, got=%d", n)
+	}
+}
+
+func TestTypeOf(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineBuiltin(0, "len")
+	global.Define("x", "INTEGER")
+	global.Define("y", "")
+
+	local := global.EnterScope()
+	local.Define("s", "STRING")
+
+	inner := local.EnterScope()
+	if free, _ := inner.Resolve("s"); free.Type != "STRING" {
+		t.Errorf("free symbol lost its type. got=%q", free.Type)
+	}
+
+	tests := []struct {
+		name     string
+		expected string
+		ok       bool
+	}{
+		{"x", "INTEGER", true},
+		{"y", "", true},
+		{"s", "STRING", true},
+		{"len", "", true},
+		{"z", "", false},
+	}
+
+	for _, tt := range tests {
+		typeName, ok := inner.TypeOf(tt.name)
+		if typeName != tt.expected || ok != tt.ok {
+			t.Errorf("TypeOf(%q) wrong. want=%q, %t, got=%q, %t",
+				tt.name, tt.expected, tt.ok, typeName, ok)
+		}
+	}
+
+	// TypeOf is not a use of the symbol
+	x, _ := global.Resolve("x")
+	if n := global.Usages(x); n != 1 {
+		t.Errorf("wrong usages of x. want=1, got=%d", n)
+	}
+}
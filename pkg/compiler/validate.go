@@ -0,0 +1,85 @@
+// The Monkey Language bytecode validation
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/freddiehaddad/monkey.compiler/pkg/builtins"
+	"github.com/freddiehaddad/monkey.compiler/pkg/code"
+)
+
+// Validate checks that b can be run without the VM indexing out of range.
+// Every instruction must be defined and complete, jumps must land on an
+// instruction or the end of the instructions, and constant and built-in
+// indexes must exist. The instructions of compiled function constants are
+// checked the same way. Global indexes need no check, their 2 byte operands
+// can't exceed the VM's default GlobalSize and the VM checks them against
+// smaller sizes. The first violation found is returned.
+func (b *Bytecode) Validate() error {
+	if err := b.validateInstructions(b.Instructions); err != nil {
+		return err
+	}
+
+	for i, constant := range b.Constants {
+		fn, ok := constant.(*CompiledFunction)
+		if !ok {
+			continue
+		}
+		if err := b.validateInstructions(fn.Instructions); err != nil {
+			return fmt.Errorf("function constant %d: %s", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (b *Bytecode) validateInstructions(ins code.Instructions) error {
+	starts := map[int]bool{ins.Len(): true}
+	jumps := [][2]int{} // Offset and target of each jump, in order
+
+	for offset := 0; offset < ins.Len(); {
+		op, operands, width, err := ins.At(offset)
+		if err != nil {
+			return err
+		}
+		starts[offset] = true
+
+		switch op {
+		case code.OpJump, code.OpJumpNotTruthy,
+			code.OpJumpWide, code.OpJumpNotTruthyWide:
+			jumps = append(jumps, [2]int{offset, operands[0]})
+		case code.OpLoop:
+			jumps = append(jumps, [2]int{offset, offset - operands[0]})
+		case code.OpConstant, code.OpConstantWide:
+			if operands[0] >= len(b.Constants) {
+				return fmt.Errorf("%s at offset %d: constant %d out of range",
+					op, offset, operands[0])
+			}
+		case code.OpClosure:
+			if operands[0] >= len(b.Constants) {
+				return fmt.Errorf("%s at offset %d: constant %d out of range",
+					op, offset, operands[0])
+			}
+			if _, ok := b.Constants[operands[0]].(*CompiledFunction); !ok {
+				return fmt.Errorf("%s at offset %d: constant %d is not a function",
+					op, offset, operands[0])
+			}
+		case code.OpGetBuiltin:
+			if operands[0] >= len(builtins.Builtins) {
+				return fmt.Errorf("%s at offset %d: built-in %d out of range",
+					op, offset, operands[0])
+			}
+		}
+
+		offset += width
+	}
+
+	for _, jump := range jumps {
+		if offset, target := jump[0], jump[1]; !starts[target] {
+			return fmt.Errorf("%s at offset %d: target %d is not an instruction",
+				code.Opcode(ins[offset]), offset, target)
+		}
+	}
+
+	return nil
+}
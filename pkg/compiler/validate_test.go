@@ -0,0 +1,101 @@
+// The Monkey Language bytecode validation unit tests
+package compiler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/freddiehaddad/monkey.compiler/pkg/code"
+	"github.com/freddiehaddad/monkey.interpreter/pkg/object"
+)
+
+func TestValidateCompiledPrograms(t *testing.T) {
+	inputs := []string{
+		`if (1 < 2) { 10 } else { 20 }; if (false) { 30 }`,
+		`let f = fn(a) { fn(b) { if (a) { b } else { len(b) } } }; f(true)([1])`,
+		`{"a": 1}["a"] + [1, 2, 3][0]`,
+	}
+
+	for _, input := range inputs {
+		if err := parseAndCompile(t, input).Validate(); err != nil {
+			t.Errorf("valid program %q rejected: %s", input, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	constants := []object.Object{
+		&object.Integer{Value: 1},
+		&CompiledFunction{Instructions: concatenateInstructions([]code.Instructions{
+			code.Make(code.OpJump, 7),
+		})},
+	}
+
+	tests := []struct {
+		instructions []code.Instructions
+		expected     string
+	}{
+		{
+			[]code.Instructions{code.Make(code.OpConstant, 0)[:2]},
+			"OpConstant at offset 0 is truncated",
+		},
+		{
+			[]code.Instructions{{255}},
+			"opcode 255 undefined",
+		},
+		{
+			[]code.Instructions{code.Make(code.OpConstant, 2)},
+			"OpConstant at offset 0: constant 2 out of range",
+		},
+		{
+			[]code.Instructions{code.Make(code.OpConstantWide, 70000)},
+			"OpConstantWide at offset 0: constant 70000 out of range",
+		},
+		{
+			[]code.Instructions{code.Make(code.OpClosure, 0, 0)},
+			"OpClosure at offset 0: constant 0 is not a function",
+		},
+		{
+			[]code.Instructions{code.Make(code.OpGetBuiltin, 200)},
+			"OpGetBuiltin at offset 0: built-in 200 out of range",
+		},
+		{
+			[]code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpJumpNotTruthy, 100),
+			},
+			"OpJumpNotTruthy at offset 1: target 100 is not an instruction",
+		},
+		{
+			[]code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpJump, 2),
+			},
+			"OpJump at offset 3: target 2 is not an instruction",
+		},
+		{
+			[]code.Instructions{code.Make(code.OpLoop, 1)},
+			"OpLoop at offset 0: target -1 is not an instruction",
+		},
+		{
+			[]code.Instructions{code.Make(code.OpClosure, 1, 0)},
+			"function constant 1: OpJump at offset 0: target 7 is not an instruction",
+		},
+	}
+
+	for i, tt := range tests {
+		bytecode := &Bytecode{
+			Instructions: concatenateInstructions(tt.instructions),
+			Constants:    constants,
+		}
+
+		err := bytecode.Validate()
+		if err == nil {
+			t.Errorf("test[%d] - expected error but resulted in none", i)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("test[%d] - wrong error. want=%q, got=%q", i, tt.expected, err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// The Monkey Language REPL commands
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/freddiehaddad/monkey.compiler/pkg/compiler"
+)
+
+// replCommand is a dot-command typed at the start of an input.
+type replCommand struct {
+	description string
+	handler     func(args string, s *session) error
+}
+
+// commands holds the dot-commands by name. Each handler gets the text
+// after the name with surrounding space removed.
+var commands = map[string]replCommand{
+	".bytecode": {
+		"print the bytecode of the input after it, or toggle printing it for every input",
+		bytecodeCommand,
+	},
+	".globals": {"list the globals and their values", globalsCommand},
+	".limit":   {"<n> stop inputs after n instructions, 0 removes the limit", limitCommand},
+	".load":    {"<path> run a Monkey source file", loadCommand},
+	".reset":   {"forget all definitions", resetCommand},
+	".timing":  {"on|off print how long inputs take to compile and run", timingCommand},
+}
+
+func init() {
+	// Listing the commands refers to commands
+	commands[".help"] = replCommand{"list the commands", helpCommand}
+}
+
+// command runs the dot-command in line, writing any error to errOut.
+func (s *session) command(line string) {
+	name, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(s.errOut, "unknown command %s, .help lists the commands\n", name)
+		return
+	}
+
+	if err := command.handler(strings.TrimSpace(args), s); err != nil {
+		fmt.Fprintf(s.errOut, "%s\n", err)
+	}
+}
+
+// helpCommand prints the commands sorted by name with the descriptions
+// aligned.
+func helpCommand(args string, s *session) error {
+	names := []string{}
+	width := 0
+	for name := range commands {
+		names = append(names, name)
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(s.out, "%-*s  %s\n", width, name, commands[name].description)
+	}
+	return nil
+}
+
+func bytecodeCommand(args string, s *session) error {
+	if args == "" {
+		s.showBytecode = !s.showBytecode
+		fmt.Fprintf(s.out, "bytecode display %s\n", onOff(s.showBytecode))
+		return nil
+	}
+
+	s.showPending = true
+	s.input(args)
+	return nil
+}
+
+// globalsCommand prints the name and value of every global, sorted by
+// name with the values aligned. Built-ins are left out.
+func globalsCommand(args string, s *session) error {
+	globals := []compiler.Symbol{}
+	width := 0
+	for _, symbol := range compiler.RestoreSnapshot(s.symbols).ListAll() {
+		if symbol.Scope != compiler.GlobalScope {
+			continue
+		}
+		globals = append(globals, symbol)
+		if len(symbol.Name) > width {
+			width = len(symbol.Name)
+		}
+	}
+
+	if len(globals) == 0 {
+		fmt.Fprintf(s.out, "no globals defined\n")
+		return nil
+	}
+
+	for _, symbol := range globals {
+		value, err := s.machine.GlobalAt(symbol.Index)
+		if err != nil || value == nil {
+			continue
+		}
+		fmt.Fprintf(s.out, "%-*s = %s\n", width, symbol.Name, value.Inspect())
+	}
+	return nil
+}
+
+func limitCommand(args string, s *session) error {
+	fields := strings.Fields(args)
+	if len(fields) != 1 {
+		return errors.New("usage: .limit <instructions>")
+	}
+
+	n, err := strconv.Atoi(fields[0])
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid limit %s", fields[0])
+	}
+
+	s.limit = n
+	if n == 0 {
+		fmt.Fprintf(s.out, "instruction limit removed\n")
+	} else {
+		fmt.Fprintf(s.out, "instruction limit set to %d\n", n)
+	}
+	return nil
+}
+
+// loadCommand runs the Monkey source file at path as if it had been typed
+// in.
+func loadCommand(args string, s *session) error {
+	// The rest of the line is the path, which may hold spaces
+	path := args
+	if path == "" {
+		return errors.New("usage: .load <path>")
+	}
+
+	source, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(s.errOut, "Woops! Loading failed:\n %s\n", err)
+		return nil
+	}
+
+	if _, err := s.eval(string(source), false); err == nil {
+		fmt.Fprintf(s.out, "loaded %s\n", path)
+	}
+	return nil
+}
+
+func resetCommand(args string, s *session) error {
+	s.reset()
+	fmt.Fprintf(s.out, "State cleared.\n")
+	return nil
+}
+
+func timingCommand(args string, s *session) error {
+	if args != "on" && args != "off" {
+		return errors.New("usage: .timing on|off")
+	}
+
+	s.timing = args == "on"
+	fmt.Fprintf(s.out, "timing %s\n", onOff(s.timing))
+	return nil
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
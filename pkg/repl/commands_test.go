@@ -0,0 +1,43 @@
+// The Monkey Language REPL commands unit tests
+package repl
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHelpCommand(t *testing.T) {
+	var out bytes.Buffer
+	Start(strings.NewReader(".help\n"), &out)
+
+	help := strings.TrimPrefix(out.String(), PROMPT)
+	for name, command := range commands {
+		line := name + strings.Repeat(" ", len(".bytecode")-len(name)) +
+			"  " + command.description + "\n"
+		if !strings.Contains(help, line) {
+			t.Errorf("expected .help output containing %q, got %q", line, help)
+		}
+	}
+
+	for _, name := range []string{".load", ".reset", ".help"} {
+		if !strings.Contains(help, name) {
+			t.Errorf("expected .help output containing %q, got %q", name, help)
+		}
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	var out, errOut bytes.Buffer
+	StartWithConfig(Config{
+		In:     strings.NewReader(".nope\n.limit\n"),
+		Out:    &out,
+		ErrOut: &errOut,
+	})
+
+	expected := "unknown command .nope, .help lists the commands\n" +
+		"usage: .limit <instructions>\n"
+	if errOut.String() != expected {
+		t.Errorf("wrong error output. want=%q, got=%q", expected, errOut.String())
+	}
+}
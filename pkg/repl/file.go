@@ -0,0 +1,83 @@
+// The Monkey Language source file runner
+package repl
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/freddiehaddad/monkey.compiler/pkg/compiler"
+	"github.com/freddiehaddad/monkey.compiler/pkg/vm"
+	"github.com/freddiehaddad/monkey.interpreter/pkg/object"
+)
+
+// Exit codes of RunFile
+const (
+	ExitOK           = 0
+	ExitFileError    = 1
+	ExitCompileError = 2
+	ExitRuntimeError = 3
+)
+
+// CompileFile compiles the Monkey source file at path, writing any errors
+// to errOut. The exit code is ExitOK when the bytecode is returned.
+func CompileFile(path string, errOut io.Writer) (*compiler.Bytecode, int) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(errOut, "%s\n", err)
+		return nil, ExitFileError
+	}
+
+	s := newSession(io.Discard, errOut)
+	bytecode, _, err := s.compile(string(source))
+	if err != nil {
+		return nil, ExitCompileError
+	}
+	printWarnings(errOut, bytecode.Warnings, true)
+	return bytecode, ExitOK
+}
+
+// RunFile compiles and runs the Monkey source file at path like
+// RunBytecode. Parse errors count as compile errors.
+func RunFile(path string, out, errOut io.Writer) int {
+	bytecode, code := CompileFile(path, errOut)
+	if code != ExitOK {
+		return code
+	}
+	return RunBytecode(bytecode, out, errOut)
+}
+
+// RunBytecode runs bytecode in a new VM without a time limit, writing the
+// result of its last expression statement to out unless it's null. Errors
+// are written to errOut. It returns the exit code for the outcome.
+func RunBytecode(bytecode *compiler.Bytecode, out, errOut io.Writer) int {
+	s := newSession(out, errOut)
+
+	result, err := s.execute(bytecode)
+	if err != nil {
+		return ExitRuntimeError
+	}
+
+	printResult(out, result)
+	return ExitOK
+}
+
+// printWarnings writes the compiler's warnings to errOut. Unused globals
+// are left out unless globals is set, a REPL line may define them for the
+// next lines.
+func printWarnings(errOut io.Writer, warnings []compiler.Warning, globals bool) {
+	for _, w := range warnings {
+		if globals || w.Scope != compiler.GlobalScope {
+			fmt.Fprintf(errOut, "warning: %s\n", w)
+		}
+	}
+}
+
+// printResult writes the result of a program to out unless it has none or
+// it's null.
+func printResult(out io.Writer, result object.Object) {
+	if result != nil && result != vm.Null {
+		io.WriteString(out, result.Inspect())
+		io.WriteString(out, "\n")
+	}
+}
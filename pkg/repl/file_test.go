@@ -0,0 +1,56 @@
+// The Monkey Language source file runner unit tests
+package repl
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunFile(t *testing.T) {
+	tests := []struct {
+		source string
+		code   int
+		out    string
+		errOut string
+	}{
+		{"let add = fn(a, b) { a + b };\nadd(2, 3)\n", ExitOK, "5\n", ""},
+		{`puts("hi")`, ExitOK, "", ""},
+		{"let unused = 1;\n2\n", ExitOK, "2\n", "warning: unused variable unused\n"},
+		{"let = 1;", ExitCompileError, "", "Parser errors detected"},
+		{"x + 1", ExitCompileError, "", "undefined identifier x"},
+		{"-true", ExitRuntimeError, "", "unsupported operand type for OpMinus"},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "script.mk")
+		if err := os.WriteFile(path, []byte(tt.source), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		var out, errOut bytes.Buffer
+		code := RunFile(path, &out, &errOut)
+
+		if code != tt.code {
+			t.Errorf("%q: wrong exit code. want=%d, got=%d", tt.source, tt.code, code)
+		}
+		if out.String() != tt.out {
+			t.Errorf("%q: wrong output. want=%q, got=%q", tt.source, tt.out, out.String())
+		}
+		if !strings.Contains(errOut.String(), tt.errOut) {
+			t.Errorf("%q: expected error output containing %q, got %q",
+				tt.source, tt.errOut, errOut.String())
+		}
+	}
+
+	var out, errOut bytes.Buffer
+	missing := filepath.Join(t.TempDir(), "missing.mk")
+	if code := RunFile(missing, &out, &errOut); code != ExitFileError {
+		t.Errorf("missing file: wrong exit code. want=%d, got=%d", ExitFileError, code)
+	}
+	if !strings.Contains(errOut.String(), missing) {
+		t.Errorf("expected error output naming %s, got %q", missing, errOut.String())
+	}
+}
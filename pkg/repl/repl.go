@@ -3,57 +3,448 @@ package repl
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/freddiehaddad/monkey.compiler/pkg/builtins"
 	"github.com/freddiehaddad/monkey.compiler/pkg/compiler"
 	"github.com/freddiehaddad/monkey.compiler/pkg/vm"
 	"github.com/freddiehaddad/monkey.interpreter/pkg/lexer"
 	"github.com/freddiehaddad/monkey.interpreter/pkg/object"
 	"github.com/freddiehaddad/monkey.interpreter/pkg/parser"
+	"github.com/freddiehaddad/monkey.interpreter/pkg/token"
 )
 
 const PROMPT = "> "
 
-func Start(in io.Reader, out io.Writer) {
-	scanner := bufio.NewScanner(in)
+// CONTINUATION_PROMPT asks for more lines of an input with unclosed
+// braces, brackets or parentheses.
+const CONTINUATION_PROMPT = ".. "
+
+// DefaultTimeout limits how long a line of the REPL may run when
+// Config.Timeout is zero.
+const DefaultTimeout = 10 * time.Second
+
+// Config configures a REPL started with StartWithConfig. Zero values
+// select the defaults.
+type Config struct {
+	In  io.Reader
+	Out io.Writer
+
+	// Receives error messages, Out when nil
+	ErrOut io.Writer
+
+	// The MONKEY_PROMPT and MONKEY_PROMPT_CONT environment variables when
+	// empty, or else PROMPT and CONTINUATION_PROMPT
+	Prompt             string
+	ContinuationPrompt string
+
+	// Initial settings of the .timing and .limit commands
+	Timing          bool
+	MaxInstructions int
+
+	// Limits how long a line may run, DefaultTimeout when zero and no limit
+	// when negative
+	Timeout time.Duration
+}
+
+// session holds the state of the inputs that ran. An input that fails to
+// compile or run leaves no definitions behind.
+type session struct {
+	out       io.Writer
+	errOut    io.Writer
+	symbols   compiler.SymbolTableSnapshot
+	constants []object.Object
+
+	// Reset for every input, reusing the stack and keeping the globals
+	machine *vm.VM
+
+	// Instructions an input may execute, set with .limit
+	limit int
+
+	// How long an input may run, zero means no limit
+	timeout time.Duration
+
+	// Print how long inputs take to compile and run, set with .timing
+	timing bool
+
+	// The input is a whole program rather than a line later lines may
+	// build on
+	wholeProgram bool
+
+	// Durations of the last input's parsing and compilation, and its run
+	compiled, ran time.Duration
 
-	constants := []object.Object{}
+	// The lines of an input with delimiters still open
+	pending strings.Builder
+
+	// Print the bytecode of every input, or of the pending one, set with
+	// .bytecode
+	showBytecode bool
+	showPending  bool
+}
+
+func newSession(out, errOut io.Writer) *session {
+	s := &session{out: out, errOut: errOut}
+	s.reset()
+	return s
+}
+
+// reset forgets the definitions, constants and globals of the inputs that
+// ran. Settings are kept.
+func (s *session) reset() {
 	symbolTable := compiler.NewSymbolTable()
+	for i, v := range builtins.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
+
 	globals := make([]object.Object, vm.GlobalSize)
 
+	s.symbols = symbolTable.Snapshot()
+	s.constants = []object.Object{}
+	s.machine = vm.NewWithState(&compiler.Bytecode{}, globals)
+}
+
+// Errors eval returns after writing the details to errOut
+var (
+	errParse   = errors.New("parsing failed")
+	errCompile = errors.New("compilation failed")
+	errRun     = errors.New("execution failed")
+)
+
+// compile parses and compiles input with the session's definitions,
+// writing any errors to errOut. The returned symbol table holds the
+// definitions input adds, the session only takes them once input ran.
+func (s *session) compile(input string) (*compiler.Bytecode, *compiler.SymbolTable, error) {
+	l := lexer.New(input)
+	p := parser.New(l)
+
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		printParserErrors(s.errOut, p.Errors())
+		return nil, nil, errParse
+	}
+
+	symbolTable := compiler.RestoreSnapshot(s.symbols)
+	comp := compiler.NewWithState(symbolTable, s.constants)
+	if err := comp.Compile(program); err != nil {
+		fmt.Fprintf(s.errOut, "Woops! Compilation failed:\n %s\n", err)
+		return nil, nil, errCompile
+	}
+
+	return comp.Bytecode(), symbolTable, nil
+}
+
+// eval compiles and runs input, writing any errors to errOut. It returns the
+// result, nil if there is none, or the stage that failed.
+func (s *session) eval(input string, showBytecode bool) (object.Object, error) {
+	start := time.Now()
+
+	bytecode, symbolTable, err := s.compile(input)
+	if err != nil {
+		return nil, err
+	}
+
+	s.compiled = time.Since(start)
+
+	printWarnings(s.errOut, bytecode.Warnings, s.wholeProgram)
+
+	if showBytecode {
+		printBytecode(s.out, bytecode)
+	}
+
+	result, err := s.execute(bytecode)
+	if err != nil {
+		return nil, err
+	}
+
+	s.symbols = symbolTable.Snapshot()
+	s.constants = bytecode.Constants
+
+	return result, nil
+}
+
+// execute runs bytecode on the session's VM, writing any error to errOut.
+// It returns the result, nil if there is none.
+func (s *session) execute(bytecode *compiler.Bytecode) (object.Object, error) {
+	s.machine.Reset(bytecode)
+	s.machine.MaxInstructions = s.limit
+
+	start := time.Now()
+	err := run(s.machine, s.timeout)
+	s.ran = time.Since(start)
+	if errors.Is(err, context.Canceled) {
+		io.WriteString(s.errOut, "^C\n")
+		return nil, errRun
+	}
+	if err != nil {
+		fmt.Fprintf(s.errOut, "Woops! Executing bytecode failed:\n %s\n", err)
+		printCallStack(s.errOut, s.machine.CallStack())
+		return nil, errRun
+	}
+
+	// Statements pop their values, a result left on the stack is newer
+	if top := s.machine.StackTop(); top != nil {
+		return top, nil
+	}
+	return s.machine.LastPoppedStackElement(), nil
+}
+
+// IsInteractive reports whether in is a terminal. Input from anything but
+// an *os.File, like a strings.Reader in tests, counts as typed in.
+func IsInteractive(in io.Reader) bool {
+	file, ok := in.(*os.File)
+	if !ok {
+		return true
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return true
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// Start runs a REPL reading from in and writing to out with the default
+// configuration.
+func Start(in io.Reader, out io.Writer) {
+	StartWithConfig(Config{In: in, Out: out})
+}
+
+// StartWithConfig runs a REPL configured by cfg until its input ends. When
+// the input isn't interactive, like a pipe, all of it runs as one program
+// without prompts instead, and the exit code is the one RunFile would
+// return for it. An interactive REPL always returns ExitOK.
+func StartWithConfig(cfg Config) int {
+	in, out, errOut := cfg.In, cfg.Out, cfg.ErrOut
+	if errOut == nil {
+		errOut = out
+	}
+
+	if !IsInteractive(in) {
+		return runBatch(cfg, in, out, errOut)
+	}
+
+	prompt := firstNonEmpty(cfg.Prompt, os.Getenv("MONKEY_PROMPT"), PROMPT)
+	continuationPrompt := firstNonEmpty(cfg.ContinuationPrompt,
+		os.Getenv("MONKEY_PROMPT_CONT"), CONTINUATION_PROMPT)
+
+	scanner := bufio.NewScanner(in)
+	session := newSession(out, errOut)
+	session.timing = cfg.Timing
+	session.limit = cfg.MaxInstructions
+	switch {
+	case cfg.Timeout == 0:
+		session.timeout = DefaultTimeout
+	case cfg.Timeout > 0:
+		session.timeout = cfg.Timeout
+	}
+
 	for {
-		fmt.Fprintf(out, PROMPT)
+		if session.pending.Len() == 0 {
+			io.WriteString(out, prompt)
+		} else {
+			io.WriteString(out, continuationPrompt)
+		}
 
 		if scanned := scanner.Scan(); !scanned {
-			return
+			return ExitOK
 		}
 
 		line := scanner.Text()
-		l := lexer.New(line)
-		p := parser.New(l)
-
-		program := p.ParseProgram()
-		if len(p.Errors()) != 0 {
-			printParserErrors(out, p.Errors())
+		if session.pending.Len() == 0 && strings.HasPrefix(line, ".") {
+			session.command(line)
 			continue
 		}
 
-		compiler := compiler.NewWithState(symbolTable, constants)
-		if err := compiler.Compile(program); err != nil {
-			fmt.Fprintf(out, "Woops! Compilation failed:\n %s\n", err)
-			continue
+		session.input(line)
+	}
+}
+
+// runBatch runs all of in as one program without a time limit and prints
+// its result like RunFile, returning the same exit codes.
+func runBatch(cfg Config, in io.Reader, out, errOut io.Writer) int {
+	source, err := io.ReadAll(in)
+	if err != nil {
+		fmt.Fprintf(errOut, "Woops! Reading input failed:\n %s\n", err)
+		return ExitFileError
+	}
+
+	session := newSession(out, errOut)
+	session.limit = cfg.MaxInstructions
+	session.wholeProgram = true
+
+	result, err := session.eval(string(source), false)
+	if errors.Is(err, errRun) {
+		return ExitRuntimeError
+	}
+	if err != nil {
+		return ExitCompileError
+	}
+
+	printResult(out, result)
+	if cfg.Timing {
+		fmt.Fprintf(out, "(compiled in %sµs, ran in %sµs)\n",
+			microseconds(session.compiled), microseconds(session.ran))
+	}
+	return ExitOK
+}
+
+// input adds line to the pending input and runs the input once its
+// delimiters are closed.
+func (s *session) input(line string) {
+	// An empty continuation line ends the input even if it's unclosed
+	if s.pending.Len() == 0 || strings.TrimSpace(line) != "" {
+		s.pending.WriteString(line)
+		s.pending.WriteString("\n")
+		if unclosed(s.pending.String()) {
+			return
 		}
+	}
 
-		machine := vm.NewWithState(compiler.Bytecode(), globals)
-		if err := machine.Run(); err != nil {
-			fmt.Fprintf(out, "Woops! Executing bytecode failed:\n %s\n", err)
-			continue
+	input := s.pending.String()
+	s.pending.Reset()
+
+	show := s.showBytecode || s.showPending
+	s.showPending = false
+
+	result, err := s.eval(input, show)
+	if err != nil {
+		return
+	}
+
+	output := []string{}
+	if result != nil {
+		output = append(output, result.Inspect())
+	}
+	if s.timing {
+		output = append(output, fmt.Sprintf("(compiled in %sµs, ran in %sµs)",
+			microseconds(s.compiled), microseconds(s.ran)))
+	}
+	if len(output) == 0 {
+		return
+	}
+	io.WriteString(s.out, strings.Join(output, " "))
+	io.WriteString(s.out, "\n")
+}
+
+// unclosed reports whether input opens more braces, brackets or
+// parentheses than it closes.
+func unclosed(input string) bool {
+	open := map[token.TokenType]int{}
+	closing := map[token.TokenType]token.TokenType{
+		token.RBRACE:   token.LBRACE,
+		token.RBRACKET: token.LBRACKET,
+		token.RPAREN:   token.LPAREN,
+	}
+
+	l := lexer.New(input)
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+		switch tok.Type {
+		case token.LBRACE, token.LBRACKET, token.LPAREN:
+			open[tok.Type]++
+		case token.RBRACE, token.RBRACKET, token.RPAREN:
+			open[closing[tok.Type]]--
+		}
+	}
+
+	for _, count := range open {
+		if count > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// microseconds formats d in microseconds with at most 3 significant
+// figures.
+func microseconds(d time.Duration) string {
+	us := float64(d) / float64(time.Microsecond)
+	if us == 0 {
+		return "0"
+	}
+
+	// Scaling by a fraction like 1e-5 leaves float noise, an integer power
+	// of ten divides instead
+	k := 3 - int(math.Ceil(math.Log10(math.Abs(us))))
+	if k < 0 {
+		scale := math.Pow(10, float64(-k))
+		return strconv.FormatFloat(math.Round(us/scale)*scale, 'f', -1, 64)
+	}
+	scale := math.Pow(10, float64(k))
+	return strconv.FormatFloat(math.Round(us*scale)/scale, 'f', -1, 64)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// printBytecode writes the disassembled instructions and the constant pool.
+func printBytecode(out io.Writer, bytecode *compiler.Bytecode) {
+	io.WriteString(out, "Instructions:\n")
+	io.WriteString(out, bytecode.Instructions.Disassemble(bytecode.Constants))
+	io.WriteString(out, "Constants:\n")
+	for i, constant := range bytecode.Constants {
+		fmt.Fprintf(out, "%04d %s\n", i, constant.Inspect())
+	}
+}
+
+// notifyInterrupt is signal.Notify, tests replace it to simulate Ctrl+C.
+var notifyInterrupt = signal.Notify
+
+// run runs machine until it ends, timeout passes or the user presses
+// Ctrl+C. A zero timeout never passes. The interrupt is only caught while
+// machine runs, otherwise it ends the process as usual.
+func run(machine *vm.VM, timeout time.Duration) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interrupt := make(chan os.Signal, 1)
+	notifyInterrupt(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
 		}
+	}()
+
+	if timeout == 0 {
+		return machine.RunWithContext(ctx)
+	}
+
+	timeoutCtx, cancelTimeout := context.WithTimeout(ctx, timeout)
+	defer cancelTimeout()
 
-		stackTop := machine.LastPoppedStackElement()
-		io.WriteString(out, stackTop.Inspect())
-		io.WriteString(out, "\n")
+	return machine.RunWithContext(timeoutCtx)
+}
+
+// Frames printCallStack writes before eliding the rest
+const maxCallStackFrames = 10
+
+func printCallStack(out io.Writer, frames []vm.FrameInfo) {
+	io.WriteString(out, " Call stack:\n")
+	for i, frame := range frames {
+		if i == maxCallStackFrames {
+			fmt.Fprintf(out, "  ... %d more\n", len(frames)-i)
+			break
+		}
+		fmt.Fprintf(out, "  %d. offset %04d in %s\n", i+1, frame.IP, frame.Function)
 	}
 }
 
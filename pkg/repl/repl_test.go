@@ -0,0 +1,613 @@
+// The Monkey Language REPL unit tests
+package repl
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStart(t *testing.T) {
+	tests := []struct {
+		input    []string
+		expected []string
+	}{
+		{
+			[]string{"let a = 5;", "a * 2"},
+			[]string{"5", "10"},
+		},
+		{
+			[]string{`let f = fn(x) { x + "!" };`, `f("hi")`},
+			[]string{"Closure", "hi!"},
+		},
+		{
+			[]string{"let a = 1;", "let a = a + 1;", "a"},
+			[]string{"1", "2", "2"},
+		},
+		{
+			// A failed line doesn't define anything
+			[]string{"let y = zz;", "y"},
+			[]string{"undefined identifier zz", "undefined identifier y"},
+		},
+		{
+			[]string{"let z = 1;", "let w = -z; let v = -true;", "w"},
+			[]string{"1", "Executing bytecode failed", "undefined identifier w"},
+		},
+		{
+			[]string{"let a = 1;", ".timing on", ".reset", "a", ".globals", ".timing off"},
+			[]string{
+				"1",
+				"timing on",
+				"State cleared.",
+				"undefined identifier a",
+				"no globals defined",
+				"timing off",
+			},
+		},
+		{
+			[]string{".limit 3", "1; 2", ".limit x", ".limit 0", "1; 2"},
+			[]string{
+				"instruction limit set to 3",
+				"execution limit reached after 3 instructions",
+				"invalid limit x",
+				"instruction limit removed",
+				"2",
+			},
+		},
+		{
+			// Literals past MaxInt64 are rejected instead of wrapping around
+			[]string{"9223372036854775807", "9223372036854775808"},
+			[]string{
+				"9223372036854775807",
+				`could not parse "9223372036854775808" as integer`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		in := strings.NewReader(strings.Join(tt.input, "\n") + "\n")
+		var out bytes.Buffer
+
+		Start(in, &out)
+
+		results := strings.Split(out.String(), PROMPT)[1:]
+		if len(results) != len(tt.input)+1 {
+			t.Fatalf("wrong number of prompts. want=%d, got=%d\n%s",
+				len(tt.input)+1, len(results), out.String())
+		}
+
+		for i, want := range tt.expected {
+			if !strings.Contains(results[i], want) {
+				t.Errorf("line %q: expected output containing %q, got %q",
+					tt.input[i], want, results[i])
+			}
+		}
+	}
+}
+
+func TestMultiLineInput(t *testing.T) {
+	input := []string{
+		"let add = fn(a, b) {",
+		"  a + b",
+		"};",
+		"add(1,",
+		"2)",
+		"[1, (2",
+		"",
+		"add(3, 4)",
+	}
+
+	in := strings.NewReader(strings.Join(input, "\n") + "\n")
+	var out bytes.Buffer
+
+	Start(in, &out)
+
+	expected := PROMPT + CONTINUATION_PROMPT + CONTINUATION_PROMPT + "Closure"
+	if !strings.HasPrefix(out.String(), expected) {
+		t.Fatalf("expected output starting with %q, got %q", expected, out.String())
+	}
+
+	expected = PROMPT + CONTINUATION_PROMPT + "3\n"
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("expected output containing %q, got %q", expected, out.String())
+	}
+
+	// The empty line sends the unclosed input to the parser
+	expected = PROMPT + CONTINUATION_PROMPT + "Woops! Parser errors detected"
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("expected output containing %q, got %q", expected, out.String())
+	}
+
+	expected = PROMPT + "7\n" + PROMPT
+	if !strings.HasSuffix(out.String(), expected) {
+		t.Errorf("expected output ending with %q, got %q", expected, out.String())
+	}
+}
+
+func TestBytecodeCommand(t *testing.T) {
+	input := []string{
+		".bytecode 1 + x",
+		`.bytecode "a"`,
+		"2",
+		".bytecode",
+		"3",
+		".bytecode",
+		"4",
+	}
+
+	in := strings.NewReader(strings.Join(input, "\n") + "\n")
+	var out bytes.Buffer
+
+	Start(in, &out)
+
+	results := strings.Split(out.String(), PROMPT)[1:]
+	if len(results) != len(input)+1 {
+		t.Fatalf("wrong number of prompts. want=%d, got=%d\n%s",
+			len(input)+1, len(results), out.String())
+	}
+
+	expected := []string{
+		"Woops! Compilation failed:\n undefined identifier x\n",
+		`Instructions:
+0000 OpConstant 0 ; "a"
+0003 OpPop
+Constants:
+0000 a
+a
+`,
+		"2\n",
+		"bytecode display on\n",
+		`Instructions:
+0000 OpConstant 2 ; 3
+0003 OpPop
+Constants:
+0000 a
+0001 2
+0002 3
+3
+`,
+		"bytecode display off\n",
+		"4\n",
+	}
+
+	for i, want := range expected {
+		if results[i] != want {
+			t.Errorf("line %q: wrong output.\nwant=%q\ngot= %q", input[i], want, results[i])
+		}
+	}
+}
+
+func TestConstantsAccumulate(t *testing.T) {
+	input := []string{
+		`let greeting = "hello";`,
+		`"world" + x`,
+		`.bytecode greeting + "hello"`,
+		`.bytecode "world"`,
+	}
+
+	in := strings.NewReader(strings.Join(input, "\n") + "\n")
+	var out bytes.Buffer
+
+	Start(in, &out)
+
+	results := strings.Split(out.String(), PROMPT)[1:]
+	if len(results) != len(input)+1 {
+		t.Fatalf("wrong number of prompts. want=%d, got=%d\n%s",
+			len(input)+1, len(results), out.String())
+	}
+
+	// The string of the first line is found in the pool by the third, the
+	// one of the line that failed to compile is not kept
+	expected := []string{
+		"hello\n",
+		"Woops! Compilation failed:\n undefined identifier x\n",
+		`Instructions:
+0000 OpGetGlobal 0
+0003 OpConstant 0 ; "hello"
+0006 OpAdd
+0007 OpPop
+Constants:
+0000 hello
+hellohello
+`,
+		`Instructions:
+0000 OpConstant 1 ; "world"
+0003 OpPop
+Constants:
+0000 hello
+0001 world
+world
+`,
+	}
+
+	for i, want := range expected {
+		if results[i] != want {
+			t.Errorf("line %q: wrong output.\nwant=%q\ngot= %q", input[i], want, results[i])
+		}
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	input := []string{
+		"let a = 1;",
+		"let f = fn() { let b = 2; a };",
+		"f()",
+	}
+
+	in := strings.NewReader(strings.Join(input, "\n") + "\n")
+	var out, errOut bytes.Buffer
+
+	StartWithConfig(Config{In: in, Out: &out, ErrOut: &errOut})
+
+	// Globals may be used by later lines, only locals are reported
+	expected := "warning: unused variable b\n"
+	if errOut.String() != expected {
+		t.Errorf("wrong warnings. want=%q, got=%q", expected, errOut.String())
+	}
+}
+
+func TestLoadCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "add numbers.mk")
+	if err := os.WriteFile(path, []byte("let add = fn(a,b){a+b};\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := filepath.Join(t.TempDir(), "invalid.mk")
+	if err := os.WriteFile(invalid, []byte("let f = fn(a) { b };\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.mk")
+
+	input := []string{
+		".load " + path,
+		"add(2,3)",
+		".load " + missing,
+		".load " + invalid,
+		"f",
+		".load",
+	}
+
+	in := strings.NewReader(strings.Join(input, "\n") + "\n")
+	var out bytes.Buffer
+
+	Start(in, &out)
+
+	results := strings.Split(out.String(), PROMPT)[1:]
+	if len(results) != len(input)+1 {
+		t.Fatalf("wrong number of prompts. want=%d, got=%d\n%s",
+			len(input)+1, len(results), out.String())
+	}
+
+	expected := []string{
+		"loaded " + path + "\n",
+		"5\n",
+		"Woops! Loading failed",
+		"undefined identifier b",
+		"undefined identifier f",
+		"usage: .load <path>",
+	}
+
+	for i, want := range expected {
+		if !strings.Contains(results[i], want) {
+			t.Errorf("line %q: expected output containing %q, got %q",
+				input[i], want, results[i])
+		}
+	}
+}
+
+func TestGlobalsCommand(t *testing.T) {
+	input := []string{
+		".globals",
+		`let y = "hello"; let x = 1;`,
+		"let longer = [x, 2];",
+		".globals",
+	}
+
+	in := strings.NewReader(strings.Join(input, "\n") + "\n")
+	var out bytes.Buffer
+
+	Start(in, &out)
+
+	results := strings.Split(out.String(), PROMPT)[1:]
+	if len(results) != len(input)+1 {
+		t.Fatalf("wrong number of prompts. want=%d, got=%d\n%s",
+			len(input)+1, len(results), out.String())
+	}
+
+	if results[0] != "no globals defined\n" {
+		t.Errorf("wrong output for empty globals: %q", results[0])
+	}
+
+	expected := "longer = [1, 2]\n" +
+		"x      = 1\n" +
+		"y      = hello\n"
+	if results[3] != expected {
+		t.Errorf("wrong globals.\nwant=%q\ngot= %q", expected, results[3])
+	}
+}
+
+func TestTimingCommand(t *testing.T) {
+	input := []string{
+		"1 + 2",
+		".timing on",
+		"1 + 2",
+		"let a = 1;",
+		".timing off",
+		"1 + 2",
+		".timing maybe",
+	}
+
+	in := strings.NewReader(strings.Join(input, "\n") + "\n")
+	var out bytes.Buffer
+
+	Start(in, &out)
+
+	results := strings.Split(out.String(), PROMPT)[1:]
+	if len(results) != len(input)+1 {
+		t.Fatalf("wrong number of prompts. want=%d, got=%d\n%s",
+			len(input)+1, len(results), out.String())
+	}
+
+	timing := `\(compiled in [0-9.]+µs, ran in [0-9.]+µs\)\n$`
+	expected := []string{
+		"^3\n$",
+		"^timing on\n$",
+		"^3 " + timing,
+		"^1 " + timing,
+		"^timing off\n$",
+		"^3\n$",
+		"^usage: .timing on|off\n$",
+	}
+
+	for i, want := range expected {
+		if !regexp.MustCompile(want).MatchString(results[i]) {
+			t.Errorf("line %q: expected output matching %q, got %q",
+				input[i], want, results[i])
+		}
+	}
+}
+
+func TestMicroseconds(t *testing.T) {
+	tests := []struct {
+		duration time.Duration
+		expected string
+	}{
+		{0, "0"},
+		{500 * time.Nanosecond, "0.5"},
+		{1234 * time.Nanosecond, "1.23"},
+		{12345 * time.Nanosecond, "12.3"},
+		{123456 * time.Nanosecond, "123"},
+		{1234567 * time.Nanosecond, "1230"},
+		{10 * time.Millisecond, "10000"},
+		{12345678 * time.Microsecond, "12300000"},
+		{25 * time.Second, "25000000"},
+		{98765 * time.Second, "98800000000"},
+	}
+
+	for _, tt := range tests {
+		if got := microseconds(tt.duration); got != tt.expected {
+			t.Errorf("microseconds(%s): want=%q, got=%q", tt.duration, tt.expected, got)
+		}
+	}
+}
+
+func TestStartWithConfig(t *testing.T) {
+	input := []string{"let f = fn() {", "1 }", "f() + x", "f()", "let = 1"}
+
+	var out, errOut bytes.Buffer
+	StartWithConfig(Config{
+		In:                 strings.NewReader(strings.Join(input, "\n") + "\n"),
+		Out:                &out,
+		ErrOut:             &errOut,
+		Prompt:             "monkey> ",
+		ContinuationPrompt: "......> ",
+		Timing:             true,
+		MaxInstructions:    2,
+	})
+
+	expected := regexp.MustCompile(`^monkey> \.\.\.\.\.\.> Closure\[[^]]*\] \(compiled in .*\)\n` +
+		`monkey> monkey> monkey> monkey> $`)
+	if !expected.MatchString(out.String()) {
+		t.Errorf("wrong output: %q", out.String())
+	}
+
+	// Errors go to ErrOut, f() needs more than 2 instructions
+	for _, want := range []string{
+		"undefined identifier x",
+		"execution limit reached after 2 instructions",
+		"Parser errors detected",
+	} {
+		if !strings.Contains(errOut.String(), want) {
+			t.Errorf("expected error output containing %q, got %q", want, errOut.String())
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	input := []string{
+		"let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) + f(n - 1) } };",
+		"f(40)",
+		"f(3)",
+	}
+
+	in := strings.NewReader(strings.Join(input, "\n") + "\n")
+	var out bytes.Buffer
+	StartWithConfig(Config{In: in, Out: &out, Timeout: 10 * time.Millisecond})
+
+	if !strings.Contains(out.String(), context.DeadlineExceeded.Error()) {
+		t.Errorf("long line not stopped. got=%q", out.String())
+	}
+	if !strings.HasSuffix(out.String(), "0\n> ") {
+		t.Errorf("line after timeout didn't run. got=%q", out.String())
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	// Every run registers a channel, the test interrupts the second one
+	runs := make(chan chan<- os.Signal)
+	notifyInterrupt = func(c chan<- os.Signal, sig ...os.Signal) {
+		runs <- c
+	}
+	defer func() { notifyInterrupt = signal.Notify }()
+
+	input := []string{
+		"let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) + f(n - 1) } };",
+		"let g = f(40);",
+		"g",
+		"f(3)",
+	}
+
+	in := strings.NewReader(strings.Join(input, "\n") + "\n")
+	var out bytes.Buffer
+
+	done := make(chan struct{})
+	go func() {
+		StartWithConfig(Config{In: in, Out: &out, Timeout: 5 * time.Second})
+		close(done)
+	}()
+
+	for i := 0; i < 3; i++ {
+		c := <-runs
+		if i == 1 {
+			c <- os.Interrupt
+		}
+	}
+	<-done
+
+	results := strings.Split(out.String(), PROMPT)[1:]
+	if len(results) != len(input)+1 {
+		t.Fatalf("wrong number of prompts. want=%d, got=%d\n%s",
+			len(input)+1, len(results), out.String())
+	}
+
+	// The interrupted line defines nothing, the session goes on
+	expected := []string{"Closure", "^C\n", "undefined identifier g", "0\n"}
+	for i, want := range expected {
+		if !strings.Contains(results[i], want) {
+			t.Errorf("line %q: expected output containing %q, got %q",
+				input[i], want, results[i])
+		}
+	}
+}
+
+func TestCallStackOnError(t *testing.T) {
+	input := []string{
+		"let inner = fn(x) { -x };",
+		"let outer = fn() { inner(true) };",
+		"outer()",
+		"let deep = fn(n) { deep(n + 1) + 0 }; deep(0)",
+	}
+
+	in := strings.NewReader(strings.Join(input, "\n") + "\n")
+	var out bytes.Buffer
+
+	Start(in, &out)
+
+	results := strings.Split(out.String(), PROMPT)[1:]
+	if len(results) != len(input)+1 {
+		t.Fatalf("wrong number of prompts. want=%d, got=%d\n%s",
+			len(input)+1, len(results), out.String())
+	}
+
+	expected := "Woops! Executing bytecode failed:\n" +
+		" unsupported operand type for OpMinus: BOOLEAN\n" +
+		" Call stack:\n" +
+		"  1. offset 0002 in inner\n" +
+		"  2. offset 0004 in outer\n" +
+		"  3. offset 0003 in <main>\n"
+	if results[2] != expected {
+		t.Errorf("wrong output.\nwant=%q\ngot= %q", expected, results[2])
+	}
+
+	// Deep call stacks are cut short
+	elided := regexp.MustCompile(`\n  10\. offset 0007 in deep\n  \.\.\. [0-9]+ more\n$`)
+	if !elided.MatchString(results[3]) {
+		t.Errorf("expected output ending with 10 frames, got %q", results[3])
+	}
+}
+
+func TestPromptEnvironment(t *testing.T) {
+	t.Setenv("MONKEY_PROMPT", "env> ")
+	t.Setenv("MONKEY_PROMPT_CONT", "env.. ")
+
+	input := "[1,\n2][0]\n"
+
+	var out bytes.Buffer
+	StartWithConfig(Config{In: strings.NewReader(input), Out: &out})
+
+	expected := "env> env.. 1\nenv> "
+	if out.String() != expected {
+		t.Errorf("wrong output. want=%q, got=%q", expected, out.String())
+	}
+
+	// Config takes precedence over the environment
+	out.Reset()
+	StartWithConfig(Config{
+		In:     strings.NewReader(input),
+		Out:    &out,
+		Prompt: "cfg> ",
+	})
+
+	expected = "cfg> env.. 1\ncfg> "
+	if out.String() != expected {
+		t.Errorf("wrong output. want=%q, got=%q", expected, out.String())
+	}
+}
+
+func TestPipedInput(t *testing.T) {
+	tests := []struct {
+		input        string
+		expectedOut  string
+		expectedErr  string
+		expectedCode int
+	}{
+		// A multi-line program runs as a whole, without prompts
+		{"let add = fn(a, b) {\n a + b\n};\n\nadd(1, 2)\n", "3\n", "", ExitOK},
+		// Like RunFile, a program ending in null prints nothing
+		{"let a = 1;\nif (a > 1) { a };\n", "", "", ExitOK},
+		{"let = 1;\n", "", "Woops!", ExitCompileError},
+		{"1 / 0\n", "", "integer division by zero", ExitCompileError},
+		{"let a = 0;\n1 / a\n", "", "Woops! Executing bytecode failed", ExitRuntimeError},
+	}
+
+	for _, tt := range tests {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if IsInteractive(r) {
+			t.Fatalf("pipe reported as interactive")
+		}
+
+		go func(w *os.File, input string) {
+			w.WriteString(input)
+			w.Close()
+		}(w, tt.input)
+
+		var out, errOut bytes.Buffer
+		code := StartWithConfig(Config{In: r, Out: &out, ErrOut: &errOut})
+		r.Close()
+
+		if code != tt.expectedCode {
+			t.Errorf("input %q: wrong exit code. want=%d, got=%d",
+				tt.input, tt.expectedCode, code)
+		}
+		if out.String() != tt.expectedOut {
+			t.Errorf("input %q: wrong output. want=%q, got=%q",
+				tt.input, tt.expectedOut, out.String())
+		}
+		if !strings.Contains(errOut.String(), tt.expectedErr) ||
+			(tt.expectedErr == "" && errOut.Len() != 0) {
+			t.Errorf("input %q: wrong error output. want %q, got=%q",
+				tt.input, tt.expectedErr, errOut.String())
+		}
+	}
+}
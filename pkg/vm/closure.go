@@ -0,0 +1,24 @@
+// The Monkey Language vm closure object
+package vm
+
+import (
+	"fmt"
+
+	"github.com/freddiehaddad/monkey.compiler/pkg/compiler"
+	"github.com/freddiehaddad/monkey.interpreter/pkg/object"
+)
+
+const CLOSURE_OBJ = "CLOSURE"
+
+type Closure struct {
+	Fn   *compiler.CompiledFunction
+	Free []object.Object
+}
+
+func (c *Closure) Type() object.ObjectType {
+	return CLOSURE_OBJ
+}
+
+func (c *Closure) Inspect() string {
+	return fmt.Sprintf("Closure[%p]", c)
+}
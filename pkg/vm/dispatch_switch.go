@@ -0,0 +1,87 @@
+//go:build !dispatch_table
+
+// The Monkey Language vm instruction dispatch with a switch
+package vm
+
+import (
+	"fmt"
+
+	"github.com/freddiehaddad/monkey.compiler/pkg/code"
+)
+
+// dispatch runs the handler for op, the opcode at offset ip of ins. Build
+// with the dispatch_table tag to look handlers up in a table instead.
+func (vm *VM) dispatch(op code.Opcode, ins code.Instructions, ip int) error {
+	switch op {
+	case code.OpNull:
+		return vm.opNull(ins, ip)
+	case code.OpPop:
+		return vm.opPop(ins, ip)
+	case code.OpDup:
+		return vm.opDup(ins, ip)
+	case code.OpSwap:
+		return vm.opSwap(ins, ip)
+	case code.OpConstant:
+		return vm.opConstant(ins, ip)
+	case code.OpConstantWide:
+		return vm.opConstantWide(ins, ip)
+	case code.OpTrue:
+		return vm.opTrue(ins, ip)
+	case code.OpFalse:
+		return vm.opFalse(ins, ip)
+	case code.OpArray:
+		return vm.opArray(ins, ip)
+	case code.OpHash:
+		return vm.opHash(ins, ip)
+	case code.OpIndex:
+		return vm.opIndex(ins, ip)
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod,
+		code.OpBitAnd, code.OpBitOr, code.OpBitXor, code.OpLeftShift,
+		code.OpRightShift:
+		return vm.opBinary(ins, ip)
+	case code.OpEqual, code.OpNotEqual, code.OpLessThan, code.OpGreaterThan,
+		code.OpLessOrEqual, code.OpGreaterOrEqual:
+		return vm.opComparison(ins, ip)
+	case code.OpBang:
+		return vm.opBang(ins, ip)
+	case code.OpMinus:
+		return vm.opMinus(ins, ip)
+	case code.OpBitNot:
+		return vm.opBitNot(ins, ip)
+	case code.OpJump:
+		return vm.opJump(ins, ip)
+	case code.OpJumpNotTruthy:
+		return vm.opJumpNotTruthy(ins, ip)
+	case code.OpJumpWide:
+		return vm.opJumpWide(ins, ip)
+	case code.OpJumpNotTruthyWide:
+		return vm.opJumpNotTruthyWide(ins, ip)
+	case code.OpLoop:
+		return vm.opLoop(ins, ip)
+	case code.OpGetGlobal:
+		return vm.opGetGlobal(ins, ip)
+	case code.OpSetGlobal:
+		return vm.opSetGlobal(ins, ip)
+	case code.OpGetLocal:
+		return vm.opGetLocal(ins, ip)
+	case code.OpSetLocal:
+		return vm.opSetLocal(ins, ip)
+	case code.OpCall:
+		return vm.opCall(ins, ip)
+	case code.OpReturnValue:
+		return vm.opReturnValue(ins, ip)
+	case code.OpReturn:
+		return vm.opReturn(ins, ip)
+	case code.OpClosure:
+		return vm.opClosure(ins, ip)
+	case code.OpGetFree:
+		return vm.opGetFree(ins, ip)
+	case code.OpCurrentClosure:
+		return vm.opCurrentClosure(ins, ip)
+	case code.OpGetBuiltin:
+		return vm.opGetBuiltin(ins, ip)
+	case code.OpIsNull:
+		return vm.opIsNull(ins, ip)
+	}
+	return fmt.Errorf("opcode %d undefined", op)
+}
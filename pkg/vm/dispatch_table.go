@@ -0,0 +1,71 @@
+//go:build dispatch_table
+
+// The Monkey Language vm instruction dispatch with a table
+package vm
+
+import (
+	"fmt"
+
+	"github.com/freddiehaddad/monkey.compiler/pkg/code"
+)
+
+// handlers is indexed by opcode, undefined opcodes have no handler
+var handlers = [256]func(vm *VM, ins code.Instructions, ip int) error{
+	code.OpNull:              (*VM).opNull,
+	code.OpPop:               (*VM).opPop,
+	code.OpDup:               (*VM).opDup,
+	code.OpSwap:              (*VM).opSwap,
+	code.OpConstant:          (*VM).opConstant,
+	code.OpConstantWide:      (*VM).opConstantWide,
+	code.OpTrue:              (*VM).opTrue,
+	code.OpFalse:             (*VM).opFalse,
+	code.OpArray:             (*VM).opArray,
+	code.OpHash:              (*VM).opHash,
+	code.OpIndex:             (*VM).opIndex,
+	code.OpAdd:               (*VM).opBinary,
+	code.OpSub:               (*VM).opBinary,
+	code.OpMul:               (*VM).opBinary,
+	code.OpDiv:               (*VM).opBinary,
+	code.OpMod:               (*VM).opBinary,
+	code.OpBitAnd:            (*VM).opBinary,
+	code.OpBitOr:             (*VM).opBinary,
+	code.OpBitXor:            (*VM).opBinary,
+	code.OpLeftShift:         (*VM).opBinary,
+	code.OpRightShift:        (*VM).opBinary,
+	code.OpEqual:             (*VM).opComparison,
+	code.OpNotEqual:          (*VM).opComparison,
+	code.OpLessThan:          (*VM).opComparison,
+	code.OpGreaterThan:       (*VM).opComparison,
+	code.OpLessOrEqual:       (*VM).opComparison,
+	code.OpGreaterOrEqual:    (*VM).opComparison,
+	code.OpBang:              (*VM).opBang,
+	code.OpMinus:             (*VM).opMinus,
+	code.OpBitNot:            (*VM).opBitNot,
+	code.OpJump:              (*VM).opJump,
+	code.OpJumpNotTruthy:     (*VM).opJumpNotTruthy,
+	code.OpJumpWide:          (*VM).opJumpWide,
+	code.OpJumpNotTruthyWide: (*VM).opJumpNotTruthyWide,
+	code.OpLoop:              (*VM).opLoop,
+	code.OpGetGlobal:         (*VM).opGetGlobal,
+	code.OpSetGlobal:         (*VM).opSetGlobal,
+	code.OpGetLocal:          (*VM).opGetLocal,
+	code.OpSetLocal:          (*VM).opSetLocal,
+	code.OpCall:              (*VM).opCall,
+	code.OpReturnValue:       (*VM).opReturnValue,
+	code.OpReturn:            (*VM).opReturn,
+	code.OpClosure:           (*VM).opClosure,
+	code.OpGetFree:           (*VM).opGetFree,
+	code.OpCurrentClosure:    (*VM).opCurrentClosure,
+	code.OpGetBuiltin:        (*VM).opGetBuiltin,
+	code.OpIsNull:            (*VM).opIsNull,
+}
+
+// dispatch runs the handler for op, the opcode at offset ip of ins, looked
+// up in handlers. Build without the dispatch_table tag to use a switch.
+func (vm *VM) dispatch(op code.Opcode, ins code.Instructions, ip int) error {
+	handler := handlers[op]
+	if handler == nil {
+		return fmt.Errorf("opcode %d undefined", op)
+	}
+	return handler(vm, ins, ip)
+}
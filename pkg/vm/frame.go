@@ -0,0 +1,32 @@
+// The Monkey Language vm call frame
+package vm
+
+import (
+	"github.com/freddiehaddad/monkey.compiler/pkg/code"
+)
+
+type Frame struct {
+	closure     *Closure
+	ip          int
+	basePointer int // Stack slot of the first local, sp before the call
+}
+
+func NewFrame(closure *Closure, basePointer int) *Frame {
+	return &Frame{
+		closure:     closure,
+		ip:          -1,
+		basePointer: basePointer,
+	}
+}
+
+// FrameInfo describes a frame on the call stack. IP is the offset of the
+// instruction the frame executed last, the call for frames that called
+// another function.
+type FrameInfo struct {
+	Function string
+	IP       int
+}
+
+func (f *Frame) Instructions() code.Instructions {
+	return f.closure.Fn.Instructions
+}
@@ -0,0 +1,297 @@
+// The Monkey Language vm instruction handlers
+package vm
+
+import (
+	"fmt"
+
+	"github.com/freddiehaddad/monkey.compiler/pkg/builtins"
+	"github.com/freddiehaddad/monkey.compiler/pkg/code"
+	"github.com/freddiehaddad/monkey.interpreter/pkg/object"
+)
+
+// Each handler executes the instruction at offset ip of ins, the current
+// frame's instructions, and moves the frame's ip past its operands.
+
+func (vm *VM) opNull(ins code.Instructions, ip int) error {
+	return vm.push(Null)
+}
+
+func (vm *VM) opPop(ins code.Instructions, ip int) error {
+	vm.pop()
+	return nil
+}
+
+func (vm *VM) opDup(ins code.Instructions, ip int) error {
+	// Objects are immutable, sharing the pointer is a copy
+	return vm.push(vm.stack[vm.sp-1])
+}
+
+func (vm *VM) opSwap(ins code.Instructions, ip int) error {
+	vm.stack[vm.sp-1], vm.stack[vm.sp-2] = vm.stack[vm.sp-2], vm.stack[vm.sp-1]
+	return nil
+}
+
+func (vm *VM) opConstant(ins code.Instructions, ip int) error {
+	constIndex := code.ReadUint16(ins[ip+1:])
+	vm.currentFrame().ip += 2
+
+	return vm.push(vm.constants[constIndex])
+}
+
+func (vm *VM) opConstantWide(ins code.Instructions, ip int) error {
+	constIndex := code.ReadUint32(ins[ip+1:])
+	vm.currentFrame().ip += 4
+
+	return vm.push(vm.constants[constIndex])
+}
+
+func (vm *VM) opTrue(ins code.Instructions, ip int) error {
+	return vm.push(True)
+}
+
+func (vm *VM) opFalse(ins code.Instructions, ip int) error {
+	return vm.push(False)
+}
+
+func (vm *VM) opArray(ins code.Instructions, ip int) error {
+	elements := int(code.ReadUint16(ins[ip+1:]))
+	vm.currentFrame().ip += 2
+
+	array := &object.Array{Elements: make([]object.Object, elements)}
+
+	// Last array element is at the top of the stack
+	for i := elements; i > 0; i-- {
+		array.Elements[i-1] = vm.pop()
+	}
+
+	return vm.push(array)
+}
+
+func (vm *VM) opHash(ins code.Instructions, ip int) error {
+	pairs := int(code.ReadUint16(ins[ip+1:]))
+	vm.currentFrame().ip += 2
+
+	hash := &object.Hash{
+		Pairs: make(map[object.HashKey]object.HashPair),
+	}
+
+	// value, pair is the order on the stack
+	for i := 0; i < pairs; i++ {
+		value := vm.pop()
+		key := vm.pop()
+
+		pair := object.HashPair{Key: key, Value: value}
+		hashKey, ok := key.(object.Hashable)
+		if !ok {
+			return fmt.Errorf("unusable as hash key: %s", key.Type())
+		}
+
+		hash.Pairs[hashKey.HashKey()] = pair
+	}
+
+	return vm.push(hash)
+}
+
+func (vm *VM) opIndex(ins code.Instructions, ip int) error {
+	key := vm.pop()
+	value := vm.pop()
+	if err := errorOperand(value, key); err != nil {
+		return err
+	}
+
+	switch {
+	case value.Type() == object.ARRAY_OBJ && key.Type() == object.INTEGER_OBJ:
+		index := int(key.(*object.Integer).Value)
+		array := value.(*object.Array).Elements
+		if index >= 0 && index < len(array) {
+			vm.push(array[index])
+		} else {
+			vm.push(Null)
+		}
+	case value.Type() == object.ARRAY_OBJ:
+		return newOperandError("array index must be %s, got %s",
+			object.INTEGER_OBJ, key.Type())
+	case value.Type() == object.STRING_OBJ && key.Type() == object.INTEGER_OBJ:
+		// Strings are indexed by character, not by byte
+		index := int(key.(*object.Integer).Value)
+		runes := []rune(value.(*object.String).Value)
+		if index >= 0 && index < len(runes) {
+			vm.push(&object.String{Value: string(runes[index])})
+		} else {
+			vm.push(Null)
+		}
+	case value.Type() == object.STRING_OBJ:
+		return newOperandError("string index must be %s, got %s",
+			object.INTEGER_OBJ, key.Type())
+	case value.Type() == object.HASH_OBJ:
+		hashTable := value.(*object.Hash).Pairs
+		hashKey, ok := key.(object.Hashable)
+		if !ok {
+			return newOperandError("unusable as hash key: %s", key.Type())
+		}
+		if pair, ok := hashTable[hashKey.HashKey()]; ok {
+			vm.push(pair.Value)
+		} else {
+			vm.push(Null)
+		}
+	default:
+		return newOperandError("index operator not supported: %s", value.Type())
+	}
+	return nil
+}
+
+func (vm *VM) opBinary(ins code.Instructions, ip int) error {
+	return vm.executeBinaryOperation(code.Opcode(ins[ip]))
+}
+
+func (vm *VM) opComparison(ins code.Instructions, ip int) error {
+	return vm.executeComparison(code.Opcode(ins[ip]))
+}
+
+func (vm *VM) opBang(ins code.Instructions, ip int) error {
+	return vm.executeBangOperator()
+}
+
+func (vm *VM) opMinus(ins code.Instructions, ip int) error {
+	return vm.executeMinusOperator()
+}
+
+func (vm *VM) opBitNot(ins code.Instructions, ip int) error {
+	return vm.executeBitNotOperator()
+}
+
+func (vm *VM) opJump(ins code.Instructions, ip int) error {
+	address := int(code.ReadUint16(ins[ip+1:]))
+	vm.currentFrame().ip = address - 1
+	return nil
+}
+
+func (vm *VM) opJumpNotTruthy(ins code.Instructions, ip int) error {
+	address := int(code.ReadUint16(ins[ip+1:]))
+	vm.currentFrame().ip += 2
+
+	condition := vm.pop()
+	if !isTruthy(condition) {
+		vm.currentFrame().ip = address - 1
+	}
+	return nil
+}
+
+func (vm *VM) opJumpWide(ins code.Instructions, ip int) error {
+	address := int(code.ReadUint32(ins[ip+1:]))
+	vm.currentFrame().ip = address - 1
+	return nil
+}
+
+func (vm *VM) opJumpNotTruthyWide(ins code.Instructions, ip int) error {
+	address := int(code.ReadUint32(ins[ip+1:]))
+	vm.currentFrame().ip += 4
+
+	condition := vm.pop()
+	if !isTruthy(condition) {
+		vm.currentFrame().ip = address - 1
+	}
+	return nil
+}
+
+func (vm *VM) opLoop(ins code.Instructions, ip int) error {
+	delta := int(code.ReadUint16(ins[ip+1:]))
+	vm.currentFrame().ip -= delta + 1
+	return nil
+}
+
+func (vm *VM) opGetGlobal(ins code.Instructions, ip int) error {
+	globalIndex := int(code.ReadUint16(ins[ip+1:]))
+	vm.currentFrame().ip += 2
+	if globalIndex >= len(vm.global) {
+		return fmt.Errorf("global %d out of range", globalIndex)
+	}
+	value := vm.getGlobal(globalIndex)
+	return vm.push(value)
+}
+
+func (vm *VM) opSetGlobal(ins code.Instructions, ip int) error {
+	globalIndex := int(code.ReadUint16(ins[ip+1:]))
+	vm.currentFrame().ip += 2
+	if globalIndex >= len(vm.global) {
+		return fmt.Errorf("global %d out of range", globalIndex)
+	}
+	value := vm.pop()
+	vm.setGlobal(globalIndex, value)
+	return nil
+}
+
+func (vm *VM) opGetLocal(ins code.Instructions, ip int) error {
+	localIndex := int(code.ReadUint8(ins[ip+1:]))
+	vm.currentFrame().ip += 1
+
+	frame := vm.currentFrame()
+	return vm.push(vm.stack[frame.basePointer+localIndex])
+}
+
+func (vm *VM) opSetLocal(ins code.Instructions, ip int) error {
+	localIndex := int(code.ReadUint8(ins[ip+1:]))
+	vm.currentFrame().ip += 1
+
+	frame := vm.currentFrame()
+	vm.stack[frame.basePointer+localIndex] = vm.pop()
+	return nil
+}
+
+func (vm *VM) opCall(ins code.Instructions, ip int) error {
+	numArgs := int(code.ReadUint8(ins[ip+1:]))
+	vm.currentFrame().ip += 1
+
+	return vm.executeCall(numArgs)
+}
+
+func (vm *VM) opReturnValue(ins code.Instructions, ip int) error {
+	returnValue := vm.pop()
+
+	// Discard the locals, arguments and the called function
+	frame := vm.popFrame()
+	vm.sp = frame.basePointer - 1
+
+	return vm.push(returnValue)
+}
+
+func (vm *VM) opReturn(ins code.Instructions, ip int) error {
+	frame := vm.popFrame()
+	vm.sp = frame.basePointer - 1
+
+	return vm.push(Null)
+}
+
+func (vm *VM) opClosure(ins code.Instructions, ip int) error {
+	constIndex := int(code.ReadUint16(ins[ip+1:]))
+	numFree := int(code.ReadUint8(ins[ip+3:]))
+	vm.currentFrame().ip += 3
+
+	return vm.pushClosure(constIndex, numFree)
+}
+
+func (vm *VM) opGetFree(ins code.Instructions, ip int) error {
+	freeIndex := int(code.ReadUint8(ins[ip+1:]))
+	vm.currentFrame().ip += 1
+
+	currentClosure := vm.currentFrame().closure
+	return vm.push(currentClosure.Free[freeIndex])
+}
+
+func (vm *VM) opCurrentClosure(ins code.Instructions, ip int) error {
+	currentClosure := vm.currentFrame().closure
+	return vm.push(currentClosure)
+}
+
+func (vm *VM) opGetBuiltin(ins code.Instructions, ip int) error {
+	builtinIndex := int(code.ReadUint8(ins[ip+1:]))
+	vm.currentFrame().ip += 1
+
+	definition := builtins.Builtins[builtinIndex]
+	return vm.push(definition.Builtin)
+}
+
+func (vm *VM) opIsNull(ins code.Instructions, ip int) error {
+	operand := vm.pop()
+	return vm.push(nativeBoolToBooleanObject(operand == Null))
+}
@@ -0,0 +1,45 @@
+// The Monkey Language vm execution statistics
+package vm
+
+import (
+	"sort"
+
+	"github.com/freddiehaddad/monkey.compiler/pkg/code"
+)
+
+// Stats counts the instructions a VM executed, indexed by opcode.
+type Stats struct {
+	Counts [256]uint64
+}
+
+// OpcodeCount is the number of times an opcode was executed.
+type OpcodeCount struct {
+	Op    code.Opcode
+	Count uint64
+}
+
+// TopN returns up to n of the executed opcodes, most executed first.
+// Opcodes executed equally often are ordered by opcode.
+func (s Stats) TopN(n int) []OpcodeCount {
+	counts := []OpcodeCount{}
+	for op, count := range s.Counts {
+		if count > 0 {
+			counts = append(counts, OpcodeCount{code.Opcode(op), count})
+		}
+	}
+
+	sort.SliceStable(counts, func(i, j int) bool {
+		return counts[i].Count > counts[j].Count
+	})
+
+	if n < len(counts) {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// ExecutionStats returns the instructions counted since vm was created or
+// last Reset.
+func (vm *VM) ExecutionStats() Stats {
+	return vm.stats
+}
@@ -0,0 +1,60 @@
+// The Monkey Language vm execution statistics unit tests
+package vm
+
+import (
+	"testing"
+
+	"github.com/freddiehaddad/monkey.compiler/pkg/code"
+	"github.com/freddiehaddad/monkey.compiler/pkg/compiler"
+)
+
+func TestExecutionStats(t *testing.T) {
+	input := `
+		let sum = fn(n, acc) { if (n == 0) { acc } else { sum(n - 1, acc + n * n + n) } };
+		sum(100, 0);
+	`
+
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	stats := vm.ExecutionStats()
+
+	// Two additions per call except the last
+	if stats.Counts[code.OpAdd] != 200 {
+		t.Errorf("wrong OpAdd count. want=200, got=%d", stats.Counts[code.OpAdd])
+	}
+
+	top := stats.TopN(5)
+	if len(top) != 5 {
+		t.Fatalf("wrong number of opcodes. want=5, got=%d", len(top))
+	}
+
+	found := false
+	for i, count := range top {
+		if i > 0 && count.Count > top[i-1].Count {
+			t.Errorf("top[%d] executed more often than top[%d]", i, i-1)
+		}
+		if count.Op == code.OpAdd {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("OpAdd missing from %v", top)
+	}
+
+	if got := len(stats.TopN(1000)); got >= 256 {
+		t.Errorf("opcodes never executed included, got %d", got)
+	}
+
+	vm.Reset(comp.Bytecode())
+	if len(vm.ExecutionStats().TopN(1)) != 0 {
+		t.Errorf("counts not cleared by Reset")
+	}
+}
@@ -2,7 +2,14 @@
 package vm
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"runtime/debug"
+	"strings"
+	"sync"
 
 	"github.com/freddiehaddad/monkey.compiler/pkg/code"
 	"github.com/freddiehaddad/monkey.compiler/pkg/compiler"
@@ -12,6 +19,10 @@ import (
 const (
 	StackSize  = 2048
 	GlobalSize = 65536
+	MaxFrames  = 1024
+
+	// Instructions executed between checks for a cancelled context
+	ContextCheckInterval = 1000
 )
 
 var True = &object.Boolean{Value: true}
@@ -19,171 +30,467 @@ var False = &object.Boolean{Value: false}
 
 var Null = &object.Null{}
 
+// Globals holds global variable values VMs share across goroutines,
+// together with the lock guarding them. VMs sharing a plain slice have no
+// lock in common, the store gives them one without a package-wide lock that
+// unrelated VMs would contend for. See NewWithGlobalsStore.
+type Globals struct {
+	mu     sync.RWMutex
+	values []object.Object
+}
+
+// NewGlobals returns size globals that are not set yet.
+func NewGlobals(size int) *Globals {
+	return &Globals{values: make([]object.Object, size)}
+}
+
+// Values returns a copy of the global variable values.
+func (g *Globals) Values() []object.Object {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	values := make([]object.Object, len(g.values))
+	copy(values, g.values)
+	return values
+}
+
 type VM struct {
-	constants    []object.Object
-	instructions code.Instructions
+	constants []object.Object
 
 	global []object.Object
 
 	stack []object.Object
 	sp    int // Always points to the next value. Top of stack is stack[sp-1]
+
+	frames      []*Frame
+	framesIndex int
+
+	// Frames allowed on the call stack, including the main program's
+	MaxCallDepth int
+
+	// Instructions Run may execute, zero means no limit
+	MaxInstructions int
+
+	// Lock the globals on every read and write, off by default to avoid
+	// the overhead. NewWithGlobalsStore turns it on, it has no effect on
+	// VMs without a Globals store.
+	ConcurrentGlobals bool
+
+	// Guards global when it belongs to a Globals, nil otherwise
+	globalsMu *sync.RWMutex
+
+	// Push errors about operand values as *object.Error results instead
+	// of stopping the program
+	ErrorValues bool
+
+	// Stack slots the main program needs, checked before running it
+	stackDepth int
+
+	// Receives a line per executed instruction when not nil
+	trace io.Writer
+
+	// Called before each instruction when not nil
+	stepCallback func(ip int, op code.Opcode)
+
+	// Executed instructions per opcode
+	stats Stats
+
+	// Receives the stack trace of recovered panics when not nil
+	panicLog io.Writer
+}
+
+// operandError is an error about the values an instruction operates on,
+// the program can go on with an *object.Error as the instruction's result.
+type operandError struct {
+	message string
 }
 
-func NewWithState(bytecode *compiler.Bytecode, global []object.Object) *VM {
-	return &VM{
-		instructions: bytecode.Instructions,
-		constants:    bytecode.Constants,
+func (e *operandError) Error() string {
+	return e.message
+}
 
-		global: global,
+func newOperandError(format string, a ...interface{}) error {
+	return &operandError{message: fmt.Sprintf(format, a...)}
+}
 
-		stack: make([]object.Object, StackSize),
-		sp:    0,
+// errorOperand returns the first *object.Error among operands as a Go
+// error. Error values may be stored, passed, returned and tested, but an
+// instruction operating on one stops the program.
+func errorOperand(operands ...object.Object) error {
+	for _, operand := range operands {
+		if err, ok := operand.(*object.Error); ok {
+			return errors.New(err.Message)
+		}
 	}
+	return nil
 }
 
-func New(bytecode *compiler.Bytecode) *VM {
-	return &VM{
-		instructions: bytecode.Instructions,
-		constants:    bytecode.Constants,
+// Option configures a VM created by New or NewWithState.
+type Option func(*VM)
 
-		global: make([]object.Object, GlobalSize),
+// WithStackSize gives the VM a stack of n slots instead of StackSize.
+func WithStackSize(n int) Option {
+	return func(vm *VM) {
+		vm.stack = make([]object.Object, n)
+	}
+}
 
-		stack: make([]object.Object, StackSize),
-		sp:    0,
+// WithGlobalSize gives the VM n globals instead of GlobalSize. It has no
+// effect on NewWithState, which uses the globals it is given.
+func WithGlobalSize(n int) Option {
+	return func(vm *VM) {
+		vm.global = make([]object.Object, n)
 	}
 }
 
-func (vm *VM) Run() error {
-	for ip := 0; ip < len(vm.instructions); ip++ {
-		op := code.Opcode(vm.instructions[ip])
+func NewWithState(bytecode *compiler.Bytecode, global []object.Object, opts ...Option) *VM {
+	vm := New(bytecode, opts...)
+	vm.global = global
+	return vm
+}
 
-		switch op {
-		case code.OpNull:
-			if err := vm.push(Null); err != nil {
-				return err
-			}
-		case code.OpPop:
-			vm.pop()
-		case code.OpConstant:
-			constIndex := code.ReadUint16(vm.instructions[ip+1:])
-			ip += 2
-
-			if err := vm.push(vm.constants[constIndex]); err != nil {
-				return err
-			}
-		case code.OpTrue:
-			if err := vm.push(True); err != nil {
-				return err
-			}
-		case code.OpFalse:
-			if err := vm.push(False); err != nil {
-				return err
-			}
-		case code.OpArray:
-			elements := int(code.ReadUint16(vm.instructions[ip+1:]))
-			ip += 2
+// NewWithGlobalsStore is NewWithState for VMs sharing globals across
+// goroutines, with ConcurrentGlobals on. Reads and writes of the globals
+// take their lock, VMs sharing other Globals don't contend for it.
+func NewWithGlobalsStore(bytecode *compiler.Bytecode, globals *Globals, opts ...Option) *VM {
+	vm := NewWithState(bytecode, globals.values, opts...)
+	vm.globalsMu = &globals.mu
+	vm.ConcurrentGlobals = true
+	return vm
+}
 
-			array := &object.Array{Elements: make([]object.Object, elements)}
+func New(bytecode *compiler.Bytecode, opts ...Option) *VM {
+	mainFn := &compiler.CompiledFunction{Instructions: bytecode.Instructions}
+	mainClosure := &Closure{Fn: mainFn}
+	mainFrame := NewFrame(mainClosure, 0)
 
-			// Last array element is at the top of the stack
-			for i := elements; i > 0; i-- {
-				array.Elements[i-1] = vm.pop()
-			}
+	frames := make([]*Frame, MaxFrames)
+	frames[0] = mainFrame
 
-			if err := vm.push(array); err != nil {
-				return err
-			}
-		case code.OpHash:
-			pairs := int(code.ReadUint16(vm.instructions[ip+1:]))
-			ip += 2
+	vm := &VM{
+		constants: bytecode.Constants,
 
-			hash := &object.Hash{
-				Pairs: make(map[object.HashKey]object.HashPair),
-			}
+		sp: 0,
 
-			// value, pair is the order on the stack
-			for i := 0; i < pairs; i++ {
-				value := vm.pop()
-				key := vm.pop()
+		frames:       frames,
+		framesIndex:  1,
+		MaxCallDepth: MaxFrames,
 
-				pair := object.HashPair{Key: key, Value: value}
-				hashKey, ok := key.(object.Hashable)
-				if !ok {
-					return fmt.Errorf("unusable as hash key: %s", key.Type())
-				}
+		stackDepth: bytecode.MaxStackDepth(),
+	}
 
-				hash.Pairs[hashKey.HashKey()] = pair
-			}
+	for _, opt := range opts {
+		opt(vm)
+	}
 
-			if err := vm.push(hash); err != nil {
-				return err
-			}
-		case code.OpIndex:
-			key := vm.pop()
-			value := vm.pop()
-			switch {
-			case value.Type() == object.ARRAY_OBJ && key.Type() == object.INTEGER_OBJ:
-				index := int(key.(*object.Integer).Value)
-				array := value.(*object.Array).Elements
-				if index >= 0 && index < len(array) {
-					vm.push(array[index])
-				} else {
-					vm.push(Null)
-				}
-			case value.Type() == object.HASH_OBJ:
-				hashTable := value.(*object.Hash).Pairs
-				hashKey, ok := key.(object.Hashable)
-				if !ok {
-					return fmt.Errorf("unusable as hash key: %s", key.Type())
-				}
-				if pair, ok := hashTable[hashKey.HashKey()]; ok {
-					vm.push(pair.Value)
-				} else {
-					vm.push(Null)
-				}
+	// Options may have allocated these already
+	if vm.global == nil {
+		vm.global = make([]object.Object, GlobalSize)
+	}
+	if vm.stack == nil {
+		vm.stack = make([]object.Object, StackSize)
+	}
+
+	return vm
+}
+
+// Reset prepares vm to run bytecode, reusing its stack, frames and globals
+// instead of allocating new ones. The globals keep their values so that
+// bytecode compiled with the same symbol table can use them. MaxCallDepth,
+// MaxInstructions, tracing and the step callback are kept as well, the
+// execution statistics start over.
+func (vm *VM) Reset(bytecode *compiler.Bytecode) {
+	mainFn := &compiler.CompiledFunction{Instructions: bytecode.Instructions}
+	mainClosure := &Closure{Fn: mainFn}
+
+	vm.constants = bytecode.Constants
+
+	// Drop references left by the previous run
+	for i := range vm.stack {
+		vm.stack[i] = nil
+	}
+	vm.sp = 0
+
+	for i := 1; i < vm.framesIndex; i++ {
+		vm.frames[i] = nil
+	}
+	vm.frames[0] = NewFrame(mainClosure, 0)
+	vm.framesIndex = 1
+
+	vm.stackDepth = bytecode.MaxStackDepth()
+	vm.stats = Stats{}
+}
+
+func (vm *VM) currentFrame() *Frame {
+	return vm.frames[vm.framesIndex-1]
+}
+
+// WithMaxCallDepth sets MaxCallDepth and returns vm.
+func (vm *VM) WithMaxCallDepth(n int) *VM {
+	vm.MaxCallDepth = n
+	return vm
+}
+
+// WithMaxInstructions sets MaxInstructions and returns vm.
+func (vm *VM) WithMaxInstructions(n int) *VM {
+	vm.MaxInstructions = n
+	return vm
+}
+
+// Trace makes Run write a line to w for every instruction it executes:
+// the offset, the opcode and its operands, and the stack pointer and top of
+// the stack before the instruction runs. A nil w turns tracing off.
+func (vm *VM) Trace(w io.Writer) {
+	vm.trace = w
+}
+
+// LogPanics makes Step write the Go stack trace of a panic it recovers from
+// to w. A nil w turns logging off.
+func (vm *VM) LogPanics(w io.Writer) {
+	vm.panicLog = w
+}
+
+func (vm *VM) traceInstruction(ins code.Instructions, ip int) {
+	text := fmt.Sprintf("UNKNOWN(%d)", ins[ip])
+	if def, err := code.Lookup(ins[ip]); err == nil {
+		operands, _ := code.ReadOperands(def, ins[ip+1:])
+		fields := []string{def.Name}
+		for _, operand := range operands {
+			fields = append(fields, fmt.Sprint(operand))
+		}
+		text = strings.Join(fields, " ")
+	}
+
+	top := "<empty>"
+	if vm.sp > 0 {
+		top = fmt.Sprintf("<%s: %s>", vm.stack[vm.sp-1].Type(), vm.stack[vm.sp-1].Inspect())
+	}
+
+	fmt.Fprintf(vm.trace, "%04d %-14s sp=%d top=%s\n", ip, text, vm.sp, top)
+}
+
+func (vm *VM) pushFrame(f *Frame) error {
+	if vm.framesIndex >= vm.MaxCallDepth {
+		return fmt.Errorf("stack overflow: max call depth %d exceeded", vm.MaxCallDepth)
+	}
+
+	if vm.framesIndex == len(vm.frames) {
+		vm.frames = append(vm.frames, f)
+	} else {
+		vm.frames[vm.framesIndex] = f
+	}
+	vm.framesIndex++
+
+	return nil
+}
+
+func (vm *VM) popFrame() *Frame {
+	vm.framesIndex--
+	return vm.frames[vm.framesIndex]
+}
+
+func (vm *VM) Run() error {
+	return vm.RunWithContext(context.Background())
+}
+
+// RunWithContext runs the program until it ends or ctx is done. The
+// context is checked every ContextCheckInterval instructions, the error
+// returned for a done context wraps ctx.Err().
+func (vm *VM) RunWithContext(ctx context.Context) error {
+	done := ctx.Done()
+
+	for executed := 0; ; executed++ {
+		if done != nil && executed%ContextCheckInterval == 0 {
+			select {
+			case <-done:
+				return fmt.Errorf("execution stopped: %w", ctx.Err())
 			default:
-				return fmt.Errorf("index operator not supported: %s", key.Type())
-			}
-		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
-			vm.executeBinaryOperation(op)
-		case code.OpEqual, code.OpNotEqual, code.OpLessThan, code.OpGreaterThan:
-			vm.executeComparison(op)
-		case code.OpBang:
-			if err := vm.executeBangOperator(); err != nil {
-				return err
-			}
-		case code.OpMinus:
-			if err := vm.executeMinusOperator(); err != nil {
-				return err
 			}
-		case code.OpJump:
-			address := int(code.ReadUint16(vm.instructions[ip+1:]))
-			ip = address - 1
-		case code.OpJumpNotTruthy:
-			address := int(code.ReadUint16(vm.instructions[ip+1:]))
-			ip += 2
-
-			condition := vm.pop()
-			if !isTruthy(condition) {
-				ip = address - 1
-			}
-		case code.OpGetGlobal:
-			globalIndex := int(code.ReadUint16(vm.instructions[ip+1:]))
-			ip += 2
-			value := vm.global[globalIndex]
-			if err := vm.push(value); err != nil {
-				return err
+		}
+		if vm.MaxInstructions > 0 && executed == vm.MaxInstructions {
+			return fmt.Errorf("execution limit reached after %d instructions", executed)
+		}
+
+		finished, err := vm.Step()
+		if err != nil || finished {
+			return err
+		}
+	}
+}
+
+// IP returns the offset of the next instruction to execute in the current
+// frame's instructions.
+func (vm *VM) IP() int {
+	return vm.currentFrame().ip + 1
+}
+
+// SetStepCallback makes Step call fn with the offset and opcode of every
+// instruction before executing it. A nil fn removes the callback.
+func (vm *VM) SetStepCallback(fn func(ip int, op code.Opcode)) {
+	vm.stepCallback = fn
+}
+
+// Step executes the next instruction. It reports done when the program has
+// no instructions left, executing nothing if that was already the case. A
+// panic while executing, a bug in the VM or in malformed bytecode, is
+// returned as an error.
+func (vm *VM) Step() (done bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if vm.panicLog != nil {
+				fmt.Fprintf(vm.panicLog, "panic: %v\n\n%s", r, debug.Stack())
 			}
-		case code.OpSetGlobal:
-			globalIndex := int(code.ReadUint16(vm.instructions[ip+1:]))
-			ip += 2
-			value := vm.pop()
-			vm.global[globalIndex] = value
+			err = fmt.Errorf("internal VM error: %v", r)
 		}
+	}()
+
+	if vm.stackDepth > len(vm.stack) {
+		return false, fmt.Errorf("stack overflow: program needs %d stack slots, StackSize is %d",
+			vm.stackDepth, len(vm.stack))
 	}
+
+	if vm.currentFrame().ip >= len(vm.currentFrame().Instructions())-1 {
+		return true, nil
+	}
+
+	if err := vm.execute(); err != nil {
+		var operandErr *operandError
+		if !vm.ErrorValues || !errors.As(err, &operandErr) {
+			return false, err
+		}
+		if err := vm.push(&object.Error{Message: operandErr.message}); err != nil {
+			return false, err
+		}
+	}
+
+	return vm.currentFrame().ip >= len(vm.currentFrame().Instructions())-1, nil
+}
+
+func (vm *VM) execute() error {
+	vm.currentFrame().ip++
+
+	ip := vm.currentFrame().ip
+	ins := vm.currentFrame().Instructions()
+	op := code.Opcode(ins[ip])
+	vm.stats.Counts[op]++
+
+	if vm.trace != nil {
+		vm.traceInstruction(ins, ip)
+	}
+	if vm.stepCallback != nil {
+		vm.stepCallback(ip, op)
+	}
+
+	return vm.dispatch(op, ins, ip)
+}
+
+func (vm *VM) executeCall(numArgs int) error {
+	callee := vm.stack[vm.sp-1-numArgs]
+	if err := errorOperand(callee); err != nil {
+		return err
+	}
+
+	switch callee := callee.(type) {
+	case *Closure:
+		return vm.callClosure(callee, numArgs)
+	case *object.Builtin:
+		return vm.callBuiltin(callee, numArgs)
+	default:
+		return fmt.Errorf("calling non-function and non-built-in")
+	}
+}
+
+func (vm *VM) callClosure(closure *Closure, numArgs int) error {
+	if numArgs != closure.Fn.NumParameters {
+		return fmt.Errorf("wrong number of arguments: want=%d, got=%d",
+			closure.Fn.NumParameters, numArgs)
+	}
+
+	// A function returning the result of calling itself reuses its frame,
+	// so deep recursion in tail position doesn't run out of frames. The
+	// reused frame appears once in CallStack.
+	if current := vm.currentFrame(); current.closure == closure && vm.isTailCall() {
+		copy(vm.stack[current.basePointer:], vm.stack[vm.sp-numArgs:vm.sp])
+		vm.sp = current.basePointer + closure.Fn.NumLocals
+		current.ip = -1
+		return nil
+	}
+
+	// Arguments are already on the stack and become the first locals
+	if vm.sp-numArgs+closure.Fn.NumLocals > len(vm.stack) {
+		return fmt.Errorf("stack overflow")
+	}
+	frame := NewFrame(closure, vm.sp-numArgs)
+	if err := vm.pushFrame(frame); err != nil {
+		return err
+	}
+
+	vm.sp = frame.basePointer + closure.Fn.NumLocals
+
 	return nil
 }
 
+// isTailCall reports whether the call the current frame is executing is
+// followed by returning its result, directly or after jumping out of
+// conditionals.
+func (vm *VM) isTailCall() bool {
+	frame := vm.currentFrame()
+	ins := frame.Instructions()
+
+	// Only forward jumps are followed, so the walk ends
+	for offset := frame.ip + 1; offset < len(ins); {
+		var target int
+		switch code.Opcode(ins[offset]) {
+		case code.OpReturnValue:
+			return true
+		case code.OpJump:
+			target = int(code.ReadUint16(ins[offset+1:]))
+		case code.OpJumpWide:
+			target = int(code.ReadUint32(ins[offset+1:]))
+		default:
+			return false
+		}
+
+		if target <= offset {
+			return false
+		}
+		offset = target
+	}
+	return false
+}
+
+func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
+	args := vm.stack[vm.sp-numArgs : vm.sp]
+
+	result := builtin.Fn(args...)
+
+	// Built-ins run without a frame, discard the arguments and the callee
+	vm.sp = vm.sp - numArgs - 1
+
+	if result != nil {
+		return vm.push(result)
+	}
+	return vm.push(Null)
+}
+
+func (vm *VM) pushClosure(constIndex, numFree int) error {
+	constant := vm.constants[constIndex]
+	function, ok := constant.(*compiler.CompiledFunction)
+	if !ok {
+		return fmt.Errorf("not a function: %+v", constant)
+	}
+
+	// The free variables were pushed in order just before OpClosure
+	free := make([]object.Object, numFree)
+	for i := 0; i < numFree; i++ {
+		free[i] = vm.stack[vm.sp-numFree+i]
+	}
+	vm.sp = vm.sp - numFree
+
+	closure := &Closure{Fn: function, Free: free}
+	return vm.push(closure)
+}
+
 func isTruthy(obj object.Object) bool {
 	switch obj := obj.(type) {
 	case *object.Boolean:
@@ -197,15 +504,34 @@ func isTruthy(obj object.Object) bool {
 
 func (vm *VM) executeMinusOperator() error {
 	operand := vm.pop()
+	if err := errorOperand(operand); err != nil {
+		return err
+	}
 
 	if operand.Type() != object.INTEGER_OBJ {
-		return fmt.Errorf("unsupported type for negation: %s", operand.Type())
+		return newOperandError("unsupported operand type for %s: %s",
+			code.OpMinus, operand.Type())
 	}
 
 	value := operand.(*object.Integer).Value
 	return vm.push(&object.Integer{Value: -value})
 }
 
+func (vm *VM) executeBitNotOperator() error {
+	operand := vm.pop()
+	if err := errorOperand(operand); err != nil {
+		return err
+	}
+
+	if operand.Type() != object.INTEGER_OBJ {
+		return newOperandError("unsupported operand type for %s: %s",
+			code.OpBitNot, operand.Type())
+	}
+
+	value := operand.(*object.Integer).Value
+	return vm.push(&object.Integer{Value: ^value})
+}
+
 func (vm *VM) executeBangOperator() error {
 	operand := vm.pop()
 
@@ -232,19 +558,27 @@ func (vm *VM) executeComparison(op code.Opcode) error {
 		return vm.executeIntegerComparison(op, left, right)
 	}
 
+	if leftType == object.STRING_OBJ && rightType == object.STRING_OBJ {
+		return vm.executeStringComparison(op, left, right)
+	}
+
 	switch op {
 	case code.OpEqual:
 		return vm.push(nativeBoolToBooleanObject(left == right))
 	case code.OpNotEqual:
 		return vm.push(nativeBoolToBooleanObject(left != right))
 	default:
-		return fmt.Errorf("unknown operator: %d (%s %s)", op, leftType, rightType)
+		return newOperandError("unsupported operand types for %s: %s and %s",
+			op, leftType, rightType)
 	}
 }
 
 func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 	right := vm.pop()
 	left := vm.pop()
+	if err := errorOperand(left, right); err != nil {
+		return err
+	}
 
 	leftType := left.Type()
 	rightType := right.Type()
@@ -257,8 +591,12 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 		return vm.executeBinaryStringOperation(op, left, right)
 	}
 
-	return fmt.Errorf("unsupported types for binary operation: %s %s",
-		leftType, rightType)
+	if op == code.OpMul && leftType == object.STRING_OBJ && rightType == object.INTEGER_OBJ {
+		return vm.executeStringRepetition(left, right)
+	}
+
+	return newOperandError("unsupported operand types for %s: %s and %s",
+		op, leftType, rightType)
 }
 
 func (vm *VM) executeIntegerComparison(
@@ -276,8 +614,36 @@ func (vm *VM) executeIntegerComparison(
 		return vm.push(nativeBoolToBooleanObject(leftValue < rightValue))
 	case code.OpGreaterThan:
 		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+	case code.OpLessOrEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue <= rightValue))
+	case code.OpGreaterOrEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue >= rightValue))
 	default:
-		return fmt.Errorf("unknown operator: %d", op)
+		return fmt.Errorf("unknown operator: %s", op)
+	}
+}
+
+func (vm *VM) executeStringComparison(
+	op code.Opcode, left, right object.Object) error {
+
+	leftValue := left.(*object.String).Value
+	rightValue := right.(*object.String).Value
+
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue == rightValue))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue != rightValue))
+	case code.OpLessThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue < rightValue))
+	case code.OpGreaterThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+	case code.OpLessOrEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue <= rightValue))
+	case code.OpGreaterOrEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue >= rightValue))
+	default:
+		return fmt.Errorf("unknown operator: %s", op)
 	}
 }
 
@@ -305,9 +671,32 @@ func (vm *VM) executeBinaryIntegerOberation(
 	case code.OpMul:
 		result = lValue * rValue
 	case code.OpDiv:
+		if rValue == 0 {
+			return newOperandError("integer division by zero")
+		}
 		result = lValue / rValue
+	case code.OpMod:
+		if rValue == 0 {
+			return newOperandError("integer modulo by zero")
+		}
+		result = lValue % rValue
+	case code.OpBitAnd:
+		result = lValue & rValue
+	case code.OpBitOr:
+		result = lValue | rValue
+	case code.OpBitXor:
+		result = lValue ^ rValue
+	case code.OpLeftShift, code.OpRightShift:
+		if rValue < 0 {
+			return newOperandError("negative shift amount: %d", rValue)
+		}
+		if op == code.OpLeftShift {
+			result = lValue << rValue
+		} else {
+			result = lValue >> rValue
+		}
 	default:
-		return fmt.Errorf("unknown interger operator: %d", op)
+		return fmt.Errorf("unknown integer operator: %s", op)
 	}
 
 	return vm.push(&object.Integer{Value: result})
@@ -325,18 +714,117 @@ func (vm *VM) executeBinaryStringOperation(
 	case code.OpAdd:
 		result = lValue + rValue
 	default:
-		return fmt.Errorf("unknown interger operator: %d", op)
+		return newOperandError("unsupported operand types for %s: %s and %s",
+			op, left.Type(), right.Type())
 	}
 
 	return vm.push(&object.String{Value: result})
 }
 
+// executeStringRepetition repeats the string left right times. A negative
+// count results in Null.
+func (vm *VM) executeStringRepetition(left, right object.Object) error {
+	value := left.(*object.String).Value
+	count := right.(*object.Integer).Value
+
+	if count < 0 {
+		return vm.push(Null)
+	}
+	if len(value) > 0 && count > math.MaxInt32/int64(len(value)) {
+		return newOperandError("string repetition too long: %d * %d", len(value), count)
+	}
+
+	return vm.push(&object.String{Value: strings.Repeat(value, int(count))})
+}
+
+func (vm *VM) getGlobal(index int) object.Object {
+	if vm.ConcurrentGlobals && vm.globalsMu != nil {
+		vm.globalsMu.RLock()
+		defer vm.globalsMu.RUnlock()
+	}
+	return vm.global[index]
+}
+
+func (vm *VM) setGlobal(index int, value object.Object) {
+	if vm.ConcurrentGlobals && vm.globalsMu != nil {
+		vm.globalsMu.Lock()
+		defer vm.globalsMu.Unlock()
+	}
+	vm.global[index] = value
+}
+
+// Globals returns a copy of the global variable values.
+func (vm *VM) Globals() []object.Object {
+	if vm.ConcurrentGlobals && vm.globalsMu != nil {
+		vm.globalsMu.RLock()
+		defer vm.globalsMu.RUnlock()
+	}
+
+	globals := make([]object.Object, len(vm.global))
+	copy(globals, vm.global)
+	return globals
+}
+
+// GlobalAt returns the value of the global variable at index. Globals that
+// were never set are nil.
+func (vm *VM) GlobalAt(index int) (object.Object, error) {
+	if index < 0 || index >= len(vm.global) {
+		return nil, fmt.Errorf("global %d out of range", index)
+	}
+	return vm.getGlobal(index), nil
+}
+
+// CallStack describes the frames on the call stack, innermost first. After
+// Run fails it shows where the error happened. The main program is named
+// <main> and functions not bound by let <anonymous>.
+func (vm *VM) CallStack() []FrameInfo {
+	frames := []FrameInfo{}
+	for i := vm.framesIndex - 1; i >= 0; i-- {
+		frame := vm.frames[i]
+
+		name := frame.closure.Fn.Name
+		if i == 0 {
+			name = "<main>"
+		} else if name == "" {
+			name = "<anonymous>"
+		}
+
+		frames = append(frames, FrameInfo{
+			Function: name,
+			IP:       instructionStart(frame.Instructions(), frame.ip),
+		})
+	}
+	return frames
+}
+
+// instructionStart returns the offset of the instruction containing the
+// byte at ip. A frame's ip is left on the last operand byte it read.
+func instructionStart(ins code.Instructions, ip int) int {
+	for offset := 0; offset <= ip; {
+		_, _, width, err := ins.At(offset)
+		if err != nil || offset+width > ip {
+			return offset
+		}
+		offset += width
+	}
+	return ip
+}
+
+// StackTop returns the value on top of the stack, or nil when the stack
+// is empty.
+func (vm *VM) StackTop() object.Object {
+	if vm.sp == 0 {
+		return nil
+	}
+	return vm.stack[vm.sp-1]
+}
+
 func (vm *VM) LastPoppedStackElement() object.Object {
 	return vm.stack[vm.sp]
 }
 
 func (vm *VM) push(o object.Object) error {
-	if vm.sp >= StackSize {
+	if vm.sp >= len(vm.stack) {
 		return fmt.Errorf("stack overflow")
 	}
 
@@ -2,9 +2,18 @@
 package vm
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/freddiehaddad/monkey.compiler/pkg/code"
 	"github.com/freddiehaddad/monkey.compiler/pkg/compiler"
 	"github.com/freddiehaddad/monkey.interpreter/pkg/ast"
 	"github.com/freddiehaddad/monkey.interpreter/pkg/lexer"
@@ -17,12 +26,62 @@ type vmTestCase struct {
 	expected interface{}
 }
 
+type vmProgramTestCase struct {
+	program  *ast.Program
+	expected interface{}
+}
+
 func parse(input string) *ast.Program {
 	l := lexer.New(input)
 	p := parser.New(l)
 	return p.ParseProgram()
 }
 
+// The parser does not know every operator the compiler supports, these
+// helpers build such programs directly.
+
+func expressionProgram(expressions ...ast.Expression) *ast.Program {
+	program := &ast.Program{}
+	for _, e := range expressions {
+		statement := &ast.ExpressionStatement{Expression: e}
+		program.Statements = append(program.Statements, statement)
+	}
+	return program
+}
+
+func infixExpression(left ast.Expression, operator string, right ast.Expression) *ast.InfixExpression {
+	return &ast.InfixExpression{Left: left, Operator: operator, Right: right}
+}
+
+func prefixExpression(operator string, right ast.Expression) *ast.PrefixExpression {
+	return &ast.PrefixExpression{Operator: operator, Right: right}
+}
+
+func identifier(name string) *ast.Identifier {
+	return &ast.Identifier{Value: name}
+}
+
+// withBindings prepends the statements of input to program. Operations on
+// integer literals are folded by the compiler, run time errors need their
+// operands bound to names.
+func withBindings(input string, program *ast.Program) *ast.Program {
+	bindings := parse(input)
+	bindings.Statements = append(bindings.Statements, program.Statements...)
+	return bindings
+}
+
+func integerLiteral(value int64) *ast.IntegerLiteral {
+	return &ast.IntegerLiteral{Value: value}
+}
+
+func booleanLiteral(value bool) *ast.Boolean {
+	return &ast.Boolean{Value: value}
+}
+
+func stringLiteral(value string) *ast.StringLiteral {
+	return &ast.StringLiteral{Value: value}
+}
+
 func testIntegerObject(expected int64, actual object.Object) error {
 	result, ok := actual.(*object.Integer)
 	if !ok {
@@ -69,8 +128,19 @@ func testStringObject(expected string, actual object.Object) error {
 func runVmTests(t *testing.T, tests []vmTestCase) {
 	t.Helper()
 
+	programTests := []vmProgramTestCase{}
 	for _, tt := range tests {
-		program := parse(tt.input)
+		programTests = append(programTests, vmProgramTestCase{parse(tt.input), tt.expected})
+	}
+
+	runVmProgramTests(t, programTests)
+}
+
+func runVmProgramTests(t *testing.T, tests []vmProgramTestCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		program := tt.program
 
 		comp := compiler.New()
 		if err := comp.Compile(program); err != nil {
@@ -88,6 +158,29 @@ func runVmTests(t *testing.T, tests []vmTestCase) {
 	}
 }
 
+// runVmErrorTests expects every program to fail with the error message
+// given as the expected value.
+func runVmErrorTests(t *testing.T, tests []vmProgramTestCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(tt.program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err := vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error but resulted in none.")
+		}
+
+		if err.Error() != tt.expected {
+			t.Fatalf("wrong VM error: want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
 func testExpectedObject(t *testing.T, expected interface{}, actual object.Object) {
 	t.Helper()
 
@@ -108,6 +201,16 @@ func testExpectedObject(t *testing.T, expected interface{}, actual object.Object
 		if actual != Null {
 			t.Errorf("object is not Null: %T (%+v)", actual, actual)
 		}
+	case *object.Error:
+		errObj, ok := actual.(*object.Error)
+		if !ok {
+			t.Errorf("object is not Error: %T (%+v)", actual, actual)
+			return
+		}
+		if errObj.Message != expected.Message {
+			t.Errorf("wrong error message. expected=%q, got=%q",
+				expected.Message, errObj.Message)
+		}
 	case []int:
 		array, ok := actual.(*object.Array)
 		if !ok {
@@ -164,6 +267,17 @@ func TestComparisonOperators(t *testing.T) {
 		{"(1 < 2) == false", false},
 		{"(1 > 2) == true", false},
 		{"(1 > 2) == false", true},
+		{`"a" == "a"`, true},
+		{`"a" != "a"`, false},
+		{`"a" < "b"`, true},
+		{`"b" > "a"`, true},
+		{`"apple" < "banana"`, true},
+		{`"z" > "a"`, true},
+		{`"ab" < "a"`, false},
+		{"(true == true) == false", false},
+		{"false != false", false},
+		{"1 == if (false) { 2 }", false},
+		{"(if (false) { 2 }) == if (false) { 1 }", true},
 	}
 
 	runVmTests(t, tests)
@@ -187,6 +301,18 @@ func TestIntegerArithmetic(t *testing.T) {
 	}
 
 	runVmTests(t, tests)
+
+	// 10 / 0 with literal operands is rejected by constant folding
+	errorTests := []vmProgramTestCase{
+		{
+			withBindings("let zero = 0;", expressionProgram(
+				infixExpression(integerLiteral(10), "/", identifier("zero")),
+			)),
+			"integer division by zero",
+		},
+	}
+
+	runVmErrorTests(t, errorTests)
 }
 
 func TestBooleanExpressions(t *testing.T) {
@@ -236,6 +362,9 @@ func TestStringExpressions(t *testing.T) {
 		{`"monkey"`, "monkey"},
 		{`"mon" + "key"`, "monkey"},
 		{`"mon" + "key" + "banana"`, "monkeybanana"},
+		{`"ab" * 3`, "ababab"},
+		{`"x" * 0`, ""},
+		{`"y" * -1`, Null},
 	}
 
 	runVmTests(t, tests)
@@ -307,12 +436,1873 @@ func TestIndexExpressions(t *testing.T) {
 		{"[[1, 1, 1]][0][0]", 1},
 		{"[][0]", Null},
 		{"[1, 2, 3][99]", Null},
+		{"[1, 2, 3][5]", Null},
 		{"[1][-1]", Null},
+		{"[1, 2, 3][-1]", Null},
 		{"{1: 1, 2: 2}[1]", 1},
 		{"{1: 1, 2: 2}[2]", 2},
 		{"{1: 1}[0]", Null},
 		{"{}[0]", Null},
+		{`"monkey"[0]`, "m"},
+		{`"monkey"[5]`, "y"},
+		{`"monkey"[6]`, Null},
+		{`"monkey"[-1]`, Null},
+		{`"héllo"[1]`, "é"},
+		{`""[0]`, Null},
+	}
+
+	runVmTests(t, tests)
+
+	errorTests := []vmProgramTestCase{
+		{
+			parse(`[1, 2, 3]["a"]`),
+			"array index must be INTEGER, got STRING",
+		},
+		{
+			parse(`[1, 2, 3][true]`),
+			"array index must be INTEGER, got BOOLEAN",
+		},
+		{
+			parse(`"monkey"["a"]`),
+			"string index must be INTEGER, got STRING",
+		},
+		{
+			parse("5[0]"),
+			"index operator not supported: INTEGER",
+		},
+	}
+
+	runVmErrorTests(t, errorTests)
+}
+
+func TestCallingFunctionsWithoutArguments(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+				let fivePlusTen = fn() { 5 + 10; };
+				fivePlusTen();
+			`,
+			expected: 15,
+		},
+		{
+			input: `
+				let one = fn() { 1; };
+				let two = fn() { 2; };
+				one() + two()
+			`,
+			expected: 3,
+		},
+		{
+			input: `
+				let a = fn() { 1 };
+				let b = fn() { a() + 1 };
+				let c = fn() { b() + 1 };
+				c();
+			`,
+			expected: 3,
+		},
+		{
+			input: `
+				let noReturn = fn() { };
+				noReturn();
+			`,
+			expected: Null,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestFunctionsWithReturnStatement(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+				let earlyExit = fn() { return 99; 100; };
+				earlyExit();
+			`,
+			expected: 99,
+		},
+		{
+			input: `
+				let earlyExit = fn() { return 99; return 100; };
+				earlyExit();
+			`,
+			expected: 99,
+		},
+		{
+			input: `
+				let sign = fn(x) {
+					if (x > 0) {
+						if (x > 10) { return 2; }
+						return 1;
+					}
+					0;
+				};
+				[sign(20), sign(5), sign(-5)];
+			`,
+			expected: []int{2, 1, 0},
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestFunctionsWithBareReturn(t *testing.T) {
+	// The parser requires a value after return
+	function := &ast.FunctionLiteral{
+		Body: &ast.BlockStatement{
+			Statements: []ast.Statement{
+				&ast.ReturnStatement{},
+				&ast.ExpressionStatement{Expression: integerLiteral(5)},
+			},
+		},
+	}
+
+	tests := []vmProgramTestCase{
+		{expressionProgram(&ast.CallExpression{Function: function}), Null},
+	}
+
+	runVmProgramTests(t, tests)
+}
+
+func TestCallingFunctionsWithBindings(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+				let one = fn() { let one = 1; one };
+				one();
+			`,
+			expected: 1,
+		},
+		{
+			input: `
+				let oneAndTwo = fn() { let one = 1; let two = 2; one + two; };
+				oneAndTwo();
+			`,
+			expected: 3,
+		},
+		{
+			input: `
+				let oneAndTwo = fn() { let one = 1; let two = 2; one + two; };
+				let threeAndFour = fn() { let three = 3; let four = 4; three + four; };
+				oneAndTwo() + threeAndFour();
+			`,
+			expected: 10,
+		},
+		{
+			input: `
+				let firstFoobar = fn() { let foobar = 50; foobar; };
+				let secondFoobar = fn() { let foobar = 100; foobar; };
+				firstFoobar() + secondFoobar();
+			`,
+			expected: 150,
+		},
+		{
+			input: `
+				let globalSeed = 50;
+				let minusOne = fn() {
+					let num = 1;
+					globalSeed - num;
+				}
+				let minusTwo = fn() {
+					let num = 2;
+					globalSeed - num;
+				}
+				minusOne() + minusTwo();
+			`,
+			expected: 97,
+		},
+		{
+			input: `
+				let shadow = 10;
+				let f = fn() { let shadow = 1; shadow };
+				f() + shadow;
+			`,
+			expected: 11,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestCallingFunctionsWithArgumentsAndBindings(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+				let identity = fn(a) { a; };
+				identity(4);
+			`,
+			expected: 4,
+		},
+		{
+			input: `
+				let sum = fn(a, b) { a + b; };
+				sum(1, 2);
+			`,
+			expected: 3,
+		},
+		{
+			input: `
+				let sum = fn(a, b) {
+					let c = a + b;
+					c;
+				};
+				sum(1, 2) + sum(3, 4);
+			`,
+			expected: 10,
+		},
+		{
+			input: `
+				let sum = fn(a, b) {
+					let c = a + b;
+					c;
+				};
+				let outer = fn() {
+					sum(1, 2) + sum(3, 4);
+				};
+				outer();
+			`,
+			expected: 10,
+		},
+		{
+			input: `
+				let globalNum = 10;
+
+				let sum = fn(a, b) {
+					let c = a + b;
+					c + globalNum;
+				};
+
+				let outer = fn() {
+					sum(1, 2) + sum(3, 4) + globalNum;
+				};
+
+				outer() + globalNum;
+			`,
+			expected: 50,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestCallingFunctionsWithWrongArguments(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input:    `fn() { 1; }(1);`,
+			expected: `wrong number of arguments: want=0, got=1`,
+		},
+		{
+			input:    `fn(a) { a; }();`,
+			expected: `wrong number of arguments: want=1, got=0`,
+		},
+		{
+			input:    `fn(a, b) { a + b; }(1);`,
+			expected: `wrong number of arguments: want=2, got=1`,
+		},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		if err := comp.Compile(program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err := vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error but resulted in none.")
+		}
+
+		if err.Error() != tt.expected {
+			t.Fatalf("wrong VM error: want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestClosures(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+				let newClosure = fn(a) {
+					fn() { a; };
+				};
+				let closure = newClosure(99);
+				closure();
+			`,
+			expected: 99,
+		},
+		{
+			input: `
+				let newAdder = fn(a, b) {
+					fn(c) { a + b + c };
+				};
+				let adder = newAdder(1, 2);
+				adder(8);
+			`,
+			expected: 11,
+		},
+		{
+			input: `
+				let newAdder = fn(a, b) {
+					let c = a + b;
+					fn(d) { c + d };
+				};
+				let adder = newAdder(1, 2);
+				adder(8);
+			`,
+			expected: 11,
+		},
+		{
+			input: `
+				let newAdderOuter = fn(a, b) {
+					let c = a + b;
+					fn(d) {
+						let e = d + c;
+						fn(f) { e + f; };
+					};
+				};
+				let newAdderInner = newAdderOuter(1, 2)
+				let adder = newAdderInner(3);
+				adder(8);
+			`,
+			expected: 14,
+		},
+		{
+			input: `
+				let a = 1;
+				let newAdderOuter = fn(b) {
+					fn(c) {
+						fn(d) { a + b + c + d };
+					};
+				};
+				let newAdderInner = newAdderOuter(2)
+				let adder = newAdderInner(3);
+				adder(8);
+			`,
+			expected: 14,
+		},
+		{
+			input: `
+				let newClosure = fn(a, b) {
+					let one = fn() { a; };
+					let two = fn() { b; };
+					fn() { one() + two(); };
+				};
+				let closure = newClosure(9, 90);
+				closure();
+			`,
+			expected: 99,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRecursiveFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+				let countDown = fn(x) {
+					if (x == 0) {
+						return 0;
+					} else {
+						countDown(x - 1);
+					}
+				};
+				countDown(1);
+			`,
+			expected: 0,
+		},
+		{
+			input: `
+				let countDown = fn(x) {
+					if (x == 0) {
+						return 0;
+					} else {
+						countDown(x - 1);
+					}
+				};
+				let wrapper = fn() {
+					countDown(1);
+				};
+				wrapper();
+			`,
+			expected: 0,
+		},
+		{
+			input: `
+				let wrapper = fn() {
+					let countDown = fn(x) {
+						if (x == 0) {
+							return 0;
+						} else {
+							countDown(x - 1);
+						}
+					};
+					countDown(1);
+				};
+				wrapper();
+			`,
+			expected: 0,
+		},
+		{
+			input: `
+				let newCounter = fn(limit) {
+					let count = fn(x) {
+						if (x == limit) {
+							return x;
+						} else {
+							count(x + 1);
+						}
+					};
+					count;
+				};
+				let counter = newCounter(3);
+				counter(0);
+			`,
+			expected: 3,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRecursiveFibonacci(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+				let fibonacci = fn(x) {
+					if (x == 0) {
+						return 0;
+					} else {
+						if (x == 1) {
+							return 1;
+						} else {
+							fibonacci(x - 1) + fibonacci(x - 2);
+						}
+					}
+				};
+				fibonacci(15);
+			`,
+			expected: 610,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestBuiltinFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{`len("")`, 0},
+		{`len("four")`, 4},
+		{`len("hello world")`, 11},
+		{`len("héllo")`, 5},
+		{`let s = "héllo"; s[len(s) - 1]`, "o"},
+		{`len([1, 2, 3])`, 3},
+		{`len([])`, 0},
+		{
+			`len(1)`,
+			&object.Error{Message: "argument to `len` not supported, got INTEGER"},
+		},
+		{
+			`len("one", "two")`,
+			&object.Error{Message: "wrong number of arguments. got=2, want=1"},
+		},
+		{`puts("hello", "world!")`, Null},
+		{`push([1, 2], 3)`, []int{1, 2, 3}},
+		{`push([], 1)`, []int{1}},
+		{
+			`push(1, 1)`,
+			&object.Error{Message: "argument to `push` must be ARRAY, got INTEGER"},
+		},
+		{`let f = fn(a) { len(a) }; f([1, 2])`, 2},
+		{`len({})`, 0},
+		{`len({"a": 1, "b": 2})`, 2},
+		{`first([1, 2, 3])`, 1},
+		{`first([])`, Null},
+		{
+			`first(1)`,
+			&object.Error{Message: "argument to `first` must be ARRAY, got INTEGER"},
+		},
+		{`last([1, 2, 3])`, 3},
+		{`last([])`, Null},
+		{
+			`last(1)`,
+			&object.Error{Message: "argument to `last` must be ARRAY, got INTEGER"},
+		},
+		{`rest([1, 2, 3])`, []int{2, 3}},
+		{`rest([1])`, []int{}},
+		{`rest([])`, Null},
+		{
+			`rest(1)`,
+			&object.Error{Message: "argument to `rest` must be ARRAY, got INTEGER"},
+		},
+		{
+			`push([1])`,
+			&object.Error{Message: "wrong number of arguments. got=1, want=2"},
+		},
 	}
 
 	runVmTests(t, tests)
 }
+
+func TestModuloOperator(t *testing.T) {
+	tests := []vmProgramTestCase{
+		{
+			expressionProgram(
+				infixExpression(integerLiteral(10), "%", integerLiteral(3)),
+			),
+			1,
+		},
+		{
+			expressionProgram(
+				infixExpression(integerLiteral(9), "%", integerLiteral(3)),
+			),
+			0,
+		},
+		{
+			expressionProgram(
+				infixExpression(integerLiteral(-7), "%", integerLiteral(3)),
+			),
+			-1,
+		},
+		{
+			expressionProgram(
+				infixExpression(integerLiteral(7), "%", integerLiteral(-3)),
+			),
+			1,
+		},
+	}
+
+	runVmProgramTests(t, tests)
+
+	errorTests := []vmProgramTestCase{
+		{
+			withBindings("let zero = 0;", expressionProgram(
+				infixExpression(integerLiteral(10), "%", identifier("zero")),
+			)),
+			"integer modulo by zero",
+		},
+	}
+
+	runVmErrorTests(t, errorTests)
+}
+
+func TestBitwiseOperators(t *testing.T) {
+	tests := []vmProgramTestCase{
+		{
+			expressionProgram(
+				infixExpression(integerLiteral(12), "&", integerLiteral(10)),
+			),
+			8,
+		},
+		{
+			expressionProgram(
+				infixExpression(integerLiteral(12), "|", integerLiteral(10)),
+			),
+			14,
+		},
+		{
+			expressionProgram(
+				infixExpression(integerLiteral(12), "^", integerLiteral(10)),
+			),
+			6,
+		},
+		{
+			expressionProgram(
+				infixExpression(integerLiteral(-1), "&", integerLiteral(255)),
+			),
+			255,
+		},
+		{
+			expressionProgram(
+				infixExpression(integerLiteral(-16), "|", integerLiteral(3)),
+			),
+			-13,
+		},
+		{
+			expressionProgram(
+				infixExpression(integerLiteral(-1), "^", integerLiteral(5)),
+			),
+			-6,
+		},
+		{expressionProgram(prefixExpression("~", integerLiteral(5))), -6},
+		{expressionProgram(prefixExpression("~", integerLiteral(-1))), 0},
+	}
+
+	runVmProgramTests(t, tests)
+
+	errorTests := []vmProgramTestCase{
+		{
+			expressionProgram(
+				infixExpression(integerLiteral(1), "&", booleanLiteral(true)),
+			),
+			"unsupported operand types for OpBitAnd: INTEGER and BOOLEAN",
+		},
+		{
+			expressionProgram(
+				infixExpression(booleanLiteral(true), "|", booleanLiteral(false)),
+			),
+			"unsupported operand types for OpBitOr: BOOLEAN and BOOLEAN",
+		},
+		{
+			expressionProgram(
+				infixExpression(stringLiteral("a"), "^", stringLiteral("b")),
+			),
+			"unsupported operand types for OpBitXor: STRING and STRING",
+		},
+		{
+			expressionProgram(prefixExpression("~", stringLiteral("a"))),
+			"unsupported operand type for OpBitNot: STRING",
+		},
+	}
+
+	runVmErrorTests(t, errorTests)
+}
+
+func TestLogicalOperators(t *testing.T) {
+	// Calling fail is a runtime error, so it must not be reached
+	fail := &ast.CallExpression{Function: identifier("fail")}
+	bindings := "let fail = fn() { -true };"
+
+	tests := []vmProgramTestCase{
+		{
+			expressionProgram(
+				infixExpression(booleanLiteral(true), "&&", integerLiteral(5)),
+			),
+			5,
+		},
+		{
+			expressionProgram(
+				infixExpression(booleanLiteral(false), "||", integerLiteral(7)),
+			),
+			7,
+		},
+		{
+			expressionProgram(
+				infixExpression(booleanLiteral(true), "||", integerLiteral(7)),
+			),
+			true,
+		},
+		{
+			withBindings(bindings, expressionProgram(
+				infixExpression(booleanLiteral(false), "&&", fail),
+			)),
+			false,
+		},
+		{
+			withBindings(bindings, expressionProgram(
+				infixExpression(booleanLiteral(true), "||", fail),
+			)),
+			true,
+		},
+		{
+			expressionProgram(
+				infixExpression(
+					infixExpression(booleanLiteral(true), "&&", booleanLiteral(false)),
+					"||",
+					integerLiteral(3),
+				),
+			),
+			3,
+		},
+	}
+
+	runVmProgramTests(t, tests)
+}
+
+func TestNullCoalescing(t *testing.T) {
+	bindings := "let nothing = if (false) { 1 }; let arr = [1];"
+
+	tests := []vmProgramTestCase{
+		{
+			withBindings(bindings, expressionProgram(
+				infixExpression(identifier("nothing"), "??", integerLiteral(42)),
+			)),
+			42,
+		},
+		{
+			expressionProgram(
+				infixExpression(integerLiteral(5), "??", integerLiteral(42)),
+			),
+			5,
+		},
+		{
+			expressionProgram(
+				infixExpression(booleanLiteral(false), "??", integerLiteral(42)),
+			),
+			false,
+		},
+		{
+			withBindings(bindings, expressionProgram(
+				infixExpression(
+					&ast.IndexExpression{Left: identifier("arr"), Index: integerLiteral(5)},
+					"??",
+					integerLiteral(0),
+				),
+			)),
+			0,
+		},
+	}
+
+	runVmProgramTests(t, tests)
+}
+
+func TestIncrementOperators(t *testing.T) {
+	x := identifier("x")
+
+	tests := []vmProgramTestCase{
+		{
+			withBindings("let x = 5;", expressionProgram(
+				prefixExpression("++", x),
+				x,
+			)),
+			6,
+		},
+		{
+			withBindings("let x = 5;", expressionProgram(
+				prefixExpression("--", x),
+			)),
+			4,
+		},
+		{
+			withBindings("let x = 5;", expressionProgram(
+				infixExpression(prefixExpression("++", x), "+", prefixExpression("++", x)),
+			)),
+			13,
+		},
+	}
+
+	runVmProgramTests(t, tests)
+}
+
+func TestShiftOperators(t *testing.T) {
+	tests := []vmProgramTestCase{
+		{
+			expressionProgram(
+				infixExpression(integerLiteral(1), "<<", integerLiteral(4)),
+			),
+			16,
+		},
+		{
+			expressionProgram(
+				infixExpression(integerLiteral(256), ">>", integerLiteral(3)),
+			),
+			32,
+		},
+		{
+			expressionProgram(
+				infixExpression(integerLiteral(7), "<<", integerLiteral(0)),
+			),
+			7,
+		},
+		{
+			expressionProgram(
+				infixExpression(integerLiteral(7), ">>", integerLiteral(0)),
+			),
+			7,
+		},
+		{
+			expressionProgram(
+				infixExpression(integerLiteral(-16), ">>", integerLiteral(2)),
+			),
+			-4,
+		},
+	}
+
+	runVmProgramTests(t, tests)
+
+	errorTests := []vmProgramTestCase{
+		{
+			withBindings("let n = -1;", expressionProgram(
+				infixExpression(integerLiteral(1), "<<", identifier("n")),
+			)),
+			"negative shift amount: -1",
+		},
+		{
+			expressionProgram(
+				infixExpression(stringLiteral("a"), ">>", integerLiteral(1)),
+			),
+			"unsupported operand types for OpRightShift: STRING and INTEGER",
+		},
+	}
+
+	runVmErrorTests(t, errorTests)
+}
+
+func TestLessOrEqualGreaterOrEqual(t *testing.T) {
+	tests := []vmProgramTestCase{
+		{
+			expressionProgram(
+				infixExpression(integerLiteral(1), "<=", integerLiteral(1)),
+			),
+			true,
+		},
+		{
+			expressionProgram(
+				infixExpression(integerLiteral(2), "<=", integerLiteral(1)),
+			),
+			false,
+		},
+		{
+			expressionProgram(
+				infixExpression(integerLiteral(2), ">=", integerLiteral(3)),
+			),
+			false,
+		},
+		{
+			expressionProgram(
+				infixExpression(integerLiteral(3), ">=", integerLiteral(3)),
+			),
+			true,
+		},
+		{
+			// (1 <= 2) == (3 >= 4)
+			expressionProgram(
+				infixExpression(
+					infixExpression(integerLiteral(1), "<=", integerLiteral(2)),
+					"==",
+					infixExpression(integerLiteral(3), ">=", integerLiteral(4)),
+				),
+			),
+			false,
+		},
+		{
+			expressionProgram(
+				infixExpression(stringLiteral("a"), "<=", stringLiteral("a")),
+			),
+			true,
+		},
+		{
+			expressionProgram(
+				infixExpression(stringLiteral("b"), "<=", stringLiteral("a")),
+			),
+			false,
+		},
+		{
+			expressionProgram(
+				infixExpression(stringLiteral("ab"), ">=", stringLiteral("a")),
+			),
+			true,
+		},
+		{
+			expressionProgram(
+				infixExpression(stringLiteral("A"), ">=", stringLiteral("a")),
+			),
+			false,
+		},
+	}
+
+	runVmProgramTests(t, tests)
+}
+
+func TestWideOperands(t *testing.T) {
+	const count = math.MaxUint16 + 2
+
+	literals := []ast.Expression{}
+	for i := 0; i < count; i++ {
+		literals = append(literals, integerLiteral(int64(i)))
+	}
+
+	program := expressionProgram(literals...)
+	program.Statements = append(program.Statements,
+		parse("if (false) { 10 } else { 20 }").Statements...)
+
+	tests := []vmProgramTestCase{
+		{expressionProgram(literals...), count - 1},
+		{program, 20},
+	}
+
+	runVmProgramTests(t, tests)
+}
+
+func TestDup(t *testing.T) {
+	instructions := code.Instructions{}
+	instructions = append(instructions, code.Make(code.OpConstant, 0)...)
+	instructions = append(instructions, code.Make(code.OpDup)...)
+
+	bytecode := &compiler.Bytecode{
+		Instructions: instructions,
+		Constants:    []object.Object{&object.Integer{Value: 42}},
+	}
+
+	vm := New(bytecode)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	if vm.sp != 2 {
+		t.Fatalf("wrong stack depth. want=2, got=%d", vm.sp)
+	}
+
+	for i := 0; i < vm.sp; i++ {
+		if err := testIntegerObject(42, vm.stack[i]); err != nil {
+			t.Errorf("stack[%d]: %s", i, err)
+		}
+	}
+}
+
+func TestSwap(t *testing.T) {
+	instructions := code.Instructions{}
+	instructions = append(instructions, code.Make(code.OpConstant, 0)...)
+	instructions = append(instructions, code.Make(code.OpConstant, 1)...)
+	instructions = append(instructions, code.Make(code.OpSwap)...)
+
+	bytecode := &compiler.Bytecode{
+		Instructions: instructions,
+		Constants: []object.Object{
+			&object.Integer{Value: 1},
+			&object.Integer{Value: 2},
+		},
+	}
+
+	vm := New(bytecode)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	if vm.sp != 2 {
+		t.Fatalf("wrong stack depth. want=2, got=%d", vm.sp)
+	}
+
+	if err := testIntegerObject(1, vm.pop()); err != nil {
+		t.Errorf("top of stack: %s", err)
+	}
+	if err := testIntegerObject(2, vm.pop()); err != nil {
+		t.Errorf("second on stack: %s", err)
+	}
+}
+
+func TestLoop(t *testing.T) {
+	// let i = 0; while (3 > i) { i = i + 1 }; i
+	instructions := code.Instructions{}
+	emit := func(op code.Opcode, operands ...int) int {
+		pos := len(instructions)
+		instructions = append(instructions, code.Make(op, operands...)...)
+		return pos
+	}
+
+	emit(code.OpConstant, 0)
+	emit(code.OpSetGlobal, 0)
+
+	loopStart := emit(code.OpConstant, 1)
+	emit(code.OpGetGlobal, 0)
+	emit(code.OpGreaterThan)
+	exitJump := emit(code.OpJumpNotTruthy, 9999)
+
+	emit(code.OpGetGlobal, 0)
+	emit(code.OpConstant, 2)
+	emit(code.OpAdd)
+	emit(code.OpSetGlobal, 0)
+
+	loopPos := len(instructions)
+	emit(code.OpLoop, loopPos-loopStart)
+
+	copy(instructions[exitJump:], code.Make(code.OpJumpNotTruthy, len(instructions)))
+	emit(code.OpGetGlobal, 0)
+	emit(code.OpPop)
+
+	bytecode := &compiler.Bytecode{
+		Instructions: instructions,
+		Constants: []object.Object{
+			&object.Integer{Value: 0},
+			&object.Integer{Value: 3},
+			&object.Integer{Value: 1},
+		},
+	}
+
+	vm := New(bytecode)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	if err := testIntegerObject(3, vm.LastPoppedStackElement()); err != nil {
+		t.Errorf("testIntegerObject failed: %s", err)
+	}
+}
+
+func TestSerializedBytecode(t *testing.T) {
+	tests := []vmTestCase{
+		{`let x = "mon" + "key"; x`, "monkey"},
+		{
+			`
+			let newAdder = fn(a) { fn(b) { a + b } };
+			let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } };
+			newAdder(fib(10))(len([1, 2, 3]))
+			`,
+			58,
+		},
+		{`{"a": [1, 2]}["a"]`, []int{1, 2}},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		var buf bytes.Buffer
+		if _, err := comp.Bytecode().WriteTo(&buf); err != nil {
+			t.Fatalf("WriteTo error: %s", err)
+		}
+
+		bytecode, err := compiler.ReadFrom(&buf)
+		if err != nil {
+			t.Fatalf("ReadFrom error: %s", err)
+		}
+
+		vm := New(bytecode)
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElement())
+	}
+}
+
+func TestJSONBytecode(t *testing.T) {
+	input := `
+		let newAdder = fn(a) { fn(b) { a + b } };
+		let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } };
+		[newAdder(fib(10))(len("abc")), "done"]
+	`
+
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	data, err := json.Marshal(comp.Bytecode())
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+
+	var bytecode compiler.Bytecode
+	if err := json.Unmarshal(data, &bytecode); err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+
+	vm := New(&bytecode)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	result, ok := vm.LastPoppedStackElement().(*object.Array)
+	if !ok || len(result.Elements) != 2 {
+		t.Fatalf("wrong result: %s", vm.LastPoppedStackElement().Inspect())
+	}
+	testExpectedObject(t, 58, result.Elements[0])
+	testExpectedObject(t, "done", result.Elements[1])
+}
+
+func TestStackDepthCheckedBeforeRun(t *testing.T) {
+	elements := []ast.Expression{}
+	for i := 0; i < StackSize+1; i++ {
+		elements = append(elements, integerLiteral(1))
+	}
+
+	tests := []vmProgramTestCase{
+		{
+			expressionProgram(&ast.ArrayLiteral{Elements: elements}),
+			fmt.Sprintf("stack overflow: program needs %d stack slots, StackSize is %d",
+				StackSize+1, StackSize),
+		},
+	}
+
+	runVmErrorTests(t, tests)
+}
+
+func TestMaxCallDepth(t *testing.T) {
+	// The addition keeps the recursive call out of tail position
+	countDown := `
+		let countDown = fn(x) { if (x == 0) { return 0; } countDown(x - 1) + 0 };
+		countDown(%d);
+	`
+
+	tests := []struct {
+		input        string
+		maxCallDepth int
+		expected     interface{}
+	}{
+		{fmt.Sprintf(countDown, 500), MaxFrames, 0},
+		{fmt.Sprintf(countDown, 50), 100, 0},
+		{fmt.Sprintf(countDown, 200), 100, "stack overflow: max call depth 100 exceeded"},
+		// Calls deeper than MaxFrames grow the call stack
+		{"let f = fn() { f() + 1 }; f()", 2000, "stack overflow: max call depth 2000 exceeded"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode()).WithMaxCallDepth(tt.maxCallDepth)
+		err := vm.Run()
+
+		if message, ok := tt.expected.(string); ok {
+			if err == nil || err.Error() != message {
+				t.Errorf("wrong VM error: want=%q, got=%v", message, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElement())
+	}
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			`let countdown = fn(n) { if (n == 0) { return 0 }; countdown(n - 1) };
+			countdown(10000)`,
+			0,
+		},
+		{
+			// The call in a branch jumps to the return
+			`let sum = fn(n, acc) { if (n == 0) { acc } else { sum(n - 1, acc + n) } };
+			sum(10000, 0)`,
+			50005000,
+		},
+		{
+			// Locals of the previous call don't leak into the next one
+			`let f = fn(n) { let twice = n * 2; if (n == 0) { twice } else { f(n - 1) } };
+			f(5000)`,
+			0,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRunWithContext(t *testing.T) {
+	// An OpLoop back to itself never ends
+	bytecode := &compiler.Bytecode{Instructions: code.Make(code.OpLoop, 0)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := New(bytecode).RunWithContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected error wrapping context.DeadlineExceeded, got=%v", err)
+	}
+
+	comp := compiler.New()
+	if err := comp.Compile(parse("1 + 2")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	if err := vm.RunWithContext(context.Background()); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 3, vm.LastPoppedStackElement())
+}
+
+func TestMaxInstructions(t *testing.T) {
+	loop := code.Instructions{}
+	loop = append(loop, code.Make(code.OpNull)...)
+	loop = append(loop, code.Make(code.OpPop)...)
+	loop = append(loop, code.Make(code.OpLoop, 2)...)
+
+	err := New(&compiler.Bytecode{Instructions: loop}).WithMaxInstructions(10).Run()
+	expected := "execution limit reached after 10 instructions"
+	if err == nil || err.Error() != expected {
+		t.Errorf("wrong VM error: want=%q, got=%v", expected, err)
+	}
+
+	comp := compiler.New()
+	if err := comp.Compile(parse("1; 2")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.Bytecode()
+
+	// OpConstant, OpPop, OpConstant, OpPop
+	if err := New(bytecode).WithMaxInstructions(4).Run(); err != nil {
+		t.Errorf("program within the limit failed: %s", err)
+	}
+
+	err = New(bytecode).WithMaxInstructions(3).Run()
+	expected = "execution limit reached after 3 instructions"
+	if err == nil || err.Error() != expected {
+		t.Errorf("wrong VM error: want=%q, got=%v", expected, err)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	tests := []struct {
+		input    string
+		opts     []Option
+		expected interface{}
+	}{
+		{"[1, 2, 3, 4]", []Option{WithStackSize(4)}, []int{1, 2, 3, 4}},
+		{
+			"[1, 2, 3, 4, 5]",
+			[]Option{WithStackSize(4)},
+			"stack overflow: program needs 5 stack slots, StackSize is 4",
+		},
+		// Function frames aren't part of the up front check
+		{"let f = fn(a) { [a, a, a] }; f(1)", []Option{WithStackSize(4)}, "stack overflow"},
+		{"let f = fn(a, b) { let c = a; c }; f(1, 2)", []Option{WithStackSize(3)}, "stack overflow"},
+		{"let a = 1; let b = 2; a + b", []Option{WithGlobalSize(2)}, 3},
+		{"let a = 1; let b = 2; let c = 3;", []Option{WithGlobalSize(2)}, "global 2 out of range"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode(), tt.opts...)
+		err := vm.Run()
+
+		if message, ok := tt.expected.(string); ok {
+			if err == nil || err.Error() != message {
+				t.Errorf("%s: wrong VM error: want=%q, got=%v", tt.input, message, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElement())
+	}
+}
+
+func TestConcurrentGlobals(t *testing.T) {
+	comp := compiler.New()
+	if err := comp.Compile(parse("let a = 1; let b = a + 1; b")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.Bytecode()
+
+	// Run with -race to check the locking. Each store is shared by its own
+	// VMs, the two don't affect each other.
+	stores := []*Globals{NewGlobals(GlobalSize), NewGlobals(8)}
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+
+	for _, globals := range stores {
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func(globals *Globals) {
+				defer wg.Done()
+
+				vm := NewWithGlobalsStore(bytecode, globals)
+				for j := 0; j < 100; j++ {
+					vm.Reset(bytecode)
+					if err := vm.Run(); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}(globals)
+		}
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	for _, globals := range stores {
+		values := globals.Values()
+		testExpectedObject(t, 1, values[0])
+		testExpectedObject(t, 2, values[1])
+	}
+
+	if n := len(stores[1].Values()); n != 8 {
+		t.Errorf("wrong number of globals. want=8, got=%d", n)
+	}
+
+	if New(bytecode).ConcurrentGlobals {
+		t.Errorf("ConcurrentGlobals on by default")
+	}
+	if !NewWithGlobalsStore(bytecode, stores[0]).ConcurrentGlobals {
+		t.Errorf("ConcurrentGlobals off for a shared store")
+	}
+}
+
+func TestStackTop(t *testing.T) {
+	vm := New(&compiler.Bytecode{})
+	if top := vm.StackTop(); top != nil {
+		t.Errorf("StackTop of empty stack is not nil. got=%+v", top)
+	}
+
+	// Leave a value on the stack by not popping it
+	bytecode := &compiler.Bytecode{
+		Instructions: code.Make(code.OpConstant, 0),
+		Constants:    []object.Object{&object.Integer{Value: 7}},
+	}
+
+	vm = New(bytecode)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 7, vm.StackTop())
+}
+
+func TestGlobals(t *testing.T) {
+	comp := compiler.New()
+	if err := comp.Compile(parse("let one = 1; let two = one + 1; two")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	for index, expected := range []int{1, 2} {
+		global, err := vm.GlobalAt(index)
+		if err != nil {
+			t.Fatalf("GlobalAt(%d) error: %s", index, err)
+		}
+		testExpectedObject(t, expected, global)
+	}
+
+	if global, err := vm.GlobalAt(2); err != nil || global != nil {
+		t.Errorf("unset global: want=nil, got=%v (%v)", global, err)
+	}
+
+	for _, index := range []int{-1, GlobalSize} {
+		_, err := vm.GlobalAt(index)
+		expected := fmt.Sprintf("global %d out of range", index)
+		if err == nil || err.Error() != expected {
+			t.Errorf("wrong error: want=%q, got=%v", expected, err)
+		}
+	}
+
+	globals := vm.Globals()
+	if len(globals) != GlobalSize {
+		t.Fatalf("wrong number of globals. want=%d, got=%d", GlobalSize, len(globals))
+	}
+	testExpectedObject(t, 2, globals[1])
+
+	// The copy doesn't alias the VM's globals
+	globals[0] = Null
+	if global, _ := vm.GlobalAt(0); global == Null {
+		t.Errorf("changing the copy changed the VM's globals")
+	}
+}
+
+func TestTrace(t *testing.T) {
+	comp := compiler.New()
+	if err := comp.Compile(parse("let a = 1; a + 2")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var out bytes.Buffer
+	vm := New(comp.Bytecode())
+	vm.Trace(&out)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	expected := []string{
+		"0000 OpConstant 0   sp=0 top=<empty>",
+		"0003 OpSetGlobal 0  sp=1 top=<INTEGER: 1>",
+		"0006 OpGetGlobal 0  sp=0 top=<empty>",
+		"0009 OpConstant 1   sp=1 top=<INTEGER: 1>",
+		"0012 OpAdd          sp=2 top=<INTEGER: 2>",
+		"0013 OpPop          sp=1 top=<INTEGER: 3>",
+	}
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("wrong number of trace lines. want=%d, got=%d\n%s",
+			len(expected), len(lines), out.String())
+	}
+
+	for i, want := range expected {
+		if lines[i] != want {
+			t.Errorf("wrong trace line %d.\nwant=%q\ngot= %q", i, want, lines[i])
+		}
+	}
+
+	// Turning tracing off writes nothing more
+	out.Reset()
+	vm = New(comp.Bytecode())
+	vm.Trace(&out)
+	vm.Trace(nil)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("trace written with tracing off: %q", out.String())
+	}
+}
+
+func TestStep(t *testing.T) {
+	ins := code.Instructions{}
+	ins = append(ins, code.Make(code.OpConstant, 0)...)
+	ins = append(ins, code.Make(code.OpConstant, 1)...)
+	ins = append(ins, code.Make(code.OpAdd)...)
+	ins = append(ins, code.Make(code.OpConstant, 0)...)
+	ins = append(ins, code.Make(code.OpSub)...)
+
+	bytecode := &compiler.Bytecode{
+		Instructions: ins,
+		Constants: []object.Object{
+			&object.Integer{Value: 1},
+			&object.Integer{Value: 2},
+		},
+	}
+
+	steps := []struct {
+		ip    int
+		op    code.Opcode
+		stack []int
+	}{
+		{0, code.OpConstant, []int{1}},
+		{3, code.OpConstant, []int{1, 2}},
+		{6, code.OpAdd, []int{3}},
+		{7, code.OpConstant, []int{3, 1}},
+		{10, code.OpSub, []int{2}},
+	}
+
+	vm := New(bytecode)
+
+	var calls []int
+	vm.SetStepCallback(func(ip int, op code.Opcode) {
+		calls = append(calls, ip)
+		if op != code.Opcode(ins[ip]) {
+			t.Errorf("callback opcode at %d: want=%s, got=%s", ip, code.Opcode(ins[ip]), op)
+		}
+	})
+
+	for i, step := range steps {
+		if vm.IP() != step.ip {
+			t.Fatalf("step %d: wrong ip. want=%d, got=%d", i, step.ip, vm.IP())
+		}
+
+		done, err := vm.Step()
+		if err != nil {
+			t.Fatalf("step %d: vm error: %s", i, err)
+		}
+		if want := i == len(steps)-1; done != want {
+			t.Fatalf("step %d: wrong done. want=%t, got=%t", i, want, done)
+		}
+
+		if vm.sp != len(step.stack) {
+			t.Fatalf("step %d: wrong stack size. want=%d, got=%d", i, len(step.stack), vm.sp)
+		}
+		for j, expected := range step.stack {
+			testExpectedObject(t, expected, vm.stack[j])
+		}
+
+		if calls[i] != step.ip {
+			t.Errorf("step %d: callback ip. want=%d, got=%d", i, step.ip, calls[i])
+		}
+	}
+
+	// Stepping past the end executes nothing
+	done, err := vm.Step()
+	if !done || err != nil {
+		t.Errorf("step past the end: want done, got done=%t, err=%v", done, err)
+	}
+	if len(calls) != len(steps) {
+		t.Errorf("wrong number of callbacks. want=%d, got=%d", len(steps), len(calls))
+	}
+}
+
+func TestReset(t *testing.T) {
+	compile := func(input string, symbolTable *compiler.SymbolTable,
+		constants []object.Object) *compiler.Bytecode {
+		comp := compiler.NewWithState(symbolTable, constants)
+		if err := comp.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		return comp.Bytecode()
+	}
+
+	symbolTable := compiler.NewSymbolTable()
+	first := compile("let f = fn(x) { x * 2 }; f(2)", symbolTable, nil)
+
+	vm := New(first).WithMaxInstructions(100)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 4, vm.LastPoppedStackElement())
+
+	// Globals set by the first program are visible to the second
+	second := compile("f(5)", symbolTable, first.Constants)
+	vm.Reset(second)
+	if vm.sp != 0 || vm.framesIndex != 1 || vm.IP() != 0 {
+		t.Fatalf("state not reset: sp=%d, framesIndex=%d, ip=%d",
+			vm.sp, vm.framesIndex, vm.IP())
+	}
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 10, vm.LastPoppedStackElement())
+
+	if vm.MaxInstructions != 100 {
+		t.Errorf("MaxInstructions not kept. want=100, got=%d", vm.MaxInstructions)
+	}
+
+	// A failed run leaves frames behind, Reset discards them
+	vm.Reset(compile("let g = fn() { -true }; g()", symbolTable, second.Constants))
+	if err := vm.Run(); err == nil {
+		t.Fatalf("expected VM error but resulted in none.")
+	}
+	vm.Reset(compile("f(1)", symbolTable, second.Constants))
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 2, vm.LastPoppedStackElement())
+}
+
+func benchmarkProgram(b *testing.B) *compiler.Bytecode {
+	comp := compiler.New()
+	if err := comp.Compile(parse("let a = [1, 2, 3]; a[1] + a[2]")); err != nil {
+		b.Fatalf("compiler error: %s", err)
+	}
+	return comp.Bytecode()
+}
+
+func FuzzVM(f *testing.F) {
+	for _, seed := range [][]byte{
+		{},
+		code.Make(code.OpTrue),
+		append(code.Make(code.OpNull), code.Make(code.OpPop)...),
+		append(code.Make(code.OpFalse), code.Make(code.OpJumpNotTruthy, 0)...),
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpLoop, 0),
+		code.Make(code.OpJump, 1)[:2],
+		{255},
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, instructions []byte) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("VM panicked on %v: %v", instructions, r)
+			}
+		}()
+
+		bytecode := &compiler.Bytecode{
+			Instructions: instructions,
+			Constants:    []object.Object{},
+		}
+
+		// Loops in the input must not hang the fuzzer. Errors are fine,
+		// including recovered ones, and so is describing where they happened.
+		vm := New(bytecode).WithMaxInstructions(10000)
+		if err := vm.Run(); err != nil {
+			vm.CallStack()
+		}
+	})
+}
+
+func BenchmarkNew(b *testing.B) {
+	bytecode := benchmarkProgram(b)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if err := New(bytecode).Run(); err != nil {
+			b.Fatalf("vm error: %s", err)
+		}
+	}
+}
+
+func BenchmarkReset(b *testing.B) {
+	bytecode := benchmarkProgram(b)
+	vm := New(bytecode)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		vm.Reset(bytecode)
+		if err := vm.Run(); err != nil {
+			b.Fatalf("vm error: %s", err)
+		}
+	}
+}
+
+// benchmarkRun compiles input once and runs it b.N times in the same VM
+func benchmarkRun(b *testing.B, input string) {
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		b.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.Bytecode()
+
+	vm := New(bytecode)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		vm.Reset(bytecode)
+		if err := vm.Run(); err != nil {
+			b.Fatalf("vm error: %s", err)
+		}
+	}
+}
+
+func BenchmarkVMIntegerArithmetic(b *testing.B) {
+	benchmarkRun(b, `
+		let sum = fn(n, acc) { if (n == 0) { acc } else { sum(n - 1, acc + n * 2 - 1) } };
+		sum(1000, 0)
+	`)
+}
+
+func BenchmarkVMConditionals(b *testing.B) {
+	benchmarkRun(b, `
+		let count = fn(n, even) {
+			if (n == 0) { return 0; }
+			if (even) { count(n - 1, false) } else { count(n - 1, true) }
+		};
+		count(1000, true)
+	`)
+}
+
+func BenchmarkVMGlobalAccess(b *testing.B) {
+	// Identifiers can't contain digits, spell the numbers with letters
+	name := func(i int) string {
+		return "g" + strings.Map(func(r rune) rune { return r - '0' + 'a' }, fmt.Sprint(i))
+	}
+
+	var input strings.Builder
+	fmt.Fprintf(&input, "let %s = 1;", name(0))
+	for i := 1; i < 500; i++ {
+		fmt.Fprintf(&input, "let %s = %s + 1;", name(i), name(i-1))
+	}
+	benchmarkRun(b, input.String())
+}
+
+func BenchmarkVMStringConcat(b *testing.B) {
+	benchmarkRun(b, `
+		let build = fn(n, s) { if (n == 0) { s } else { build(n - 1, s + "ab") } };
+		build(500, "")
+	`)
+}
+
+func BenchmarkVMArrayBuild(b *testing.B) {
+	elements := make([]string, 1000)
+	for i := range elements {
+		elements[i] = fmt.Sprint(i)
+	}
+	benchmarkRun(b, "["+strings.Join(elements, ", ")+"]")
+}
+
+func TestErrorValues(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			"let r = -true; r",
+			&object.Error{Message: "unsupported operand type for OpMinus: BOOLEAN"},
+		},
+		{"let r = -true; if (r) { 1 } else { 2 }", 1},
+		{"let zero = 0; let r = 1 / zero; if (!r) { 1 } else { 2 }", 2},
+		{
+			"let f = fn(x) { x }; f([1][true])",
+			&object.Error{Message: "array index must be INTEGER, got BOOLEAN"},
+		},
+		{
+			`let r = {}[fn() {}]; [r, 1][1]`,
+			1,
+		},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		vm.ErrorValues = true
+		if err := vm.Run(); err != nil {
+			t.Fatalf("%s: vm error: %s", tt.input, err)
+		}
+
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElement())
+	}
+
+	// Operating on an error value stops the program
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{"let r = -true; r + 1", "unsupported operand type for OpMinus: BOOLEAN"},
+		{"let r = len(1); -r", "argument to `len` not supported, got INTEGER"},
+		{`let r = "a" - "b"; r[0]`, "unsupported operand types for OpSub: STRING and STRING"},
+		{"let r = -true; r()", "unsupported operand type for OpMinus: BOOLEAN"},
+	}
+
+	for _, tt := range errorTests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		vm.ErrorValues = true
+		err := vm.Run()
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("%s: wrong VM error: want=%q, got=%v", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestOperandTypeErrors(t *testing.T) {
+	tests := []vmProgramTestCase{
+		{parse("1 + true"), "unsupported operand types for OpAdd: INTEGER and BOOLEAN"},
+		{parse(`"a" * "b"`), "unsupported operand types for OpMul: STRING and STRING"},
+		{parse(`[] - "a"`), "unsupported operand types for OpSub: ARRAY and STRING"},
+		{parse("1 > true"), "unsupported operand types for OpGreaterThan: INTEGER and BOOLEAN"},
+		{parse("true < false"), "unsupported operand types for OpLessThan: BOOLEAN and BOOLEAN"},
+		{parse(`1 * "a"`), "unsupported operand types for OpMul: INTEGER and STRING"},
+		{parse(`"ab" * 9223372036854775807`), "string repetition too long: 2 * 9223372036854775807"},
+		{parse(`"a" < 1`), "unsupported operand types for OpLessThan: STRING and INTEGER"},
+		{parse("-true"), "unsupported operand type for OpMinus: BOOLEAN"},
+		{parse(`-"a"`), "unsupported operand type for OpMinus: STRING"},
+	}
+
+	runVmErrorTests(t, tests)
+}
+
+func TestCallStack(t *testing.T) {
+	input := `
+		let inner = fn(x) { -x };
+		let outer = fn() { fn() { inner(true) }() };
+		outer();
+	`
+
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	if err := vm.Run(); err == nil {
+		t.Fatalf("expected VM error but resulted in none.")
+	}
+
+	// Each frame stopped at its failing instruction or its call
+	expected := []FrameInfo{
+		{"inner", 2},
+		{"<anonymous>", 4},
+		{"outer", 4},
+		{"<main>", 17},
+	}
+
+	stack := vm.CallStack()
+	if len(stack) != len(expected) {
+		t.Fatalf("wrong call stack. want=%+v, got=%+v", expected, stack)
+	}
+	for i, frame := range expected {
+		if stack[i] != frame {
+			t.Errorf("wrong frame %d. want=%+v, got=%+v", i, frame, stack[i])
+		}
+	}
+}
+
+func TestUndefinedOpcode(t *testing.T) {
+	// Holds in both dispatch modes, run with -tags dispatch_table too
+	bytecode := &compiler.Bytecode{Instructions: code.Instructions{255}}
+
+	err := New(bytecode).Run()
+	if err == nil || err.Error() != "opcode 255 undefined" {
+		t.Errorf("wrong VM error: want=%q, got=%v", "opcode 255 undefined", err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	compile := func(input string) *compiler.Bytecode {
+		comp := compiler.New()
+		if err := comp.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		return comp.Bytecode()
+	}
+
+	base := compile(`let a = 10; let add = fn(x) { x + a };`)
+	extension := compile(`
+	let b = 5;
+	let max = fn(x, y) { if (x > y) { x } else { y } };
+	max(b, 3) * b`)
+
+	merged, err := compiler.Merge(base, extension)
+	if err != nil {
+		t.Fatalf("merge error: %s", err)
+	}
+
+	vm := New(merged)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	testExpectedObject(t, 25, vm.LastPoppedStackElement())
+
+	// The globals of both programs keep their values
+	globals := vm.Globals()
+	testExpectedObject(t, 10, globals[0])
+	testExpectedObject(t, 5, globals[2])
+}
+
+func TestIsNull(t *testing.T) {
+	instructions := code.Instructions{}
+	instructions = append(instructions, code.Make(code.OpNull)...)
+	instructions = append(instructions, code.Make(code.OpIsNull)...)
+	instructions = append(instructions, code.Make(code.OpPop)...)
+	instructions = append(instructions, code.Make(code.OpFalse)...)
+	instructions = append(instructions, code.Make(code.OpIsNull)...)
+	instructions = append(instructions, code.Make(code.OpPop)...)
+
+	vm := New(&compiler.Bytecode{Instructions: instructions})
+
+	for _, expected := range []bool{true, false} {
+		for i := 0; i < 3; i++ {
+			if _, err := vm.Step(); err != nil {
+				t.Fatalf("vm error: %s", err)
+			}
+		}
+
+		if err := testBooleanObject(expected, vm.LastPoppedStackElement()); err != nil {
+			t.Errorf("testBooleanObject failed: %s", err)
+		}
+	}
+}
+
+// brokenInteger claims to be an integer without being an *object.Integer
+type brokenInteger struct{}
+
+func (b *brokenInteger) Type() object.ObjectType { return object.INTEGER_OBJ }
+func (b *brokenInteger) Inspect() string         { return "broken" }
+
+func TestPanicRecovery(t *testing.T) {
+	instructions := code.Instructions{}
+	instructions = append(instructions, code.Make(code.OpConstant, 0)...)
+	instructions = append(instructions, code.Make(code.OpConstant, 1)...)
+	instructions = append(instructions, code.Make(code.OpAdd)...)
+
+	bytecode := &compiler.Bytecode{
+		Instructions: instructions,
+		Constants:    []object.Object{&brokenInteger{}, &object.Integer{Value: 1}},
+	}
+
+	var log bytes.Buffer
+	vm := New(bytecode)
+	vm.LogPanics(&log)
+
+	err := vm.Run()
+	if err == nil {
+		t.Fatalf("expected VM error but resulted in none.")
+	}
+	if !strings.HasPrefix(err.Error(), "internal VM error: ") {
+		t.Errorf("wrong VM error: %q", err)
+	}
+	if !strings.Contains(log.String(), "executeBinaryIntegerOberation") {
+		t.Errorf("stack trace missing from log: %q", log.String())
+	}
+}